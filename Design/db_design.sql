@@ -2,14 +2,19 @@
 CREATE TABLE Users (
     UserID SERIAL PRIMARY KEY,
     username VARCHAR(255),
-    password VARCHAR(255)
+    password VARCHAR(255),
+    email VARCHAR(255) UNIQUE -- optional, lets other customers send tickets to the user
 );
 
 -- Venue Table
 CREATE TABLE Venue (
     VenueID SERIAL PRIMARY KEY,
     VenueName VARCHAR(255),
-    VenueLocation VARCHAR(255)
+    VenueLocation VARCHAR(255),
+    Currency CHAR(3) DEFAULT 'USD', -- ISO 4217, every amount at the venue is in this currency
+    Booking_fee BIGINT DEFAULT 0, -- minor units, charged once per order
+    Service_fee BIGINT DEFAULT 0, -- minor units, charged per ticket
+    Tax_rate_bps INTEGER DEFAULT 0 -- tax on tickets and fees, in basis points
 );
 
 -- Hall Table
@@ -17,6 +22,7 @@ CREATE TABLE Hall (
     HallID SERIAL PRIMARY KEY,
     VenueID INTEGER REFERENCES Venue(VenueID),
     Capacity INTEGER,
+    Turnover_minutes INTEGER DEFAULT 30 -- cleaning/changeover time kept free after each show
 );
 
 -- Seat Table
@@ -28,6 +34,20 @@ CREATE TABLE Seat (
     Category VARCHAR(255)
 );
 
+-- Needed for the hall overlap exclusion constraint on Show
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+-- Schedule Table, a recurring run of performances of one show
+CREATE TABLE Schedule (
+    ScheduleID SERIAL PRIMARY KEY,
+    ShowName VARCHAR(255),
+    VenueID INTEGER REFERENCES Venue(VenueID),
+    HallID INTEGER REFERENCES Hall(HallID),
+    Rule JSONB, -- recurrence rule the shows were generated from
+    Status VARCHAR(20) DEFAULT 'active',
+    Created_at TIMESTAMP DEFAULT NOW()
+);
+
 -- Show Table
 CREATE TABLE Show (
     ShowID SERIAL PRIMARY KEY,
@@ -36,20 +56,332 @@ CREATE TABLE Show (
     HallID INTEGER REFERENCES Hall(HallID),
     Time_start TIMESTAMP,
     Time_end TIMESTAMP,
+    Blocked_until TIMESTAMP, -- Time_end plus the turnover time of the hall
     totalcapacity INTEGER,
-    currentusage INTEGER
+    currentusage INTEGER,
+    Status VARCHAR(20) DEFAULT 'scheduled',
+    ScheduleID INTEGER REFERENCES Schedule(ScheduleID),
+    Transfers_allowed BOOLEAN DEFAULT TRUE, -- whether customers can pass tickets on to each other
+    Transfer_cutoff_minutes INTEGER DEFAULT 0, -- transfers close this long before Time_start
+    Max_transfers INTEGER, -- times one seat's ticket can change hands, NULL for no limit
+    Resale_allowed BOOLEAN DEFAULT FALSE, -- whether customers can list tickets for resale
+    Resale_price_cap_pct INTEGER DEFAULT 100, -- highest listing price, in percent of the face value
+    Resale_fee_bps INTEGER DEFAULT 0, -- taken from the seller's payout
+    Waiting_room_opens TIMESTAMP, -- users queueing from then until On_sale_start are let in in a random order
+    On_sale_start TIMESTAMP, -- claimSeat and checkPayment require a waitingRoom admission token from then
+    On_sale_end TIMESTAMP, -- until then
+    Admit_per_minute INTEGER, -- users waitingRoom lets in per minute
+    Max_seats_per_order INTEGER, -- purchase limits, NULL for no limit
+    Max_seats_per_user INTEGER, -- seats one user can have booked or claimed
+    Max_held_seats INTEGER, -- seats one user can have claimed and not booked yet
+    UNIQUE (ShowName, VenueID, HallID, Time_start),
+    CHECK (Time_end > Time_start),
+    CONSTRAINT show_hall_no_overlap EXCLUDE USING gist (
+        HallID WITH =,
+        tsrange(Time_start, Blocked_until) WITH &&
+    ) WHERE (Status <> 'cancelled')
 );
 
 -- Reservation Table
 CREATE TABLE Reservation (
     ReservationID SERIAL PRIMARY KEY,
     SeatReservationID VARCHAR(255),
+    ShowID INTEGER REFERENCES Show(ShowID),
     last_claim TIMESTAMP,
     ClaimedbyID INTEGER REFERENCES Users(UserID),
     BookedbyID INTEGER REFERENCES Users(UserID),
     Booked BOOLEAN,
-    Booking_confirmID VARCHAR(255)
+    Booking_confirmID VARCHAR(255), -- Orders.Reference of the order the seat was booked in
+    Claimed_price BIGINT, -- price locked in when the seat was claimed, in minor units
+    Claimed_currency CHAR(3),
+    Checked_in_at TIMESTAMP, -- set by checkIn when the ticket for the seat is scanned
+    Held_for INTEGER REFERENCES Users(UserID), -- waitlisted user the free seat is offered to
+    Held_until TIMESTAMP, -- nobody else can claim the seat before then
+    Released_at TIMESTAMP -- a claim was released or the booking refunded, the waitlist offers it
+);
+
+-- PriceTier Table, base price of a seat category for one show
+CREATE TABLE PriceTier (
+    ShowID INTEGER REFERENCES Show(ShowID),
+    Category VARCHAR(255),
+    Price_minor BIGINT, -- in minor units of the venue currency
+    PRIMARY KEY (ShowID, Category)
+);
+
+-- PriceRule Table, adjustments applied on top of the tier price
+CREATE TABLE PriceRule (
+    RuleID SERIAL PRIMARY KEY,
+    ShowID INTEGER REFERENCES Show(ShowID),
+    Category VARCHAR(255), -- NULL applies to every category
+    Kind VARCHAR(20), -- early_bird, last_minute or demand
+    Hours_before INTEGER, -- early_bird: until this many hours before the show, last_minute: from
+    Seats_left_below FLOAT, -- demand: applies when the share of seats left drops below this
+    Percent FLOAT -- price change, negative for a discount
+);
+
+-- Voucher Table, promo codes applied at checkout
+CREATE TABLE Voucher (
+    Code VARCHAR(64) PRIMARY KEY, -- stored upper case
+    Kind VARCHAR(20), -- percent or fixed
+    Amount BIGINT, -- fixed: minor units taken off the eligible seats, NULL for percent
+    Percent_bps INTEGER, -- percent: basis points taken off the eligible seats (10000 is 100%), NULL for fixed
+    ShowID INTEGER REFERENCES Show(ShowID), -- NULL for every show
+    Category VARCHAR(255), -- NULL for every seat category
+    Max_uses INTEGER, -- NULL for unlimited
+    Max_uses_per_user INTEGER, -- NULL for unlimited
+    Used_count INTEGER DEFAULT 0,
+    Valid_from TIMESTAMP,
+    Valid_until TIMESTAMP,
+    -- A voucher that could take off more than the seats cost, or nothing, is refused when created
+    CHECK ((Kind = 'percent' AND Percent_bps > 0 AND Percent_bps <= 10000 AND Amount IS NULL)
+        OR (Kind = 'fixed' AND Amount > 0 AND Percent_bps IS NULL)),
+    CHECK (Max_uses IS NULL OR Max_uses > 0),
+    CHECK (Max_uses_per_user IS NULL OR Max_uses_per_user > 0),
+    CHECK (Valid_from IS NULL OR Valid_until IS NULL OR Valid_from < Valid_until)
+);
+
+-- VoucherRedemption Table, written in the booking transaction
+CREATE TABLE VoucherRedemption (
+    RedemptionID SERIAL PRIMARY KEY,
+    Code VARCHAR(64) REFERENCES Voucher(Code),
+    UserID INTEGER REFERENCES Users(UserID),
+    ShowID INTEGER REFERENCES Show(ShowID),
+    Paymentconf_id INTEGER,
+    Discount BIGINT, -- minor units
+    Created_at TIMESTAMP DEFAULT NOW()
 );
 
+-- Receipt Table, itemized amounts of an order as charged by checkPayment
+CREATE TABLE Receipt (
+    ReceiptID SERIAL PRIMARY KEY,
+    Paymentconf_id INTEGER UNIQUE,
+    UserID INTEGER REFERENCES Users(UserID),
+    ShowID INTEGER REFERENCES Show(ShowID),
+    Currency CHAR(3),
+    Subtotal BIGINT, -- every amount is in minor units of Currency
+    Discount BIGINT,
+    Service_fee BIGINT,
+    Booking_fee BIGINT,
+    Tax_rate_bps INTEGER,
+    Tax BIGINT,
+    Total BIGINT,
+    Lines JSONB, -- seat, category and price of every ticket
+    Created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Notification Table, filled when a show is rescheduled, moved or cancelled, or a waitlist
+-- offer is made. outboxRelay emails them, Sent stays FALSE for customers without an email
+CREATE TABLE Notification (
+    NotificationID SERIAL PRIMARY KEY,
+    UserID INTEGER REFERENCES Users(UserID),
+    ShowID INTEGER REFERENCES Show(ShowID),
+    Message TEXT,
+    Sent BOOLEAN DEFAULT FALSE,
+    Created_at TIMESTAMP DEFAULT NOW()
+);
 
+-- Refund Table, one row per order of a cancelled show, or per customer for seats booked
+-- before Orders existed, those have no Paymentconf_id and are paid back by support
+-- Status: pending until checkPayment refunds the payment, then refunded, or failed
+CREATE TABLE Refund (
+    RefundID SERIAL PRIMARY KEY,
+    ShowID INTEGER REFERENCES Show(ShowID),
+    UserID INTEGER REFERENCES Users(UserID),
+    Paymentconf_id INTEGER,
+    Amount BIGINT, -- minor units
+    Currency CHAR(3),
+    Status VARCHAR(20) DEFAULT 'pending',
+    Created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Payment Table, one row per checkout attempt, Status follows the state machine in checkPayment
+-- created -> authorized -> captured -> refunded, or voided/failed when it doesn't go through
+CREATE TABLE Payment (
+    PaymentID SERIAL PRIMARY KEY,
+    Paymentconf_id INTEGER UNIQUE,
+    UserID INTEGER REFERENCES Users(UserID),
+    ShowID INTEGER REFERENCES Show(ShowID),
+    Amount BIGINT, -- minor units
+    Currency CHAR(3),
+    Status VARCHAR(20) DEFAULT 'created',
+    Created_at TIMESTAMP DEFAULT NOW(),
+    Updated_at TIMESTAMP DEFAULT NOW()
+);
+
+-- PaymentEvent Table, every status change of a payment
+CREATE TABLE PaymentEvent (
+    EventID SERIAL PRIMARY KEY,
+    PaymentID INTEGER REFERENCES Payment(PaymentID),
+    From_status VARCHAR(20), -- NULL for the creation
+    To_status VARCHAR(20),
+    Reason TEXT,
+    Created_at TIMESTAMP DEFAULT NOW()
+);
 
+-- Saga Table, one row per purchase driven by the orchestrator
+-- Step: claim -> checkout -> payment -> done
+-- Status: running, compensating, completed, aborted or failed
+CREATE TABLE Saga (
+    SagaID SERIAL PRIMARY KEY,
+    UserID INTEGER REFERENCES Users(UserID),
+    ShowID INTEGER REFERENCES Show(ShowID),
+    Seat_ids TEXT[],
+    Promo_code VARCHAR(64),
+    Step VARCHAR(20),
+    Status VARCHAR(20) DEFAULT 'running',
+    Paymentconf_id INTEGER, -- set once the payment is captured
+    Attempts INTEGER DEFAULT 0, -- recovery rounds so far
+    Last_error TEXT,
+    Created_at TIMESTAMP DEFAULT NOW(),
+    Updated_at TIMESTAMP DEFAULT NOW()
+);
+
+-- SagaEvent Table, every step, retry and compensation of a saga
+CREATE TABLE SagaEvent (
+    EventID SERIAL PRIMARY KEY,
+    SagaID INTEGER REFERENCES Saga(SagaID),
+    Step VARCHAR(20),
+    Outcome VARCHAR(30),
+    Detail TEXT,
+    Created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Outbox Table, domain events written in the same transaction as the change they describe
+-- (show_created, show_updated, show_cancelled, seat_claimed, seat_booked, booking_refunded),
+-- published in EventID order by outboxRelay
+CREATE TABLE Outbox (
+    EventID BIGSERIAL PRIMARY KEY,
+    Event_type VARCHAR(50),
+    Aggregate_id INTEGER, -- ShowID for every current event
+    Payload JSONB,
+    Created_at TIMESTAMP DEFAULT NOW(),
+    Published_at TIMESTAMP -- NULL until the relay has published it
+);
+CREATE INDEX outbox_unpublished ON Outbox (EventID) WHERE Published_at IS NULL;
+
+-- Orders Table, the seats one customer paid for together, written by bookSeat
+-- Reference: 11 Crockford base32 characters and a check character, XXXX-XXXX-XXXX
+-- Status: confirmed, cancelled when the show is cancelled and the order refunded, or
+-- refunded when checkPayment refunds its payment, its tickets void and its seats released
+CREATE TABLE Orders (
+    OrderID SERIAL PRIMARY KEY,
+    Reference VARCHAR(14) UNIQUE NOT NULL,
+    UserID INTEGER REFERENCES Users(UserID),
+    ShowID INTEGER REFERENCES Show(ShowID),
+    Seat_ids TEXT[], -- SeatReservationIDs, kept in sync when the show moves hall
+    Total BIGINT, -- minor units, itemized in the Receipt with the same Paymentconf_id
+    Currency CHAR(3),
+    Promo_code VARCHAR(64),
+    Paymentconf_id INTEGER,
+    Status VARCHAR(20) DEFAULT 'confirmed',
+    Created_at TIMESTAMP DEFAULT NOW(),
+    Updated_at TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX orders_user ON Orders (UserID);
+CREATE INDEX orders_show ON Orders (ShowID);
+
+-- Ticket Table, one e-ticket per booked seat, issued by bookSeat with the order
+-- Token: base64url(claims json) "." base64url(ed25519 signature), checked at the door by checkIn
+-- Status: valid, used once scanned, void when the show is cancelled, transferred once
+-- given to someone else, who holds a new ticket for the same seat
+CREATE TABLE Ticket (
+    TicketID CHAR(32) PRIMARY KEY, -- random, also inside the token
+    Order_reference VARCHAR(14) REFERENCES Orders(Reference),
+    ShowID INTEGER REFERENCES Show(ShowID),
+    SeatReservationID VARCHAR(255),
+    HolderID INTEGER REFERENCES Users(UserID), -- the buyer, or who it was transferred to
+    Token TEXT,
+    Status VARCHAR(12) DEFAULT 'valid',
+    Transfer_count INTEGER DEFAULT 0, -- times the seat changed hands before this ticket
+    Face_value BIGINT, -- what the first buyer paid for the seat, caps resale prices
+    Issued_at TIMESTAMP DEFAULT NOW(),
+    Used_at TIMESTAMP
+);
+CREATE INDEX ticket_show_seat ON Ticket (ShowID, SeatReservationID);
+CREATE INDEX ticket_holder ON Ticket (HolderID);
+
+-- TicketTransfer Table, offers of a ticket from one customer to another, kept as the audit trail
+-- Status: pending, accepted, declined (by the recipient), cancelled (by the sender or when
+-- the show is cancelled) or expired
+CREATE TABLE TicketTransfer (
+    TransferID SERIAL PRIMARY KEY,
+    TicketID CHAR(32) REFERENCES Ticket(TicketID), -- the ticket offered, transferred once accepted
+    New_ticketID CHAR(32) REFERENCES Ticket(TicketID), -- issued to the recipient on acceptance
+    ShowID INTEGER REFERENCES Show(ShowID),
+    FromID INTEGER REFERENCES Users(UserID),
+    ToID INTEGER REFERENCES Users(UserID),
+    Status VARCHAR(10) DEFAULT 'pending',
+    Created_at TIMESTAMP DEFAULT NOW(),
+    Expires_at TIMESTAMP,
+    Responded_at TIMESTAMP
+);
+CREATE UNIQUE INDEX ticket_transfer_pending ON TicketTransfer (TicketID) WHERE Status = 'pending';
+
+-- ResaleListing Table, a booked seat its holder offers to other customers
+-- Buyers claim and pay for the seat like any other, bookSeat then reissues the ticket to them
+-- Status: active, sold, withdrawn (by the seller or when the show stops allowing resale)
+-- or cancelled when the show is cancelled or the sale refunded
+CREATE TABLE ResaleListing (
+    ListingID SERIAL PRIMARY KEY,
+    TicketID CHAR(32) REFERENCES Ticket(TicketID), -- the seller's ticket, transferred once sold
+    ShowID INTEGER REFERENCES Show(ShowID),
+    SeatReservationID VARCHAR(255),
+    SellerID INTEGER REFERENCES Users(UserID),
+    Price BIGINT, -- minor units, capped when listed
+    Currency CHAR(3),
+    Face_value BIGINT,
+    Status VARCHAR(10) DEFAULT 'active',
+    BuyerID INTEGER REFERENCES Users(UserID),
+    Order_reference VARCHAR(14) REFERENCES Orders(Reference), -- the buyer's order
+    Created_at TIMESTAMP DEFAULT NOW(),
+    Sold_at TIMESTAMP
+);
+CREATE UNIQUE INDEX resale_listing_active ON ResaleListing (SeatReservationID) WHERE Status = 'active';
+
+-- Payout Table, what a seller is owed for a sold listing
+-- Status: pending until the show has ended, released once the net amount is paid out to the seller, or cancelled with the show or the sale
+-- or when the buyer's payment wasn't captured
+CREATE TABLE Payout (
+    PayoutID SERIAL PRIMARY KEY,
+    ListingID INTEGER UNIQUE REFERENCES ResaleListing(ListingID),
+    SellerID INTEGER REFERENCES Users(UserID),
+    Paymentconf_id INTEGER, -- the buyer's payment
+    Gross BIGINT, -- the listing price
+    Fee BIGINT,
+    Net BIGINT, -- Gross minus Fee, what the seller receives
+    Currency CHAR(3),
+    Status VARCHAR(10) DEFAULT 'pending',
+    Created_at TIMESTAMP DEFAULT NOW(),
+    Released_at TIMESTAMP
+);
+
+-- CheckIn Table, every ticket scan at the venue gates, rejected ones included
+-- Result: accepted, duplicate, wrong_show, void, transferred, unknown_ticket, superseded or invalid_ticket
+CREATE TABLE CheckIn (
+    CheckInID BIGSERIAL PRIMARY KEY,
+    TicketID CHAR(32), -- NULL when the token couldn't be read
+    ShowID INTEGER, -- the show the gate was scanning for, as sent by the scanner
+    Gate VARCHAR(64),
+    Result VARCHAR(20),
+    Scanned_at TIMESTAMP, -- when the scanner read it, earlier than Recorded_at for offline scans
+    Recorded_at TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX checkin_show ON CheckIn (ShowID);
+
+-- WaitlistEntry Table, users waiting for seats of a show, offered freed seats in the order they joined
+-- Status: waiting, offered (seats held until Offer_expires_at), claimed, expired, left
+-- or closed when the show was cancelled or started
+CREATE TABLE WaitlistEntry (
+    EntryID SERIAL PRIMARY KEY,
+    ShowID INTEGER REFERENCES Show(ShowID),
+    UserID INTEGER REFERENCES Users(UserID),
+    Party_size INTEGER,
+    Category VARCHAR(255), -- NULL takes seats of any category
+    Status VARCHAR(10) DEFAULT 'waiting',
+    Offered_seats TEXT[], -- SeatReservationIDs held for the user
+    Offered_at TIMESTAMP,
+    Offer_expires_at TIMESTAMP,
+    Created_at TIMESTAMP DEFAULT NOW()
+);
+CREATE UNIQUE INDEX waitlist_live_entry ON WaitlistEntry (ShowID, UserID) WHERE Status IN ('waiting', 'offered');
+CREATE INDEX waitlist_show_queue ON WaitlistEntry (ShowID, Created_at) WHERE Status = 'waiting';
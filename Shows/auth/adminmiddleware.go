@@ -0,0 +1,70 @@
+package authmiddleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type contextKey string
+
+const staffIDKey contextKey = "staff_id"
+
+var adminSecret []byte
+
+// Reads ADMIN_TOKEN_SECRET, the secret back-office staff tokens are signed
+// with. Called at startup, the support routes would be open without it.
+func LoadAdminSecret() {
+	secret := os.Getenv("ADMIN_TOKEN_SECRET")
+	if secret == "" {
+		log.Fatal("Error: ADMIN_TOKEN_SECRET is not set")
+	}
+	adminSecret = []byte(secret)
+}
+
+// Staff member the admin token was issued to, set by AdminMiddleware
+func StaffID(ctx context.Context) (int, bool) {
+	staffID, ok := ctx.Value(staffIDKey).(int)
+	return staffID, ok
+}
+
+// Lets only back-office staff through. Their token is an HS256 JWT with iss
+// "admin", the staff member in "sub" and an exp.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || tokenString == "" {
+			http.Error(w, "Error: Authorization header is missing", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return adminSecret, nil
+		}, jwt.WithIssuer("admin"), jwt.WithExpirationRequired())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: invalid admin token: %v", err), http.StatusUnauthorized)
+			return
+		}
+
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			http.Error(w, "Error: invalid admin token claims", http.StatusUnauthorized)
+			return
+		}
+		sub, ok := claims["sub"].(float64)
+		if !ok {
+			http.Error(w, "Error: admin token has no staff member", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), staffIDKey, int(sub))))
+	})
+}
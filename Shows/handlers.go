@@ -1,9 +1,9 @@
 package main
 
 import (
-	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,8 +11,7 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq" // Import PostgreSQL driver
-	"github.com/redis/go-redis/v9"
+	"github.com/lib/pq" // Import PostgreSQL driver
 )
 
 type Show struct {
@@ -29,7 +28,7 @@ func (app *Config) createShow(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewDecoder(r.Body).Decode(&show)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to parse show form: %v", err), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse show form: %v", err))
 		return
 	}
 
@@ -37,8 +36,13 @@ func (app *Config) createShow(w http.ResponseWriter, r *http.Request) {
 
 	//Check if HallID and VenueID is correct
 	err = checkValidValues(db, show)
+	var conflict *showConflictError
+	if errors.As(err, &conflict) {
+		writeShowConflict(w, conflict)
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("CheckFailed : %v", err), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("CheckFailed : %v", err))
 		return
 	}
 
@@ -46,55 +50,80 @@ func (app *Config) createShow(w http.ResponseWriter, r *http.Request) {
 	hallCapacityStr, err := getHallCapacity(db, show.VenueID, show.HallID)
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("HallCapacity failed : %v", err), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("HallCapacity failed : %v", err))
 		return
 	}
 
 	hallCapacity, err := strconv.Atoi(hallCapacityStr)
 	if err != nil {
-		log.Println("Cant convert hallCapacity to integer")
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Cant convert hallCapacity to integer: %v", err))
+		return
+	}
+
+	//Hall is blocked until the turnover after the show is done
+	blockedUntil, err := getBlockedUntil(db, show.HallID, show.Endtime)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("HallTurnover failed : %v", err))
+		return
 	}
 
+	// Slice to store seatIDs
+	var seatIDs []string
+
+	seatIDs, err = getSeatIDs(db, show.VenueID, show.HallID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("GetSeatIDs failed : %v", err))
+		return
+	}
+
+	// Show row, reservation rows and the show_created event are created as one unit
+	uow, err := beginUnitOfWork(db)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer uow.rollback() // Undo everything if the show wasn't committed
+
 	// Create show in show table, with capacity=hallcapacity, usage=0
 	var showid int
-	err = db.QueryRow(`INSERT INTO Show (ShowName, VenueID, HallID, Time_start, Time_end,totalcapacity,currentusage)
-						VALUES ($1, $2, $3, $4, $5,$6,$7)
+	err = uow.tx.QueryRow(`INSERT INTO Show (ShowName, VenueID, HallID, Time_start, Time_end, Blocked_until,totalcapacity,currentusage)
+						VALUES ($1, $2, $3, $4, $5,$6,$7,$8)
 						ON CONFLICT (ShowName, VenueID, HallID, Time_start) DO NOTHING
 						RETURNING showid`,
-		show.ShowName, show.VenueID, show.HallID, show.Starttime, show.Endtime, hallCapacity, 0).Scan(&showid)
+		show.ShowName, show.VenueID, show.HallID, show.Starttime, show.Endtime, blockedUntil, hallCapacity, 0).Scan(&showid)
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Show already exists in the database", http.StatusBadRequest)
+		err = asShowConflict(db, err, show, 0)
+		if errors.As(err, &conflict) {
+			writeShowConflict(w, conflict)
 			return
-		} else {
-			// Handle other errors
-			fmt.Printf("ShowInsert error : %v\n", err)
+		}
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusBadRequest, "Show already exists in the database")
 			return
 		}
+		log.Printf("ShowInsert error : %v", err)
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("ShowInsert failed : %v", err))
+		return
 	}
 
-	//Create entry in redis
-	err = createRedisEntry(showid, hallCapacity)
+	// Create entries in reservation table
+	// Columns that will be created : showid, seatreservationid
+	err = insertReservations(uow.tx.Tx, showid, seatIDs)
 	if err != nil {
-		http.Error(w, "Failed to updated Redis", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Reservation table entry failed : %v", err))
 		return
 	}
 
-	// Slice to store seatIDs
-	var seatIDs []string
-
-	seatIDs, err = getSeatIDs(db, show.VenueID, show.HallID)
+	// The seats left counter in Redis is created from this event by outboxRelay
+	err = writeOutboxEvent(uow.tx, eventShowCreated, showid, showCreatedEvent{ShowID: showid, Capacity: hallCapacity})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("GetSeatIDs failed : %v", err), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Outbox entry failed : %v", err))
 		return
 	}
 
-	// Create entries in reservation table
-	// Columns that will be created : showid, seatreservationid
-	err = insertReservations(db, showid, seatIDs)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Reservation table entry failed : %v", err), http.StatusInternalServerError)
+	if err := uow.commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit show: %v", err))
 		return
 	}
 
@@ -106,7 +135,7 @@ func (app *Config) createShow(w http.ResponseWriter, r *http.Request) {
 	// Convert the JSON object to a JSON string
 	jsonResponse, err := json.Marshal(response)
 	if err != nil {
-		http.Error(w, "Failed to convert showID to json", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to convert showID to json")
 		return
 	}
 	// Set the Content-Type header to indicate JSON response
@@ -173,7 +202,8 @@ func checkValidValues(db *sqlx.DB, show Show) error {
 		return fmt.Errorf("hall with ID %d does not exist", show.HallID)
 	}
 
-	return nil
+	// Check the hall isn't used by another show at that time
+	return checkHallFree(db, show, 0)
 }
 
 func getHallCapacity(db *sqlx.DB, VenueID int, HallID int) (string, error) {
@@ -187,47 +217,47 @@ func getHallCapacity(db *sqlx.DB, VenueID int, HallID int) (string, error) {
 	return strconv.Itoa(hallCapacity), nil
 }
 
-func insertReservations(db *sqlx.DB, showID int, seatIDs []string) error {
-	// Begin a transaction
-	tx, err := db.Begin()
+// Streams the reservation rows of every seat with COPY inside an existing transaction,
+// one INSERT per seat takes minutes for arena sized halls
+func insertReservations(tx *sql.Tx, showID int, seatIDs []string) error {
+	stmt, err := tx.Prepare(pq.CopyIn("reservation", "seatreservationid", "showid"))
 	if err != nil {
-		return err
+		return fmt.Errorf("copy prepare error: %v", err)
 	}
-	defer tx.Rollback() // Rollback transaction if not committed
+	defer stmt.Close()
 
 	for _, seatID := range seatIDs {
 		seatReservationID := "SH_" + strconv.Itoa(showID) + "_ST_" + seatID
-		_, err := tx.Exec("INSERT INTO reservation (seatreservationid, showid) VALUES ($1, $2)", seatReservationID, showID)
+		_, err := stmt.Exec(seatReservationID, showID)
 		if err != nil {
-			return err
+			return fmt.Errorf("copy row error: %v", err)
 		}
 	}
 
-	// Commit the transaction if all inserts were successful
-	if err := tx.Commit(); err != nil {
-		return err
+	// Flush the buffered rows to Postgres
+	_, err = stmt.Exec()
+	if err != nil {
+		return fmt.Errorf("copy flush error: %v", err)
 	}
 
 	return nil
 }
 
-func createRedisEntry(showID int, totalCapacity int) error {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
-
-	defer rdb.Close()
-
-	// Context for the Redis operations.
-	ctx := context.Background()
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	// Construct a JSON object
+	response := map[string]string{
+		"error": message,
+	}
 
-	// Update the value in Redis.
-	err := rdb.Set(ctx, strconv.Itoa(showID), totalCapacity, 0).Err()
+	// Convert the JSON object to a JSON string
+	jsonResponse, err := json.Marshal(response)
 	if err != nil {
-		return fmt.Errorf("error setting value in Redis: %v", err)
+		http.Error(w, message, status)
+		return
 	}
+	// Set the Content-Type header to indicate JSON response
+	w.Header().Set("Content-Type", "application/json")
 
-	return nil
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// Compares COPY against one INSERT per seat for halls of a few sizes, e.g.
+// go test -run '^$' -bench InsertReservations. Everything runs in a transaction
+// that is rolled back, so it is safe to point at a database with real shows in it.
+func BenchmarkInsertReservations(b *testing.B) {
+	db := ConnecttoDB()
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		b.Skipf("no database: %v", err)
+	}
+
+	for _, seats := range []int{500, 5000, 50000} {
+		seatIDs := make([]string, seats)
+		for i := range seatIDs {
+			seatIDs[i] = "BENCH" + strconv.Itoa(i)
+		}
+
+		b.Run(fmt.Sprintf("copy/%d", seats), func(b *testing.B) {
+			benchmarkInTx(b, seats, func(tx *sql.Tx, showID int) error {
+				return insertReservations(tx, showID, seatIDs)
+			})
+		})
+
+		b.Run(fmt.Sprintf("insert/%d", seats), func(b *testing.B) {
+			benchmarkInTx(b, seats, func(tx *sql.Tx, showID int) error {
+				for _, seatID := range seatIDs {
+					seatReservationID := "SH_" + strconv.Itoa(showID) + "_ST_" + seatID
+					_, err := tx.Exec("INSERT INTO reservation (seatreservationid, showid) VALUES ($1, $2)", seatReservationID, showID)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
+
+// Runs fn b.N times against a throwaway show, each run's rows are undone so
+// every iteration starts from the same table
+func benchmarkInTx(b *testing.B, seats int, fn func(tx *sql.Tx, showID int) error) {
+	db := ConnecttoDB()
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		b.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback() // Nothing of the benchmark is kept
+
+	// Not tied to any hall so it can't clash with a real one
+	var showID int
+	err = tx.QueryRow(`INSERT INTO Show (ShowName, Time_start, Time_end, Blocked_until, totalcapacity, currentusage)
+						VALUES ('reservation benchmark', NOW(), NOW() + INTERVAL '1 hour', NOW() + INTERVAL '1 hour', $1, 0)
+						RETURNING showid`, seats).Scan(&showID)
+	if err != nil {
+		b.Fatalf("Failed to create benchmark show: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tx.Exec("SAVEPOINT reservation_bench"); err != nil {
+			b.Fatal(err)
+		}
+
+		err := fn(tx, showID)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT reservation_bench"); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(seats)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+}
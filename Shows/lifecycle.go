@@ -0,0 +1,531 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Fields left out of the request keep their current value
+type ShowUpdate struct {
+	ShowID    int        `json:"show_id"`
+	HallID    *int       `json:"hall_id"`
+	Starttime *time.Time `json:"show_start_time"`
+	Endtime   *time.Time `json:"show_end_time"`
+}
+
+type ShowCancel struct {
+	ShowID int    `json:"show_id"`
+	Reason string `json:"reason"`
+}
+
+// Row of the show table needed for the lifecycle operations
+type storedShow struct {
+	ShowID    int       `db:"showid"`
+	ShowName  string    `db:"showname"`
+	VenueID   int       `db:"venueid"`
+	HallID    int       `db:"hallid"`
+	Starttime time.Time `db:"time_start"`
+	Endtime   time.Time `db:"time_end"`
+	Status    string    `db:"status"`
+}
+
+// A booked seat that has to follow the show to its new hall
+type bookedSeat struct {
+	SeatReservationID string         `db:"seatreservationid"`
+	BookedbyID        int            `db:"bookedbyid"`
+	BookingConfirmID  sql.NullString `db:"booking_confirmid"`
+	Category          string         `db:"category"`
+}
+
+const (
+	showScheduled = "scheduled"
+	showCancelled = "cancelled"
+)
+
+func (app *Config) updateShow(w http.ResponseWriter, r *http.Request) {
+
+	var update ShowUpdate
+
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse show update form: %v", err))
+		return
+	}
+
+	db := ConnecttoDB()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	current, err := lockShow(tx, update.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ShowLookup failed : %v", err))
+		return
+	}
+
+	if current.Status == showCancelled {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Show %d is cancelled and can't be updated", current.ShowID))
+		return
+	}
+
+	updated := *current
+	if update.Starttime != nil {
+		updated.Starttime = *update.Starttime
+	}
+	if update.Endtime != nil {
+		updated.Endtime = *update.Endtime
+	}
+	if update.HallID != nil {
+		updated.HallID = *update.HallID
+	}
+
+	change, err := applyShowUpdate(tx, db, current, updated)
+	var conflict *showConflictError
+	if errors.As(err, &conflict) {
+		writeShowConflict(w, conflict)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ShowUpdate failed : %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit show update: %v", err))
+		return
+	}
+
+	log.Printf("Show %d updated, hall changed: %v", updated.ShowID, change.hallChanged)
+
+	writeShowStatus(w, updated.ShowID, "updated")
+}
+
+func (app *Config) cancelShow(w http.ResponseWriter, r *http.Request) {
+
+	var cancel ShowCancel
+
+	err := json.NewDecoder(r.Body).Decode(&cancel)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse show cancel form: %v", err))
+		return
+	}
+
+	db := ConnecttoDB()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	show, err := lockShow(tx, cancel.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ShowLookup failed : %v", err))
+		return
+	}
+
+	if show.Status == showCancelled {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Show %d is already cancelled", show.ShowID))
+		return
+	}
+
+	err = cancelShowTx(tx, show, cancel.Reason)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("ShowCancel failed : %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit show cancel: %v", err))
+		return
+	}
+
+	log.Printf("Show %d cancelled", show.ShowID)
+
+	writeShowStatus(w, show.ShowID, showCancelled)
+}
+
+// Result of applyShowUpdate
+type showChange struct {
+	hallChanged bool
+}
+
+// Writes the new name, slot and hall of a show, moving reservations when the hall
+// changes and notifying the customers. db is only used to look up clashes once
+// the transaction has been aborted by the overlap constraint.
+func applyShowUpdate(tx *sqlx.Tx, db *sqlx.DB, current *storedShow, updated storedShow) (*showChange, error) {
+	// The new slot must not clash with another show in the hall
+	candidate := Show{ShowName: updated.ShowName, VenueID: updated.VenueID, HallID: updated.HallID,
+		Starttime: updated.Starttime, Endtime: updated.Endtime}
+
+	err := checkHallFree(tx, candidate, updated.ShowID)
+	if err != nil {
+		return nil, err
+	}
+
+	blockedUntil, err := getBlockedUntil(tx, updated.HallID, updated.Endtime)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &showChange{hallChanged: updated.HallID != current.HallID}
+	var hallCapacity int
+
+	if change.hallChanged {
+		hallCapacityStr, err := getHallCapacity(db, updated.VenueID, updated.HallID)
+		if err != nil {
+			return nil, err
+		}
+		hallCapacity, err = strconv.Atoi(hallCapacityStr)
+		if err != nil {
+			return nil, fmt.Errorf("cant convert hallCapacity to integer: %v", err)
+		}
+
+		var oldCapacity int
+		err = tx.Get(&oldCapacity, `SELECT totalcapacity FROM Show WHERE ShowID = $1`, updated.ShowID)
+		if err != nil {
+			return nil, fmt.Errorf("capacity lookup error: %v", err)
+		}
+
+		// Move the reservation rows over to the seats of the new hall
+		_, err = migrateReservations(tx, updated.ShowID, updated.VenueID, updated.HallID)
+		if err != nil {
+			return nil, fmt.Errorf("reservation migration failed: %v", err)
+		}
+
+		// Bookings move with the show, seats left only changes with the capacity
+		err = writeOutboxEvent(tx, eventShowUpdated, updated.ShowID, showUpdatedEvent{
+			ShowID:         updated.ShowID,
+			Capacity:       hallCapacity,
+			CapacityChange: hallCapacity - oldCapacity,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE Show SET ShowName = $1, HallID = $2, Time_start = $3, Time_end = $4, Blocked_until = $5,
+						totalcapacity = CASE WHEN $7 THEN $6 ELSE totalcapacity END
+						WHERE ShowID = $8`,
+		updated.ShowName, updated.HallID, updated.Starttime, updated.Endtime, blockedUntil, hallCapacity,
+		change.hallChanged, updated.ShowID)
+	if err != nil {
+		// Transaction is aborted at this point, look the clash up outside of it
+		return nil, asShowConflict(db, err, candidate, updated.ShowID)
+	}
+
+	// Renaming alone doesn't concern the customers
+	if change.hallChanged || !updated.Starttime.Equal(current.Starttime) || !updated.Endtime.Equal(current.Endtime) {
+		message := fmt.Sprintf("%s has been rescheduled to %s - %s", updated.ShowName,
+			updated.Starttime.Format(time.RFC1123), updated.Endtime.Format(time.RFC1123))
+		if change.hallChanged {
+			message += fmt.Sprintf(" and moved to hall %d, your seats have been reassigned", updated.HallID)
+		}
+
+		err = notifyShowUsers(tx, updated.ShowID, message)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return change, nil
+}
+
+// Marks the show cancelled, queues a refund per booking for checkPayment to pay
+// and notifies the customers
+func cancelShowTx(tx *sqlx.Tx, show *storedShow, reason string) error {
+	_, err := tx.Exec(`UPDATE Show SET Status = $1 WHERE ShowID = $2`, showCancelled, show.ShowID)
+	if err != nil {
+		return fmt.Errorf("status update error: %v", err)
+	}
+
+	err = writeOutboxEvent(tx, eventShowCancelled, show.ShowID, showCancelledEvent{ShowID: show.ShowID})
+	if err != nil {
+		return err
+	}
+
+	// One refund per order, for the total it was paid
+	_, err = tx.Exec(`
+		INSERT INTO Refund (ShowID, UserID, Paymentconf_id, Amount, Currency)
+		SELECT ShowID, UserID, Paymentconf_id, Total, Currency
+		FROM Orders
+		WHERE ShowID = $1 AND Status = $2`, show.ShowID, orderConfirmed)
+	if err != nil {
+		return fmt.Errorf("refund insert error: %v", err)
+	}
+
+	err = refundBookingsWithoutOrder(tx, show.ShowID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE Orders SET Status = $1, Updated_at = NOW() WHERE ShowID = $2 AND Status = $3`,
+		orderCancelled, show.ShowID, orderConfirmed)
+	if err != nil {
+		return fmt.Errorf("order update error: %v", err)
+	}
+
+	// Tickets given away stay transferred, it's the holder's ticket that is void
+	_, err = tx.Exec(`UPDATE Ticket SET Status = 'void' WHERE ShowID = $1 AND Status <> 'transferred'`, show.ShowID)
+	if err != nil {
+		return fmt.Errorf("ticket update error: %v", err)
+	}
+
+	_, err = tx.Exec(`UPDATE TicketTransfer SET Status = 'cancelled', Responded_at = NOW() WHERE ShowID = $1 AND Status = 'pending'`,
+		show.ShowID)
+	if err != nil {
+		return fmt.Errorf("transfer update error: %v", err)
+	}
+
+	// Resale buyers are refunded with their order, so sellers aren't paid out
+	_, err = tx.Exec(`UPDATE ResaleListing SET Status = 'cancelled' WHERE ShowID = $1 AND Status = 'active'`, show.ShowID)
+	if err != nil {
+		return fmt.Errorf("listing update error: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE Payout p
+		SET Status = 'cancelled'
+		FROM ResaleListing l
+		WHERE l.ListingID = p.ListingID AND l.ShowID = $1 AND p.Status = 'pending'`, show.ShowID)
+	if err != nil {
+		return fmt.Errorf("payout update error: %v", err)
+	}
+
+	message := fmt.Sprintf("%s on %s has been cancelled, your booking will be refunded", show.ShowName,
+		show.Starttime.Format(time.RFC1123))
+	if reason != "" {
+		message += ": " + reason
+	}
+
+	return notifyShowUsers(tx, show.ShowID, message)
+}
+
+// Reads the show row and locks it for the rest of the transaction
+func lockShow(tx *sqlx.Tx, showID int) (*storedShow, error) {
+	var show storedShow
+	err := tx.Get(&show, `SELECT ShowID, ShowName, VenueID, HallID, Time_start, Time_end, Status
+						FROM Show WHERE ShowID = $1 FOR UPDATE`, showID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("show with ID %d does not exist", showID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ShowSelect Error: %v", err)
+	}
+
+	return &show, nil
+}
+
+// Seats booked before Orders existed have no order to refund from, their
+// holders get one refund each for the price of their seats: the price locked in
+// at the claim, or the list price for bookings older than that
+func refundBookingsWithoutOrder(tx *sqlx.Tx, showID int) error {
+	var seats []struct {
+		UserID          int      `db:"bookedbyid"`
+		ClaimedPrice    *int64   `db:"claimed_price"`
+		ClaimedCurrency *string  `db:"claimed_currency"`
+		ListPrice       *float64 `db:"price"`
+		VenueCurrency   string   `db:"venue_currency"`
+	}
+	err := tx.Select(&seats, `
+		SELECT r.BookedbyID, r.Claimed_price, r.Claimed_currency, s.Price, COALESCE(v.Currency, $2) AS venue_currency
+		FROM Reservation r
+		JOIN Show sh ON sh.ShowID = r.ShowID
+		LEFT JOIN Venue v ON v.VenueID = sh.VenueID
+		LEFT JOIN Seat s ON r.SeatReservationID = 'SH_' || r.ShowID || '_ST_' || s.SeatID
+		WHERE r.ShowID = $1 AND r.Booked = TRUE AND r.BookedbyID IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM Orders o WHERE o.Reference = r.Booking_confirmID)
+		ORDER BY r.BookedbyID`, showID, defaultCurrency)
+	if err != nil {
+		return fmt.Errorf("bookings without order query error: %v", err)
+	}
+
+	type legacyRefund struct {
+		Amount   int64
+		Currency string
+	}
+	var userIDs []int
+	refunds := make(map[int]*legacyRefund)
+	for _, seat := range seats {
+		refund, ok := refunds[seat.UserID]
+		if !ok {
+			refund = &legacyRefund{Currency: seat.VenueCurrency}
+			refunds[seat.UserID] = refund
+			userIDs = append(userIDs, seat.UserID)
+		}
+
+		switch {
+		case seat.ClaimedPrice != nil:
+			refund.Amount += *seat.ClaimedPrice
+			if seat.ClaimedCurrency != nil {
+				refund.Currency = *seat.ClaimedCurrency
+			}
+		case seat.ListPrice != nil:
+			refund.Amount += toMinorUnits(*seat.ListPrice, seat.VenueCurrency)
+		}
+	}
+
+	for _, userID := range userIDs {
+		_, err = tx.Exec(`INSERT INTO Refund (ShowID, UserID, Amount, Currency) VALUES ($1, $2, $3, $4)`,
+			showID, userID, refunds[userID].Amount, refunds[userID].Currency)
+		if err != nil {
+			return fmt.Errorf("refund insert error: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Recreates the reservation rows of a show for the seats of another hall. Booked
+// seats are moved to a free seat of the same category, claims are dropped.
+// Returns the number of seats that stay booked.
+func migrateReservations(tx *sqlx.Tx, showID int, venueID int, hallID int) (int, error) {
+	var booked []bookedSeat
+	err := tx.Select(&booked, `
+		SELECT r.SeatReservationID, r.BookedbyID, r.Booking_confirmID, s.Category
+		FROM Reservation r
+		JOIN Seat s ON r.SeatReservationID = 'SH_' || r.ShowID || '_ST_' || s.SeatID
+		WHERE r.ShowID = $1 AND r.Booked = TRUE
+		ORDER BY s.Category, s.SeatID`, showID)
+	if err != nil {
+		return 0, fmt.Errorf("booked seats query error: %v", err)
+	}
+
+	// Free seats of the new hall, grouped per category
+	rows, err := tx.Query(`SELECT SeatID, Category FROM Seat WHERE VenueID = $1 AND HallID = $2
+						ORDER BY Category, SeatID`, venueID, hallID)
+	if err != nil {
+		return 0, fmt.Errorf("new hall seats query error: %v", err)
+	}
+	defer rows.Close()
+
+	var seatIDs []string
+	freeSeats := make(map[string][]string)
+	for rows.Next() {
+		var seatID, category string
+		if err := rows.Scan(&seatID, &category); err != nil {
+			return 0, err
+		}
+		seatIDs = append(seatIDs, seatID)
+		freeSeats[category] = append(freeSeats[category], seatID)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM Reservation WHERE ShowID = $1`, showID)
+	if err != nil {
+		return 0, fmt.Errorf("old reservation delete error: %v", err)
+	}
+
+	err = insertReservations(tx.Tx, showID, seatIDs)
+	if err != nil {
+		return 0, fmt.Errorf("new reservation insert error: %v", err)
+	}
+
+	var fromSeats, toSeats []string
+	for _, seat := range booked {
+		if len(freeSeats[seat.Category]) == 0 {
+			return 0, fmt.Errorf("hall %d doesn't have enough %s seats for the existing bookings", hallID, seat.Category)
+		}
+		seatID := freeSeats[seat.Category][0]
+		freeSeats[seat.Category] = freeSeats[seat.Category][1:]
+
+		fromSeats = append(fromSeats, seat.SeatReservationID)
+		toSeats = append(toSeats, "SH_"+strconv.Itoa(showID)+"_ST_"+seatID)
+
+		_, err = tx.Exec(`
+			UPDATE Reservation
+			SET BookedbyID = $1, Booked = true, Booking_confirmID = $2
+			WHERE SeatReservationID = $3`,
+			seat.BookedbyID, seat.BookingConfirmID, "SH_"+strconv.Itoa(showID)+"_ST_"+seatID)
+		if err != nil {
+			return 0, fmt.Errorf("booking move error for %s: %v", seat.SeatReservationID, err)
+		}
+	}
+
+	// Tickets follow their seats in one statement, so a seat that is both left
+	// and taken doesn't move twice. bookSeat signs them again for the new seat.
+	_, err = tx.Exec(`
+		UPDATE Ticket t
+		SET SeatReservationID = moved.to_seat
+		FROM unnest($1::text[], $2::text[]) AS moved(from_seat, to_seat)
+		WHERE t.ShowID = $3 AND t.SeatReservationID = moved.from_seat AND t.Status = 'valid'`,
+		pq.Array(fromSeats), pq.Array(toSeats), showID)
+	if err != nil {
+		return 0, fmt.Errorf("ticket move error: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE ResaleListing l
+		SET SeatReservationID = moved.to_seat
+		FROM unnest($1::text[], $2::text[]) AS moved(from_seat, to_seat)
+		WHERE l.ShowID = $3 AND l.SeatReservationID = moved.from_seat AND l.Status = 'active'`,
+		pq.Array(fromSeats), pq.Array(toSeats), showID)
+	if err != nil {
+		return 0, fmt.Errorf("listing move error: %v", err)
+	}
+
+	// Orders follow their seats to the new hall
+	_, err = tx.Exec(`
+		UPDATE Orders o
+		SET Seat_ids = moved.Seat_ids, Updated_at = NOW()
+		FROM (SELECT Booking_confirmID, array_agg(SeatReservationID ORDER BY SeatReservationID) AS Seat_ids
+			FROM Reservation
+			WHERE ShowID = $1 AND Booked = TRUE
+			GROUP BY Booking_confirmID) moved
+		WHERE o.Reference = moved.Booking_confirmID`, showID)
+	if err != nil {
+		return 0, fmt.Errorf("order seats update error: %v", err)
+	}
+
+	return len(booked), nil
+}
+
+// Leaves a message for every customer holding a booking for the show
+func notifyShowUsers(tx *sqlx.Tx, showID int, message string) error {
+	_, err := tx.Exec(`
+		INSERT INTO Notification (UserID, ShowID, Message)
+		SELECT DISTINCT BookedbyID, ShowID, $2
+		FROM Reservation
+		WHERE ShowID = $1 AND Booked = TRUE`, showID, message)
+	if err != nil {
+		return fmt.Errorf("notification insert error: %v", err)
+	}
+
+	return nil
+}
+
+func writeShowStatus(w http.ResponseWriter, showID int, status string) {
+	// Construct a JSON object
+	response := map[string]interface{}{
+		"showid": showID,
+		"status": status,
+	}
+
+	// Convert the JSON object to a JSON string
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Failed to convert show status to json")
+		return
+	}
+	// Set the Content-Type header to indicate JSON response
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Replaces the purchase limits of a show, a limit left out is lifted. claimSeat
+// checks them when seats are claimed and bookSeat again when they are booked.
+type PurchaseLimitsForm struct {
+	ShowID      int  `json:"show_id"`
+	MaxPerOrder *int `json:"max_seats_per_order"`
+	MaxPerUser  *int `json:"max_seats_per_user"` // booked and claimed seats across all of the user's orders
+	MaxHeld     *int `json:"max_held_seats"`     // seats claimed but not booked yet
+}
+
+func (app *Config) setPurchaseLimits(w http.ResponseWriter, r *http.Request) {
+
+	var limits PurchaseLimitsForm
+
+	err := json.NewDecoder(r.Body).Decode(&limits)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse purchase limits form: %v", err))
+		return
+	}
+
+	for name, limit := range map[string]*int{
+		"max_seats_per_order": limits.MaxPerOrder,
+		"max_seats_per_user":  limits.MaxPerUser,
+		"max_held_seats":      limits.MaxHeld,
+	} {
+		if limit != nil && *limit <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("CheckFailed : %s must be positive", name))
+			return
+		}
+	}
+
+	db := ConnecttoDB()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	show, err := lockShow(tx, limits.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ShowLookup failed : %v", err))
+		return
+	}
+
+	// Seats bought before a limit is lowered stay booked, the limit only blocks new ones
+	_, err = tx.Exec(`UPDATE Show SET Max_seats_per_order = $1, Max_seats_per_user = $2, Max_held_seats = $3 WHERE ShowID = $4`,
+		limits.MaxPerOrder, limits.MaxPerUser, limits.MaxHeld, show.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Purchase limits update failed : %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit purchase limits: %v", err))
+		return
+	}
+
+	log.Printf("Purchase limits of show %d set: %s per order, %s per user, %s held", show.ShowID, formatLimit(limits.MaxPerOrder), formatLimit(limits.MaxPerUser), formatLimit(limits.MaxHeld))
+
+	writeShowStatus(w, show.ShowID, "purchase limits set")
+}
+
+func formatLimit(limit *int) string {
+	if limit == nil {
+		return "no limit"
+	}
+
+	return fmt.Sprint(*limit)
+}
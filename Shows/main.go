@@ -1,6 +1,7 @@
 package main
 
 import (
+	authmiddleware "Shows/auth"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,6 +15,9 @@ type Config struct {
 }
 
 func main() {
+	// Support routes only answer back-office staff
+	authmiddleware.LoadAdminSecret()
+
 	app := Config{}
 
 	log.Printf("Starting ClaimSeat service on port: %s", webPort)
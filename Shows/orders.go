@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Statuses of an order, orders are created by bookSeat
+const (
+	orderConfirmed = "confirmed"
+	orderCancelled = "cancelled" // the show was cancelled, the order is refunded
+)
+
+// Support looks up orders by any of these, at least one is required
+type OrderLookup struct {
+	Reference      string `json:"reference"`
+	Paymentconf_id int    `json:"paymentconf_id"`
+	UserID         int    `json:"user_id"`
+	ShowID         int    `json:"show_id"`
+}
+
+// An order with what support needs to answer a customer: the seats, the
+// amounts charged, and where the payment and any refund stand
+type orderView struct {
+	OrderID        int             `json:"order_id" db:"orderid"`
+	Reference      string          `json:"reference" db:"reference"`
+	UserID         int             `json:"user_id" db:"userid"`
+	Username       *string         `json:"username" db:"username"`
+	ShowID         int             `json:"show_id" db:"showid"`
+	ShowName       string          `json:"show_name" db:"showname"`
+	Starttime      time.Time       `json:"show_start_time" db:"time_start"`
+	SeatIDs        pq.StringArray  `json:"seat_ids" db:"seat_ids"`
+	Total          int64           `json:"total" db:"total"`
+	Currency       *string         `json:"currency" db:"currency"`
+	PromoCode      *string         `json:"promo_code" db:"promo_code"`
+	Paymentconf_id *int            `json:"paymentconf_id" db:"paymentconf_id"`
+	PaymentStatus  *string         `json:"payment_status" db:"payment_status"`
+	RefundStatus   *string         `json:"refund_status" db:"refund_status"`
+	ReceiptLines   json.RawMessage `json:"receipt_lines" db:"receipt_lines"`
+	Status         string          `json:"status" db:"status"`
+	CreatedAt      time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+func (app *Config) lookupOrders(w http.ResponseWriter, r *http.Request) {
+
+	var lookup OrderLookup
+
+	err := json.NewDecoder(r.Body).Decode(&lookup)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse order lookup: %v", err))
+		return
+	}
+
+	if lookup.Reference == "" && lookup.Paymentconf_id == 0 && lookup.UserID == 0 && lookup.ShowID == 0 {
+		writeJSONError(w, http.StatusBadRequest, "Order lookup needs a reference, paymentconf_id, user_id or show_id")
+		return
+	}
+
+	if lookup.Reference != "" {
+		reference, ok := parseBookingReference(lookup.Reference)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%q isn't a valid booking reference", lookup.Reference))
+			return
+		}
+		lookup.Reference = reference
+	}
+
+	db := ConnecttoDB()
+
+	// Unset filters match everything, references are matched the way customers type them
+	var orders []orderView
+	err = db.Select(&orders, `
+		SELECT o.OrderID, o.Reference, o.UserID, u.username, o.ShowID, sh.ShowName, sh.Time_start, o.Seat_ids,
+			o.Total, o.Currency, o.Promo_code, o.Paymentconf_id, p.Status AS payment_status,
+			rf.Status AS refund_status, rc.Lines AS receipt_lines, o.Status, o.Created_at, o.Updated_at
+		FROM Orders o
+		JOIN Show sh ON sh.ShowID = o.ShowID
+		LEFT JOIN Users u ON u.UserID = o.UserID
+		LEFT JOIN Payment p ON p.Paymentconf_id = o.Paymentconf_id
+		LEFT JOIN Receipt rc ON rc.Paymentconf_id = o.Paymentconf_id
+		LEFT JOIN Refund rf ON rf.Paymentconf_id = o.Paymentconf_id
+		WHERE ($1 = '' OR o.Reference = $1)
+			AND ($2 = 0 OR o.Paymentconf_id = $2)
+			AND ($3 = 0 OR o.UserID = $3)
+			AND ($4 = 0 OR o.ShowID = $4)
+		ORDER BY o.Created_at DESC
+		LIMIT 100`,
+		lookup.Reference, lookup.Paymentconf_id, lookup.UserID, lookup.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Order lookup failed : %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"orders": orders,
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A new show, seats left starts at its capacity
+const eventShowCreated = "show_created"
+
+type showCreatedEvent struct {
+	ShowID   int `json:"show_id"`
+	Capacity int `json:"capacity"`
+}
+
+// The show moved hall, seats left changes by the difference in capacity
+const eventShowUpdated = "show_updated"
+
+type showUpdatedEvent struct {
+	ShowID         int `json:"show_id"`
+	Capacity       int `json:"capacity"`
+	CapacityChange int `json:"capacity_change"`
+}
+
+// Nothing can be sold for the show anymore
+const eventShowCancelled = "show_cancelled"
+
+type showCancelledEvent struct {
+	ShowID int `json:"show_id"`
+}
+
+// Adds the event to the Outbox in the caller's transaction, outboxRelay publishes it
+func writeOutboxEvent(tx *sqlx.Tx, eventType string, aggregateID int, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %v", eventType, err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO Outbox (Event_type, Aggregate_id, Payload) VALUES ($1, $2, $3)`,
+		eventType, aggregateID, data)
+	if err != nil {
+		return fmt.Errorf("outbox insert error: %v", err)
+	}
+
+	return nil
+}
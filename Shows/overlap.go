@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Used when the hall doesn't define its own turnover time
+const defaultTurnoverMinutes = 30
+
+// Postgres error code raised by the show_hall_no_overlap exclusion constraint
+const exclusionViolation = "23P01"
+
+// Show already occupying the hall in the requested time slot
+type clashingShow struct {
+	ShowID    int       `json:"show_id" db:"showid"`
+	ShowName  string    `json:"show_name" db:"showname"`
+	Starttime time.Time `json:"show_start_time" db:"time_start"`
+	Endtime   time.Time `json:"show_end_time" db:"time_end"`
+}
+
+type showConflictError struct {
+	HallID int
+	Clash  clashingShow
+}
+
+func (e *showConflictError) Error() string {
+	return fmt.Sprintf("hall %d is already booked by show %d (%s) from %s to %s", e.HallID, e.Clash.ShowID,
+		e.Clash.ShowName, e.Clash.Starttime.Format(time.RFC3339), e.Clash.Endtime.Format(time.RFC3339))
+}
+
+// The hall stays blocked after the show ends for the turnover time of the hall
+func getBlockedUntil(q sqlx.Queryer, hallID int, endtime time.Time) (time.Time, error) {
+	var turnoverMinutes int
+	err := q.QueryRowx(`SELECT COALESCE(turnover_minutes, $2) FROM hall WHERE hallid = $1`,
+		hallID, defaultTurnoverMinutes).Scan(&turnoverMinutes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("HallTurnover Error: %v", err)
+	}
+
+	return endtime.Add(time.Duration(turnoverMinutes) * time.Minute), nil
+}
+
+// Checks that no other show uses the hall between the start of the show and the
+// end of its turnover, excludeShowID is skipped so a show doesn't clash with itself
+func checkHallFree(q sqlx.Queryer, show Show, excludeShowID int) error {
+	if !show.Endtime.After(show.Starttime) {
+		return fmt.Errorf("show end time must be after start time")
+	}
+
+	blockedUntil, err := getBlockedUntil(q, show.HallID, show.Endtime)
+	if err != nil {
+		return err
+	}
+
+	clash, err := findClashingShow(q, show.HallID, show.Starttime, blockedUntil, excludeShowID)
+	if err != nil {
+		return err
+	}
+	if clash != nil {
+		return &showConflictError{HallID: show.HallID, Clash: *clash}
+	}
+
+	return nil
+}
+
+func findClashingShow(q sqlx.Queryer, hallID int, start time.Time, blockedUntil time.Time, excludeShowID int) (*clashingShow, error) {
+	var clash clashingShow
+	err := sqlx.Get(q, &clash, `
+		SELECT ShowID, ShowName, Time_start, Time_end
+		FROM Show
+		WHERE HallID = $1 AND ShowID <> $4 AND Status <> 'cancelled'
+			AND Time_start < $3 AND $2 < Blocked_until
+		ORDER BY Time_start
+		LIMIT 1`, hallID, start, blockedUntil, excludeShowID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ShowOverlap Error: %v", err)
+	}
+
+	return &clash, nil
+}
+
+// Turns an exclusion constraint violation, hit when two requests race past
+// checkHallFree, into the same conflict error
+func asShowConflict(q sqlx.Queryer, err error, show Show, excludeShowID int) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != exclusionViolation {
+		return err
+	}
+
+	if conflictErr := checkHallFree(q, show, excludeShowID); conflictErr != nil {
+		return conflictErr
+	}
+
+	return err
+}
+
+// Responds with 409 and the show that is already using the hall
+func writeShowConflict(w http.ResponseWriter, conflict *showConflictError) {
+	response := map[string]interface{}{
+		"error":         conflict.Error(),
+		"clashing_show": conflict.Clash,
+	}
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Failed to convert show conflict to json")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	w.Write(jsonResponse)
+}
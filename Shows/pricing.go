@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Base price of a seat category for one show, in minor units of the venue currency
+type PriceTier struct {
+	Category   string `json:"category"`
+	PriceMinor int64  `json:"price_minor"`
+}
+
+// Adjustment on top of the tier price, see claimSeat for how the kinds are applied
+type PriceRule struct {
+	Category       *string  `json:"category"` // nil applies to every category
+	Kind           string   `json:"kind"`     // early_bird, last_minute or demand
+	HoursBefore    *int     `json:"hours_before"`
+	SeatsLeftBelow *float64 `json:"seats_left_below"` // share of seats left, between 0 and 1
+	Percent        float64  `json:"percent"`          // negative for a discount
+}
+
+// Replaces the whole pricing of a show
+type PricingForm struct {
+	ShowID int         `json:"show_id"`
+	Tiers  []PriceTier `json:"tiers"`
+	Rules  []PriceRule `json:"rules"`
+}
+
+func (app *Config) setPricing(w http.ResponseWriter, r *http.Request) {
+
+	var pricing PricingForm
+
+	err := json.NewDecoder(r.Body).Decode(&pricing)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse pricing form: %v", err))
+		return
+	}
+
+	err = checkPricing(pricing)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("CheckFailed : %v", err))
+		return
+	}
+
+	db := ConnecttoDB()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	show, err := lockShow(tx, pricing.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ShowLookup failed : %v", err))
+		return
+	}
+
+	// Claimed seats keep the price they were claimed at, only new claims see the change
+	_, err = tx.Exec(`DELETE FROM PriceTier WHERE ShowID = $1`, show.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("PriceTier delete failed : %v", err))
+		return
+	}
+	_, err = tx.Exec(`DELETE FROM PriceRule WHERE ShowID = $1`, show.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("PriceRule delete failed : %v", err))
+		return
+	}
+
+	for _, tier := range pricing.Tiers {
+		_, err = tx.Exec(`INSERT INTO PriceTier (ShowID, Category, Price_minor) VALUES ($1, $2, $3)`,
+			show.ShowID, tier.Category, tier.PriceMinor)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("PriceTier insert failed : %v", err))
+			return
+		}
+	}
+
+	for _, rule := range pricing.Rules {
+		_, err = tx.Exec(`INSERT INTO PriceRule (ShowID, Category, Kind, Hours_before, Seats_left_below, Percent)
+						VALUES ($1, $2, $3, $4, $5, $6)`,
+			show.ShowID, rule.Category, rule.Kind, rule.HoursBefore, rule.SeatsLeftBelow, rule.Percent)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("PriceRule insert failed : %v", err))
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit pricing: %v", err))
+		return
+	}
+
+	log.Printf("Pricing of show %d set: %d tiers, %d rules", show.ShowID, len(pricing.Tiers), len(pricing.Rules))
+
+	writeShowStatus(w, show.ShowID, "priced")
+}
+
+func checkPricing(pricing PricingForm) error {
+	for _, tier := range pricing.Tiers {
+		if tier.Category == "" {
+			return fmt.Errorf("price tier without category")
+		}
+		if tier.PriceMinor < 0 {
+			return fmt.Errorf("price of category %s can't be negative", tier.Category)
+		}
+	}
+
+	for _, rule := range pricing.Rules {
+		switch rule.Kind {
+		case "early_bird", "last_minute":
+			if rule.HoursBefore == nil || *rule.HoursBefore < 0 {
+				return fmt.Errorf("%s rule needs a positive hours_before", rule.Kind)
+			}
+		case "demand":
+			if rule.SeatsLeftBelow == nil || *rule.SeatsLeftBelow <= 0 || *rule.SeatsLeftBelow > 1 {
+				return fmt.Errorf("demand rule needs seats_left_below between 0 and 1")
+			}
+		default:
+			return fmt.Errorf("unknown price rule kind %s", rule.Kind)
+		}
+
+		if rule.Percent <= -100 {
+			return fmt.Errorf("price rule can't take more than 100%% off")
+		}
+	}
+
+	return nil
+}
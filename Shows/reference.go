@@ -0,0 +1,51 @@
+package main
+
+import "strings"
+
+// Booking references as bookSeat/reference.go issues them. Crockford base32:
+// no I, L, O or U so references survive being read out loud
+const referenceAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// 11 random characters (55 bits) and a check character, shown as XXXX-XXXX-XXXX
+const referenceRandomLength = 11
+
+// Luhn mod 32 check character, catches any single mistyped character and
+// most swaps of two neighbouring ones
+func referenceCheckChar(chars string) byte {
+	base := len(referenceAlphabet)
+	factor := 2
+	sum := 0
+
+	for i := len(chars) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(referenceAlphabet, chars[i])
+		factor = 3 - factor
+		sum += addend/base + addend%base
+	}
+
+	return referenceAlphabet[(base-sum%base)%base]
+}
+
+func formatBookingReference(raw string) string {
+	return raw[0:4] + "-" + raw[4:8] + "-" + raw[8:]
+}
+
+// Normalizes what a user typed: case, dashes, spaces and the characters
+// Crockford base32 reads as others. Returns false when the check fails.
+func parseBookingReference(input string) (string, bool) {
+	replacer := strings.NewReplacer("-", "", " ", "", "I", "1", "L", "1", "O", "0")
+	raw := replacer.Replace(strings.ToUpper(strings.TrimSpace(input)))
+
+	if len(raw) != referenceRandomLength+1 {
+		return "", false
+	}
+	for i := 0; i < len(raw); i++ {
+		if strings.IndexByte(referenceAlphabet, raw[i]) < 0 {
+			return "", false
+		}
+	}
+	if referenceCheckChar(raw[:referenceRandomLength]) != raw[referenceRandomLength] {
+		return "", false
+	}
+
+	return formatBookingReference(raw), true
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Replaces the whole resale policy of a show, resale is off until the organizer allows it
+type ResalePolicyForm struct {
+	ShowID      int  `json:"show_id"`
+	Allowed     bool `json:"resale_allowed"`
+	PriceCapPct int  `json:"resale_price_cap_pct"` // highest listing price, in percent of the face value
+	FeeBps      int  `json:"resale_fee_bps"`       // taken from the seller's payout, in basis points
+}
+
+type PayoutRelease struct {
+	ShowID int `json:"show_id"`
+}
+
+type payoutView struct {
+	PayoutID       int        `json:"payout_id" db:"payoutid"`
+	ListingID      int        `json:"listing_id" db:"listingid"`
+	SellerID       int        `json:"seller_id" db:"sellerid"`
+	Paymentconf_id int        `json:"paymentconf_id" db:"paymentconf_id"`
+	Gross          int64      `json:"gross" db:"gross"`
+	Fee            int64      `json:"fee" db:"fee"`
+	Net            int64      `json:"net" db:"net"`
+	Currency       string     `json:"currency" db:"currency"`
+	Status         string     `json:"status" db:"status"`
+	ReleasedAt     *time.Time `json:"released_at" db:"released_at"`
+}
+
+func (app *Config) setResalePolicy(w http.ResponseWriter, r *http.Request) {
+
+	var policy ResalePolicyForm
+
+	err := json.NewDecoder(r.Body).Decode(&policy)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse resale policy form: %v", err))
+		return
+	}
+
+	if policy.PriceCapPct <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "CheckFailed : resale_price_cap_pct must be positive")
+		return
+	}
+	if policy.FeeBps < 0 || policy.FeeBps > 10000 {
+		writeJSONError(w, http.StatusBadRequest, "CheckFailed : resale_fee_bps must be between 0 and 10000")
+		return
+	}
+
+	db := ConnecttoDB()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	show, err := lockShow(tx, policy.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ShowLookup failed : %v", err))
+		return
+	}
+
+	// Listings already up keep their price, the cap only applies to new ones
+	_, err = tx.Exec(`UPDATE Show SET Resale_allowed = $1, Resale_price_cap_pct = $2, Resale_fee_bps = $3 WHERE ShowID = $4`,
+		policy.Allowed, policy.PriceCapPct, policy.FeeBps, show.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Resale policy update failed : %v", err))
+		return
+	}
+
+	// Turning resale off takes the show's listings off the market
+	if !policy.Allowed {
+		_, err = tx.Exec(`UPDATE ResaleListing SET Status = 'withdrawn' WHERE ShowID = $1 AND Status = 'active'`, show.ShowID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Listing update failed : %v", err))
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit resale policy: %v", err))
+		return
+	}
+
+	log.Printf("Resale policy of show %d set: allowed %t, cap %d%%, fee %d bps", show.ShowID, policy.Allowed, policy.PriceCapPct, policy.FeeBps)
+
+	writeShowStatus(w, show.ShowID, "resale policy set")
+}
+
+// Pays the sellers of a show's resold seats once it has ended: each pending
+// payout's net amount, the listing price minus the resale fee, is sent through
+// the psp and the payout marked released. Payouts whose buyer payment isn't
+// captured and a cancelled show's payouts are never released.
+func (app *Config) releasePayouts(w http.ResponseWriter, r *http.Request) {
+
+	var release PayoutRelease
+
+	err := json.NewDecoder(r.Body).Decode(&release)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse payout release: %v", err))
+		return
+	}
+
+	db := ConnecttoDB()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	show, err := lockShow(tx, release.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ShowLookup failed : %v", err))
+		return
+	}
+
+	if show.Status == showCancelled {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Show %d is cancelled, its payouts are cancelled", show.ShowID))
+		return
+	}
+	if time.Now().Before(show.Endtime) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Show %d hasn't ended yet", show.ShowID))
+		return
+	}
+
+	// Sellers are only paid with money the buyer was actually charged
+	var payouts []payoutView
+	err = tx.Select(&payouts, `
+		UPDATE Payout p
+		SET Status = 'released', Released_at = NOW()
+		FROM ResaleListing l, Payment pm
+		WHERE l.ListingID = p.ListingID AND l.ShowID = $1 AND p.Status = 'pending'
+			AND pm.Paymentconf_id = p.Paymentconf_id AND pm.Status = 'captured'
+		RETURNING p.PayoutID, p.ListingID, p.SellerID, p.Paymentconf_id, p.Gross, p.Fee, p.Net, p.Currency, p.Status, p.Released_at`,
+		show.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Payout release failed : %v", err))
+		return
+	}
+
+	// A payout that can't be sent keeps every payout of the show pending, the
+	// release is simply asked for again
+	for _, payout := range payouts {
+		err = payOutSeller(payout)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Payout %d failed : %v", payout.PayoutID, err))
+			return
+		}
+	}
+
+	// Refunded, voided or never captured, nothing to pay out of
+	var cancelled []payoutView
+	err = tx.Select(&cancelled, `
+		UPDATE Payout p
+		SET Status = 'cancelled'
+		FROM ResaleListing l
+		WHERE l.ListingID = p.ListingID AND l.ShowID = $1 AND p.Status = 'pending'
+		RETURNING p.PayoutID, p.ListingID, p.SellerID, p.Paymentconf_id, p.Gross, p.Fee, p.Net, p.Currency, p.Status, p.Released_at`,
+		show.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Payout cancel failed : %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit payout release: %v", err))
+		return
+	}
+
+	log.Printf("Released %d payouts of show %d, cancelled %d", len(payouts), show.ShowID, len(cancelled))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"show_id":   show.ShowID,
+		"payouts":   payouts,
+		"cancelled": cancelled,
+	})
+}
+
+// Sends the seller the net amount of a payout
+func payOutSeller(payout payoutView) error {
+	//Simulating a psp payout
+	time.Sleep(10 * time.Millisecond)
+
+	log.Printf("Paid out %d %s to seller %d for listing %d", payout.Net, payout.Currency, payout.SellerID, payout.ListingID)
+	return nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	authmiddleware "Shows/auth"
 	"net/http"
+	"ratelimit"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -25,8 +27,33 @@ func (app *Config) routes() http.Handler {
 	//To check if service up or not
 	mux.Use(middleware.Heartbeat("/ping"))
 
+	//Rate limit per address, these are back-office calls
+	mux.Use(ratelimit.Middleware("shows_ip", ratelimit.PerMinute(300), ratelimit.ByIP))
+
 	//Add route at root level
 	mux.Post("/createShow", app.createShow)
+	mux.Post("/updateShow", app.updateShow)
+	mux.Post("/cancelShow", app.cancelShow)
+
+	//Recurring shows
+	mux.Post("/createSchedule", app.createSchedule)
+	mux.Post("/updateSchedule", app.updateSchedule)
+	mux.Post("/cancelSchedule", app.cancelSchedule)
+
+	//Per show price tiers, rules, transfer and resale policy, waiting room, limits
+	mux.Post("/setPricing", app.setPricing)
+	mux.Post("/setTransferPolicy", app.setTransferPolicy)
+	mux.Post("/setResalePolicy", app.setResalePolicy)
+	mux.Post("/setWaitingRoom", app.setWaitingRoom)
+	mux.Post("/setPurchaseLimits", app.setPurchaseLimits)
+
+	//Support, customer data and payouts are only for back-office staff
+	mux.Group(func(mux chi.Router) {
+		mux.Use(authmiddleware.AdminMiddleware)
+		mux.Post("/lookupOrders", app.lookupOrders)
+		mux.Post("/lookupTransfers", app.lookupTransfers)
+		mux.Post("/releasePayouts", app.releasePayouts)
+	})
 
 	return mux
 }
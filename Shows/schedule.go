@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Upper bound on the performances a single schedule can generate
+const maxScheduleOccurrences = 500
+
+// Recurrence rule, modelled on the RRULE BYDAY/EXDATE parts
+type ScheduleForm struct {
+	ShowName        string   `json:"show_name"`
+	VenueID         int      `json:"venue_id"`
+	HallID          int      `json:"hall_id"`
+	StartDate       string   `json:"start_date"`   // 2006-01-02, first day of the run
+	EndDate         string   `json:"end_date"`     // 2006-01-02, last day of the run
+	DaysOfWeek      []string `json:"days_of_week"` // MO, TU, WE, TH, FR, SA, SU
+	Times           []string `json:"times"`        // 15:04, start time of each performance on a day
+	DurationMinutes int      `json:"duration_minutes"`
+	Exceptions      []string `json:"exceptions"` // 2006-01-02, days without performances
+	Timezone        string   `json:"timezone"`   // IANA name, defaults to UTC
+}
+
+// Only the fields set are changed, on the performances that haven't started yet
+type ScheduleUpdate struct {
+	ScheduleID   int    `json:"schedule_id"`
+	ShowName     string `json:"show_name"`
+	HallID       int    `json:"hall_id"`
+	ShiftMinutes int    `json:"shift_minutes"`
+}
+
+type ScheduleCancel struct {
+	ScheduleID int    `json:"schedule_id"`
+	Reason     string `json:"reason"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+func (app *Config) createSchedule(w http.ResponseWriter, r *http.Request) {
+
+	var form ScheduleForm
+
+	err := json.NewDecoder(r.Body).Decode(&form)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse schedule form: %v", err))
+		return
+	}
+
+	occurrences, err := expandSchedule(form)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("CheckFailed : %v", err))
+		return
+	}
+
+	db := ConnecttoDB()
+
+	//Validate venue and hall once, the slots are checked one by one below
+	err = checkValidValues(db, occurrences[0])
+	var conflict *showConflictError
+	if errors.As(err, &conflict) {
+		writeShowConflict(w, conflict)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("CheckFailed : %v", err))
+		return
+	}
+
+	hallCapacityStr, err := getHallCapacity(db, form.VenueID, form.HallID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("HallCapacity failed : %v", err))
+		return
+	}
+	hallCapacity, err := strconv.Atoi(hallCapacityStr)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Cant convert hallCapacity to integer: %v", err))
+		return
+	}
+
+	seatIDs, err := getSeatIDs(db, form.VenueID, form.HallID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("GetSeatIDs failed : %v", err))
+		return
+	}
+
+	// Every show of the series, their reservations and show_created events are created as one unit
+	uow, err := beginUnitOfWork(db)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer uow.rollback() // Undo everything if the schedule wasn't committed
+
+	rule, err := json.Marshal(form)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to convert schedule rule to json: %v", err))
+		return
+	}
+
+	var scheduleID int
+	err = uow.tx.QueryRow(`INSERT INTO Schedule (ShowName, VenueID, HallID, Rule) VALUES ($1, $2, $3, $4) RETURNING ScheduleID`,
+		form.ShowName, form.VenueID, form.HallID, rule).Scan(&scheduleID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("ScheduleInsert failed : %v", err))
+		return
+	}
+
+	var showIDs []int
+
+	for _, show := range occurrences {
+		showID, err := insertScheduledShow(uow.tx, db, show, scheduleID, hallCapacity, seatIDs)
+		if errors.As(err, &conflict) {
+			writeShowConflict(w, conflict)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("ShowInsert failed for %s : %v", show.Starttime.Format(time.RFC3339), err))
+			return
+		}
+
+		// The seats left counter in Redis is created from this event by outboxRelay
+		err = writeOutboxEvent(uow.tx, eventShowCreated, showID, showCreatedEvent{ShowID: showID, Capacity: hallCapacity})
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Outbox entry failed : %v", err))
+			return
+		}
+
+		showIDs = append(showIDs, showID)
+	}
+
+	if err := uow.commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit schedule: %v", err))
+		return
+	}
+
+	log.Printf("Schedule %d created with %d shows", scheduleID, len(showIDs))
+
+	writeScheduleStatus(w, scheduleID, showIDs, "created")
+}
+
+func (app *Config) updateSchedule(w http.ResponseWriter, r *http.Request) {
+
+	var update ScheduleUpdate
+
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse schedule update form: %v", err))
+		return
+	}
+
+	db := ConnecttoDB()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	shows, err := lockUpcomingScheduleShows(tx, update.ScheduleID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ScheduleLookup failed : %v", err))
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE Schedule SET ShowName = COALESCE(NULLIF($1, ''), ShowName),
+						HallID = COALESCE(NULLIF($2, 0), HallID) WHERE ScheduleID = $3`,
+		update.ShowName, update.HallID, update.ScheduleID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("ScheduleUpdate failed : %v", err))
+		return
+	}
+
+	var showIDs []int
+	shift := time.Duration(update.ShiftMinutes) * time.Minute
+
+	// Move the last show first when shifting later, so a show never lands on the
+	// old slot of the next one in the series
+	if shift > 0 {
+		for i, j := 0, len(shows)-1; i < j; i, j = i+1, j-1 {
+			shows[i], shows[j] = shows[j], shows[i]
+		}
+	}
+
+	for i := range shows {
+		current := &shows[i]
+		updated := *current
+		if update.ShowName != "" {
+			updated.ShowName = update.ShowName
+		}
+		if update.HallID != 0 {
+			updated.HallID = update.HallID
+		}
+		updated.Starttime = current.Starttime.Add(shift)
+		updated.Endtime = current.Endtime.Add(shift)
+
+		_, err := applyShowUpdate(tx, db, current, updated)
+		var conflict *showConflictError
+		if errors.As(err, &conflict) {
+			writeShowConflict(w, conflict)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ShowUpdate failed for show %d : %v", current.ShowID, err))
+			return
+		}
+
+		showIDs = append(showIDs, current.ShowID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit schedule update: %v", err))
+		return
+	}
+
+	log.Printf("Schedule %d updated, %d shows changed", update.ScheduleID, len(showIDs))
+
+	writeScheduleStatus(w, update.ScheduleID, showIDs, "updated")
+}
+
+func (app *Config) cancelSchedule(w http.ResponseWriter, r *http.Request) {
+
+	var cancel ScheduleCancel
+
+	err := json.NewDecoder(r.Body).Decode(&cancel)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse schedule cancel form: %v", err))
+		return
+	}
+
+	db := ConnecttoDB()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	shows, err := lockUpcomingScheduleShows(tx, cancel.ScheduleID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ScheduleLookup failed : %v", err))
+		return
+	}
+
+	var showIDs []int
+
+	for i := range shows {
+		err = cancelShowTx(tx, &shows[i], cancel.Reason)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("ShowCancel failed for show %d : %v", shows[i].ShowID, err))
+			return
+		}
+		showIDs = append(showIDs, shows[i].ShowID)
+	}
+
+	_, err = tx.Exec(`UPDATE Schedule SET Status = $1 WHERE ScheduleID = $2`, showCancelled, cancel.ScheduleID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("ScheduleCancel failed : %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit schedule cancel: %v", err))
+		return
+	}
+
+	log.Printf("Schedule %d cancelled, %d shows cancelled", cancel.ScheduleID, len(showIDs))
+
+	writeScheduleStatus(w, cancel.ScheduleID, showIDs, showCancelled)
+}
+
+// Turns the recurrence rule into the list of performances, in date order
+func expandSchedule(form ScheduleForm) ([]Show, error) {
+	location := time.UTC
+	if form.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(form.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %s", form.Timezone)
+		}
+	}
+
+	startDate, err := time.ParseInLocation("2006-01-02", form.StartDate, location)
+	if err != nil {
+		return nil, fmt.Errorf("start_date must be formatted as YYYY-MM-DD: %v", err)
+	}
+	endDate, err := time.ParseInLocation("2006-01-02", form.EndDate, location)
+	if err != nil {
+		return nil, fmt.Errorf("end_date must be formatted as YYYY-MM-DD: %v", err)
+	}
+	if endDate.Before(startDate) {
+		return nil, fmt.Errorf("end_date is before start_date")
+	}
+	if form.DurationMinutes <= 0 {
+		return nil, fmt.Errorf("duration_minutes must be positive")
+	}
+
+	days := make(map[time.Weekday]bool)
+	for _, day := range form.DaysOfWeek {
+		weekday, ok := weekdays[strings.ToUpper(day)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day of week %s", day)
+		}
+		days[weekday] = true
+	}
+	if len(days) == 0 {
+		return nil, fmt.Errorf("days_of_week can't be empty")
+	}
+
+	var times []time.Time
+	for _, t := range form.Times {
+		parsed, err := time.Parse("15:04", t)
+		if err != nil {
+			return nil, fmt.Errorf("time %s must be formatted as HH:MM", t)
+		}
+		times = append(times, parsed)
+	}
+	if len(times) == 0 {
+		return nil, fmt.Errorf("times can't be empty")
+	}
+
+	exceptions := make(map[string]bool)
+	for _, day := range form.Exceptions {
+		exceptions[day] = true
+	}
+
+	var occurrences []Show
+	duration := time.Duration(form.DurationMinutes) * time.Minute
+
+	for day := startDate; !day.After(endDate); day = day.AddDate(0, 0, 1) {
+		if !days[day.Weekday()] || exceptions[day.Format("2006-01-02")] {
+			continue
+		}
+
+		for _, t := range times {
+			// Time_start has no time zone, it's stored as the server's local time
+			start := time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, location).In(time.Local)
+			occurrences = append(occurrences, Show{
+				ShowName:  form.ShowName,
+				VenueID:   form.VenueID,
+				HallID:    form.HallID,
+				Starttime: start,
+				Endtime:   start.Add(duration),
+			})
+		}
+
+		if len(occurrences) > maxScheduleOccurrences {
+			return nil, fmt.Errorf("schedule generates more than %d shows", maxScheduleOccurrences)
+		}
+	}
+
+	if len(occurrences) == 0 {
+		return nil, fmt.Errorf("schedule doesn't generate any show")
+	}
+
+	return occurrences, nil
+}
+
+// Creates one performance of a schedule with its reservation rows
+func insertScheduledShow(tx *sqlx.Tx, db *sqlx.DB, show Show, scheduleID int, hallCapacity int, seatIDs []string) (int, error) {
+	// Earlier performances of the series are visible inside the transaction
+	err := checkHallFree(tx, show, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	blockedUntil, err := getBlockedUntil(tx, show.HallID, show.Endtime)
+	if err != nil {
+		return 0, err
+	}
+
+	var showID int
+	err = tx.QueryRow(`INSERT INTO Show (ShowName, VenueID, HallID, Time_start, Time_end, Blocked_until, totalcapacity, currentusage, ScheduleID)
+						VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+						RETURNING showid`,
+		show.ShowName, show.VenueID, show.HallID, show.Starttime, show.Endtime, blockedUntil, hallCapacity, 0, scheduleID).Scan(&showID)
+	if err != nil {
+		return 0, asShowConflict(db, err, show, 0)
+	}
+
+	err = insertReservations(tx.Tx, showID, seatIDs)
+	if err != nil {
+		return 0, fmt.Errorf("reservation insert error: %v", err)
+	}
+
+	return showID, nil
+}
+
+// Reads and locks the performances of a schedule that haven't started yet
+func lockUpcomingScheduleShows(tx *sqlx.Tx, scheduleID int) ([]storedShow, error) {
+	var status string
+	err := tx.QueryRow(`SELECT Status FROM Schedule WHERE ScheduleID = $1 FOR UPDATE`, scheduleID).Scan(&status)
+	if err != nil {
+		return nil, fmt.Errorf("schedule with ID %d does not exist", scheduleID)
+	}
+	if status == showCancelled {
+		return nil, fmt.Errorf("schedule %d is cancelled", scheduleID)
+	}
+
+	var shows []storedShow
+	err = tx.Select(&shows, `SELECT ShowID, ShowName, VenueID, HallID, Time_start, Time_end, Status
+						FROM Show
+						WHERE ScheduleID = $1 AND Status <> 'cancelled' AND Time_start > NOW()
+						ORDER BY Time_start
+						FOR UPDATE`, scheduleID)
+	if err != nil {
+		return nil, fmt.Errorf("ScheduleShows Error: %v", err)
+	}
+
+	return shows, nil
+}
+
+func writeScheduleStatus(w http.ResponseWriter, scheduleID int, showIDs []int, status string) {
+	// Construct a JSON object
+	response := map[string]interface{}{
+		"schedule_id": scheduleID,
+		"showids":     showIDs,
+		"status":      status,
+	}
+
+	// Convert the JSON object to a JSON string
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Failed to convert schedule status to json")
+		return
+	}
+	// Set the Content-Type header to indicate JSON response
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
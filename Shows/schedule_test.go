@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandSchedule(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("no timezone data: %v", err)
+	}
+
+	base := ScheduleForm{
+		ShowName:        "Hamlet",
+		VenueID:         1,
+		HallID:          2,
+		StartDate:       "2024-03-25", // a Monday
+		EndDate:         "2024-03-31",
+		DaysOfWeek:      []string{"MO", "WE"},
+		Times:           []string{"20:00"},
+		DurationMinutes: 150,
+	}
+
+	tests := []struct {
+		name   string
+		change func(form *ScheduleForm)
+		starts []time.Time
+	}{
+		{
+			name:   "days of the week",
+			change: func(form *ScheduleForm) {},
+			starts: []time.Time{
+				time.Date(2024, 3, 25, 20, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 27, 20, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "lower case days and several times a day",
+			change: func(form *ScheduleForm) {
+				form.DaysOfWeek = []string{"sa"}
+				form.Times = []string{"14:30", "20:00"}
+			},
+			starts: []time.Time{
+				time.Date(2024, 3, 30, 14, 30, 0, 0, time.UTC),
+				time.Date(2024, 3, 30, 20, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:   "exceptions are skipped",
+			change: func(form *ScheduleForm) { form.Exceptions = []string{"2024-03-27"} },
+			starts: []time.Time{time.Date(2024, 3, 25, 20, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:   "single day run",
+			change: func(form *ScheduleForm) { form.EndDate = form.StartDate },
+			starts: []time.Time{time.Date(2024, 3, 25, 20, 0, 0, 0, time.UTC)},
+		},
+		{
+			// Clocks go forward on the 31st, the show still starts at 20:00 local time
+			name: "local time across a daylight saving change",
+			change: func(form *ScheduleForm) {
+				form.DaysOfWeek = []string{"SA", "SU"}
+				form.Timezone = "Europe/Paris"
+			},
+			starts: []time.Time{
+				time.Date(2024, 3, 30, 20, 0, 0, 0, paris),
+				time.Date(2024, 3, 31, 20, 0, 0, 0, paris),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := base
+			tt.change(&form)
+
+			shows, err := expandSchedule(form)
+			if err != nil {
+				t.Fatalf("expandSchedule: %v", err)
+			}
+			if len(shows) != len(tt.starts) {
+				t.Fatalf("got %d shows, want %d: %v", len(shows), len(tt.starts), shows)
+			}
+			for i, show := range shows {
+				if !show.Starttime.Equal(tt.starts[i]) {
+					t.Errorf("show %d starts at %v, want %v", i, show.Starttime, tt.starts[i])
+				}
+				if show.Starttime.Location() != time.Local || show.Endtime.Location() != time.Local {
+					t.Errorf("show %d isn't in the server's time zone: %v", i, show.Starttime)
+				}
+				if got := show.Endtime.Sub(show.Starttime); got != 150*time.Minute {
+					t.Errorf("show %d lasts %v, want 2h30m", i, got)
+				}
+				if show.ShowName != form.ShowName || show.VenueID != form.VenueID || show.HallID != form.HallID {
+					t.Errorf("show %d is %+v, not of the schedule", i, show)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandScheduleErrors(t *testing.T) {
+	valid := ScheduleForm{
+		StartDate:       "2024-03-25",
+		EndDate:         "2024-03-31",
+		DaysOfWeek:      []string{"MO"},
+		Times:           []string{"20:00"},
+		DurationMinutes: 90,
+	}
+
+	tests := []struct {
+		name   string
+		change func(form *ScheduleForm)
+		err    string
+	}{
+		{"unknown timezone", func(form *ScheduleForm) { form.Timezone = "Mars/Olympus" }, "unknown timezone"},
+		{"bad start date", func(form *ScheduleForm) { form.StartDate = "25/03/2024" }, "start_date"},
+		{"bad end date", func(form *ScheduleForm) { form.EndDate = "" }, "end_date"},
+		{"end before start", func(form *ScheduleForm) { form.EndDate = "2024-03-24" }, "before start_date"},
+		{"no duration", func(form *ScheduleForm) { form.DurationMinutes = 0 }, "duration_minutes"},
+		{"unknown day", func(form *ScheduleForm) { form.DaysOfWeek = []string{"MONDAY"} }, "unknown day of week"},
+		{"no days", func(form *ScheduleForm) { form.DaysOfWeek = nil }, "days_of_week"},
+		{"bad time", func(form *ScheduleForm) { form.Times = []string{"8pm"} }, "HH:MM"},
+		{"no times", func(form *ScheduleForm) { form.Times = nil }, "times"},
+		{"every day excepted", func(form *ScheduleForm) { form.Exceptions = []string{"2024-03-25"} }, "doesn't generate any show"},
+		{
+			"too many shows",
+			func(form *ScheduleForm) {
+				form.EndDate = "2030-12-31"
+				form.DaysOfWeek = []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"}
+			},
+			"more than",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := valid
+			tt.change(&form)
+
+			shows, err := expandSchedule(form)
+			if err == nil {
+				t.Fatalf("expandSchedule returned %d shows, want an error containing %q", len(shows), tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %q doesn't contain %q", err, tt.err)
+			}
+		})
+	}
+}
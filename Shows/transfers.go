@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Replaces the whole transfer policy of a show, bookSeat checks it when a
+// customer offers a ticket and again when the recipient accepts
+type TransferPolicyForm struct {
+	ShowID        int   `json:"show_id"`
+	Allowed       *bool `json:"transfers_allowed"`       // true when not set
+	CutoffMinutes int   `json:"transfer_cutoff_minutes"` // transfers close this long before the show starts
+	MaxTransfers  *int  `json:"max_transfers"`           // times one seat's ticket can change hands, nil for no limit
+}
+
+// Support looks up the transfers of a ticket, an order, a user or a show
+type TransferLookup struct {
+	TicketID  string `json:"ticket_id"`
+	Reference string `json:"reference"`
+	UserID    int    `json:"user_id"`
+	ShowID    int    `json:"show_id"`
+}
+
+type transferView struct {
+	TransferID  int        `json:"transfer_id" db:"transferid"`
+	TicketID    string     `json:"ticket_id" db:"ticketid"`
+	NewTicketID *string    `json:"new_ticket_id" db:"new_ticketid"`
+	Reference   string     `json:"reference" db:"order_reference"`
+	ShowID      int        `json:"show_id" db:"showid"`
+	Seat        string     `json:"seat_reservation_id" db:"seatreservationid"`
+	FromID      int        `json:"from_user_id" db:"fromid"`
+	FromName    *string    `json:"from_username" db:"from_username"`
+	ToID        int        `json:"to_user_id" db:"toid"`
+	ToName      *string    `json:"to_username" db:"to_username"`
+	Status      string     `json:"status" db:"status"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at" db:"expires_at"`
+	RespondedAt *time.Time `json:"responded_at" db:"responded_at"`
+}
+
+func (app *Config) setTransferPolicy(w http.ResponseWriter, r *http.Request) {
+
+	var policy TransferPolicyForm
+
+	err := json.NewDecoder(r.Body).Decode(&policy)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse transfer policy form: %v", err))
+		return
+	}
+
+	if policy.CutoffMinutes < 0 {
+		writeJSONError(w, http.StatusBadRequest, "CheckFailed : transfer_cutoff_minutes can't be negative")
+		return
+	}
+	if policy.MaxTransfers != nil && *policy.MaxTransfers < 0 {
+		writeJSONError(w, http.StatusBadRequest, "CheckFailed : max_transfers can't be negative")
+		return
+	}
+
+	allowed := true
+	if policy.Allowed != nil {
+		allowed = *policy.Allowed
+	}
+
+	db := ConnecttoDB()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	show, err := lockShow(tx, policy.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ShowLookup failed : %v", err))
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE Show SET Transfers_allowed = $1, Transfer_cutoff_minutes = $2, Max_transfers = $3 WHERE ShowID = $4`,
+		allowed, policy.CutoffMinutes, policy.MaxTransfers, show.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Transfer policy update failed : %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit transfer policy: %v", err))
+		return
+	}
+
+	log.Printf("Transfer policy of show %d set: allowed %t, cutoff %d minutes", show.ShowID, allowed, policy.CutoffMinutes)
+
+	writeShowStatus(w, show.ShowID, "transfer policy set")
+}
+
+// Audit trail of ticket transfers, every offer is kept whatever became of it
+func (app *Config) lookupTransfers(w http.ResponseWriter, r *http.Request) {
+
+	var lookup TransferLookup
+
+	err := json.NewDecoder(r.Body).Decode(&lookup)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse transfer lookup: %v", err))
+		return
+	}
+
+	if lookup.TicketID == "" && lookup.Reference == "" && lookup.UserID == 0 && lookup.ShowID == 0 {
+		writeJSONError(w, http.StatusBadRequest, "Transfer lookup needs a ticket_id, reference, user_id or show_id")
+		return
+	}
+
+	if lookup.Reference != "" {
+		reference, ok := parseBookingReference(lookup.Reference)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%q isn't a valid booking reference", lookup.Reference))
+			return
+		}
+		lookup.Reference = reference
+	}
+
+	db := ConnecttoDB()
+
+	// A ticket id matches both sides of the transfer, so the chain of holders can be followed
+	var transfers []transferView
+	err = db.Select(&transfers, `
+		SELECT tt.TransferID, tt.TicketID, tt.New_ticketID, t.Order_reference, tt.ShowID, t.SeatReservationID,
+			tt.FromID, uf.username AS from_username, tt.ToID, ut.username AS to_username,
+			CASE WHEN tt.Status = 'pending' AND tt.Expires_at <= NOW() THEN 'expired' ELSE tt.Status END AS status,
+			tt.Created_at, tt.Expires_at, tt.Responded_at
+		FROM TicketTransfer tt
+		JOIN Ticket t ON t.TicketID = tt.TicketID
+		LEFT JOIN Users uf ON uf.UserID = tt.FromID
+		LEFT JOIN Users ut ON ut.UserID = tt.ToID
+		WHERE ($1 = '' OR tt.TicketID = $1 OR tt.New_ticketID = $1)
+			AND ($2 = '' OR t.Order_reference = $2)
+			AND ($3 = 0 OR tt.FromID = $3 OR tt.ToID = $3)
+			AND ($4 = 0 OR tt.ShowID = $4)
+		ORDER BY tt.Created_at DESC
+		LIMIT 100`,
+		lookup.TicketID, lookup.Reference, lookup.UserID, lookup.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Transfer lookup failed : %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transfers": transfers,
+	})
+}
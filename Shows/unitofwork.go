@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Creating shows writes to Postgres only, Redis is kept in sync through the
+// outbox, so a failure at any step leaves nothing behind.
+type unitOfWork struct {
+	tx       *sqlx.Tx
+	finished bool
+}
+
+func beginUnitOfWork(db *sqlx.DB) (*unitOfWork, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	return &unitOfWork{tx: tx}, nil
+}
+
+// Rolls the transaction back. Does nothing once the unit of work has been
+// committed, so it can be deferred.
+func (u *unitOfWork) rollback() {
+	if u.finished {
+		return
+	}
+	u.finished = true
+
+	if err := u.tx.Rollback(); err != nil {
+		log.Printf("Rollback failed: %v", err)
+	}
+}
+
+func (u *unitOfWork) commit() error {
+	u.finished = true
+
+	return u.tx.Commit()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Puts the on-sale of a show behind the waiting room, claimSeat and checkPayment
+// then only serve users holding an admission token between on_sale_start and
+// on_sale_end. Leaving on_sale_start out takes the show out of the waiting room.
+type WaitingRoomForm struct {
+	ShowID         int        `json:"show_id"`
+	Opens          *time.Time `json:"waiting_room_opens"` // arrivals before on_sale_start are let in in a random order
+	OnSaleStart    *time.Time `json:"on_sale_start"`
+	OnSaleEnd      *time.Time `json:"on_sale_end"`
+	AdmitPerMinute int        `json:"admit_per_minute"`
+}
+
+func (app *Config) setWaitingRoom(w http.ResponseWriter, r *http.Request) {
+
+	var room WaitingRoomForm
+
+	err := json.NewDecoder(r.Body).Decode(&room)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse waiting room form: %v", err))
+		return
+	}
+
+	if room.OnSaleStart != nil {
+		if room.OnSaleEnd == nil || !room.OnSaleEnd.After(*room.OnSaleStart) {
+			writeJSONError(w, http.StatusBadRequest, "CheckFailed : on_sale_end must be after on_sale_start")
+			return
+		}
+		if room.Opens != nil && room.Opens.After(*room.OnSaleStart) {
+			writeJSONError(w, http.StatusBadRequest, "CheckFailed : waiting_room_opens can't be after on_sale_start")
+			return
+		}
+		if room.AdmitPerMinute <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "CheckFailed : admit_per_minute must be positive")
+			return
+		}
+	} else {
+		room.Opens, room.OnSaleEnd = nil, nil
+	}
+
+	db := ConnecttoDB()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to begin transaction: %v", err))
+		return
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	show, err := lockShow(tx, room.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("ShowLookup failed : %v", err))
+		return
+	}
+
+	if show.Status == showCancelled {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Show %d is cancelled", show.ShowID))
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE Show SET Waiting_room_opens = $1, On_sale_start = $2, On_sale_end = $3, Admit_per_minute = $4 WHERE ShowID = $5`,
+		room.Opens, room.OnSaleStart, room.OnSaleEnd, room.AdmitPerMinute, show.ShowID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Waiting room update failed : %v", err))
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to commit waiting room: %v", err))
+		return
+	}
+
+	if room.OnSaleStart == nil {
+		log.Printf("Waiting room of show %d removed", show.ShowID)
+		writeShowStatus(w, show.ShowID, "waiting room removed")
+		return
+	}
+
+	log.Printf("Waiting room of show %d set: on sale %v to %v, %d admitted per minute", show.ShowID, *room.OnSaleStart, *room.OnSaleEnd, room.AdmitPerMinute)
+
+	writeShowStatus(w, show.ShowID, "waiting room set")
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,11 +17,12 @@ import (
 )
 
 func SignUp(c *gin.Context) {
-	//Get email password
+	//Get username, password and email
 	var body struct {
 		Userid   int    `json:"userid"`
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Email    string `json:"email"`
 	}
 
 	if c.Bind(&body) != nil {
@@ -29,6 +32,20 @@ func SignUp(c *gin.Context) {
 		return
 	}
 	fmt.Println("Parsed Body:", body)
+
+	//Email is optional, stored lower case so transfers can find the user by it
+	var email *string
+	if body.Email != "" {
+		address, err := mail.ParseAddress(body.Email)
+		if err != nil || address.Address != strings.TrimSpace(body.Email) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid email address",
+			})
+			return
+		}
+		normalized := strings.ToLower(address.Address)
+		email = &normalized
+	}
 	//hashing the password
 	hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), 10)
 
@@ -40,7 +57,7 @@ func SignUp(c *gin.Context) {
 	}
 
 	//User details
-	user := models.User{Userid: body.Userid, Username: body.Username, Password: string(hash)}
+	user := models.User{Userid: body.Userid, Username: body.Username, Password: string(hash), Email: email}
 
 	result := initializers.DB.Create(&user)
 	if result.Error != nil {
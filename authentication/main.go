@@ -3,6 +3,9 @@ package main
 import (
 	initializers "authentication/initialisers"
 	"os"
+	"ratelimit"
+	"ratelimit/ginlimit"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,10 +19,25 @@ func init() {
 func main() {
 	r := gin.Default()
 
-	r.POST("/signup", SignUp)
-	r.POST("/login", Login)
+	// ClientIP only believes X-Forwarded-For from the proxies listed in
+	// TRUSTED_PROXIES, none by default, or the rate limits key on what clients write there
+	var proxies []string
+	if list := os.Getenv("TRUSTED_PROXIES"); list != "" {
+		proxies = strings.Split(list, ",")
+	}
+	err := r.SetTrustedProxies(proxies)
+	if err != nil {
+		panic("[Error] invalid TRUSTED_PROXIES: " + err.Error())
+	}
+
+	// Brute force protection, per address and per account tried
+	r.POST("/signup", ginlimit.Middleware("signup_ip", ratelimit.PerMinute(5), ginlimit.ByIP), SignUp)
+	r.POST("/login",
+		ginlimit.Middleware("login_ip", ratelimit.PerMinute(10), ginlimit.ByIP),
+		ginlimit.Middleware("login_username", ratelimit.PerMinute(5), ginlimit.ByUsername),
+		Login)
 
-	err := r.Run(os.Getenv("PORT"))
+	err = r.Run(os.Getenv("PORT"))
 	if err != nil {
 		panic("[Error] failed to start Gin server due to: " + err.Error())
 	}
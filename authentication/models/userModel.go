@@ -7,4 +7,5 @@ type User struct {
 	Userid   int `gorm:"unique"`
 	Username string
 	Password string
+	Email    *string `gorm:"unique"` // optional, other customers can send tickets to it
 }
@@ -2,6 +2,7 @@ package authmiddleware
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,6 +14,17 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+type contextKey string
+
+const userIDKey contextKey = "user_id"
+
+// User the JWT was issued to, set by JWTMiddleware. Handlers of requests
+// without a body (GET) read it from here instead of the body.
+func UserID(ctx context.Context) (int, bool) {
+	userID, ok := ctx.Value(userIDKey).(int)
+	return userID, ok
+}
+
 func JWTMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Extract token from Authorization header
@@ -44,14 +56,6 @@ func JWTMiddleware(next http.Handler) http.Handler {
 				http.Error(w, "Error: Claim time isnt correct ", http.StatusUnauthorized)
 				return
 			}
-			//Attach to request
-			// Token is valid, add userID to request body
-			body := make(map[string]interface{})
-			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-				http.Error(w, "Error: Failed to decode request body", http.StatusInternalServerError)
-				return
-			}
-
 			// Convert the value of claims["sub"] to a float64
 			sub, ok := claims["sub"].(float64)
 			if !ok {
@@ -60,6 +64,26 @@ func JWTMiddleware(next http.Handler) http.Handler {
 			}
 			// Convert the float64 value to an integer
 			value := int(sub)
+			r = r.WithContext(context.WithValue(r.Context(), userIDKey, value))
+
+			// Requests without a body only get the user in the context
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			//Attach to request
+			// Token is valid, add userID to request body
+			body := make(map[string]interface{})
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err == io.EOF {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Error: Failed to decode request body", http.StatusInternalServerError)
+				return
+			}
 			body["user_id"] = value
 
 			// Encode the modified body and create a new request with it
@@ -0,0 +1,62 @@
+package authmiddleware
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Header the orchestrator authenticates itself with, next to the user's JWT
+const ServiceTokenHeader = "X-Service-Token"
+
+var serviceSecret []byte
+
+// Reads SERVICE_TOKEN_SECRET, shared with the orchestrator. Called at startup,
+// the rate limits can't tell the orchestrator from a customer without it.
+func LoadServiceSecret() {
+	secret := os.Getenv("SERVICE_TOKEN_SECRET")
+	if secret == "" {
+		log.Fatal("Error: SERVICE_TOKEN_SECRET is not set")
+	}
+	serviceSecret = []byte(secret)
+}
+
+// Whether the request carries a valid service token, the orchestrator's calls
+// are only rate limited per user
+func FromService(r *http.Request) bool {
+	_, err := ServiceUser(r)
+	return err == nil
+}
+
+// User the orchestrator is acting for, an error when the request doesn't carry
+// a valid service token
+func ServiceUser(r *http.Request) (int, error) {
+	tokenString := r.Header.Get(ServiceTokenHeader)
+	if tokenString == "" {
+		return 0, fmt.Errorf("service token is missing")
+	}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return serviceSecret, nil
+	}, jwt.WithIssuer("orchestrator"), jwt.WithExpirationRequired())
+	if err != nil {
+		return 0, fmt.Errorf("invalid service token: %v", err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return 0, fmt.Errorf("invalid service token claims")
+	}
+	sub, ok := claims["sub"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("service token has no user")
+	}
+
+	return int(sub), nil
+}
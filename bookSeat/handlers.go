@@ -4,9 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"regexp"
 	"sort"
@@ -17,19 +18,32 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	_ "github.com/lib/pq" // Import PostgreSQL driver
-	"github.com/redis/go-redis/v9"
 )
 
 type ReservationRequest struct {
 	SeatReservationIDs []string `json:"seatreservation_ids"`
 	BookedbyID         int      `json:"user_id"`
+	Paymentconf_id     int      `json:"paymentconf_id"`
+	PromoCode          string   `json:"promo_code"`
+	Receipt            *Receipt `json:"receipt"`
+}
+
+// Payment data received by the listener, the booking outcome goes back on
+// Result so the listener can tell checkPayment whether to capture or void
+type paymentDelivery struct {
+	Data   PaymentData
+	Result chan error
 }
 
 type PaymentData struct {
-	Price          int      `json:"price"`
+	Amount         int64    `json:"amount"`   // minor units
+	Currency       string   `json:"currency"` // ISO 4217
 	Userid         int      `json:"user_id"`
+	ShowID         int      `json:"show_id"` // the show checkPayment priced and admitted
 	Seats          []string `json:"seat_ids"`
 	Paymentconf_id int      `json:"paymentconf_id"`
+	PromoCode      string   `json:"promo_code,omitempty"`
+	Receipt        *Receipt `json:"receipt"`
 }
 
 // Reservation request structure, based on Reservation table DB schema
@@ -71,31 +85,58 @@ func (app *Config) HandleBookSeat(w http.ResponseWriter, r *http.Request) {
 	tx, err := db.Beginx()
 	if err != nil {
 		// Handle error
-		http.Error(w, fmt.Sprintf("Error: Error creating DB transaction", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error: Error creating DB transaction: %v", err), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
 
 	// Go routine that waits for incoming payment data
 	sort.Strings(reservationform.SeatIDs)
 
 	paymenturl := getPaymentUrl(reservationform.SeatIDs, reservationform.BookedbyID)
-	paymentDataChan := make(chan PaymentData)
+	deliveries := make(chan paymentDelivery)
 
-	go listenForPaymentData(paymenturl, paymentDataChan)
+	go listenForPaymentData(paymenturl, deliveries, r.Context().Done())
+
+	// Wait for payment data, the funds are only authorized at this point.
+	// A caller that gives up stops the listener, no payment can arrive after that
+	var delivery paymentDelivery
+	select {
+	case delivery = <-deliveries:
+	case <-r.Context().Done():
+		log.Printf("Booking of %v for user %d abandoned before payment", reservationform.SeatIDs, reservationform.BookedbyID)
+		return
+	}
+	paymentData := delivery.Data
 
-	// Wait for payment data
-	paymentData := <-paymentDataChan
+	log.Println("Payment data; amount: ", paymentData.Amount, paymentData.Currency, " conf id : ", paymentData.Paymentconf_id, " seats: ", paymentData.Seats)
 
-	log.Println("Payment data; price: ", paymentData.Price, " conf id : ", paymentData.Paymentconf_id, " seats: ", paymentData.Seats)
+	// checkPayment captures the funds only if the booking went through, and voids them otherwise
+	reference, err := confirmPaidBooking(tx, db, reservationform, paymentData)
+	delivery.Result <- err
+	var overLimit *limitError
+	if errors.As(err, &overLimit) {
+		http.Error(w, fmt.Sprintf("Error: Purchase limit reached: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to book Seat: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-	// //Dummy check
-	// log.Println("OG: ", reservationform.BookedbyID)
-	// log.Println("GOT: ", paymentData.Userid)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Success: Seat %v for Show %v is booked for user %v, booking reference %s", reservationform.SeatIDs, reservationform.ShowID, reservationform.BookedbyID, reference)
+}
 
+// Checks the payment matches the reservation form and saves the booking, returns its reference
+func confirmPaidBooking(tx *sqlx.Tx, db *sqlx.DB, reservationform ReservationForm, paymentData PaymentData) (string, error) {
 	//Check from paymentData and OG
 	if reservationform.BookedbyID != paymentData.Userid {
-		http.Error(w, fmt.Sprintf("Error: User arent same as Payment: %v", err), http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("user %d isn't the one who paid", reservationform.BookedbyID)
+	}
+	// Seat IDs repeat in every show of a hall, the payment has to be for this show
+	if reservationform.ShowID != paymentData.ShowID {
+		return "", fmt.Errorf("payment is for show %d, not show %d", paymentData.ShowID, reservationform.ShowID)
 	}
 	//Sort for proper check
 	sort.Strings(paymentData.Seats)
@@ -104,8 +145,7 @@ func (app *Config) HandleBookSeat(w http.ResponseWriter, r *http.Request) {
 	log.Print("Reservation Seats", reservationform.SeatIDs)
 
 	if !isSeatsSame(paymentData.Seats, reservationform.SeatIDs) {
-		http.Error(w, fmt.Sprintf("Error: Seats arent same as Payment: OG: %v %v", err), http.StatusInternalServerError)
-		return
+		return "", fmt.Errorf("seats arent same as Payment: OG: %v %v", reservationform.SeatIDs, paymentData.Seats)
 	}
 
 	//Proceed with saving the data, in the db
@@ -118,16 +158,12 @@ func (app *Config) HandleBookSeat(w http.ResponseWriter, r *http.Request) {
 		reservation.SeatReservationIDs = append(reservation.SeatReservationIDs, "SH_"+strconv.Itoa(reservationform.ShowID)+"_ST_"+seatID)
 	}
 	reservation.BookedbyID = reservationform.BookedbyID
+	reservation.Paymentconf_id = paymentData.Paymentconf_id
+	reservation.PromoCode = paymentData.PromoCode
+	reservation.Receipt = paymentData.Receipt
 
 	//Send the request to the producer function
-	err = saveBooking(tx, db, reservation, reservationform.ShowID)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error: Failed to book Seat: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, "Success: Seat %v for Show %v is booked for user %v", reservationform.SeatIDs, reservationform.ShowID, reservationform.BookedbyID)
+	return saveBooking(tx, db, reservation, reservationform.ShowID)
 }
 
 func isSeatsSame(slice1, slice2 []string) bool {
@@ -183,12 +219,12 @@ func checkBookingDataValid(db *sqlx.DB, reservationform ReservationForm) error {
 
 	// Check if show exists
 	var showExists bool
-	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM show WHERE showid = $1)`, reservationform.ShowID).Scan(&showExists)
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM show WHERE showid = $1 AND status <> 'cancelled')`, reservationform.ShowID).Scan(&showExists)
 	if err != nil {
 		return fmt.Errorf("ShowExists Error: %v", err)
 	}
 	if !showExists {
-		return fmt.Errorf("show with ID %d does not exist", reservationform.ShowID)
+		return fmt.Errorf("show with ID %d does not exist or is cancelled", reservationform.ShowID)
 	}
 
 	// log.Printf("DEBUG: showcheck done for show: %v", claimseatform.ShowID)
@@ -196,23 +232,37 @@ func checkBookingDataValid(db *sqlx.DB, reservationform ReservationForm) error {
 	return nil
 }
 
-func saveBooking(tx *sqlx.Tx, db *sqlx.DB, reservation ReservationRequest, showid int) error {
+func saveBooking(tx *sqlx.Tx, db *sqlx.DB, reservation ReservationRequest, showid int) (string, error) {
 	log.Println("Inside Consumer_saveToDatabase")
-	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	err := checkBookingLimits(tx, showid, reservation.BookedbyID, reservation.SeatReservationIDs)
+	if err != nil {
+		return "", err
+	}
+
+	// Seats on resale are booked already, they are bought from their holder
+	listings, err := lockActiveListings(tx, reservation.SeatReservationIDs)
+	if err != nil {
+		return "", err
+	}
+	resale := len(listings) > 0
+	if resale && len(listings) != len(reservation.SeatReservationIDs) {
+		return "", fmt.Errorf("resale seats have to be booked on their own")
+	}
 
 	// Check if any of the provided SeatReservationIDs are already booked
 	var count int
-	err := tx.Get(&count, `
+	err = tx.Get(&count, `
     SELECT COUNT(*)
     FROM Reservation
     WHERE SeatReservationID = ANY($1) AND Booked = TRUE`, pq.Array(reservation.SeatReservationIDs))
 
 	if err != nil && err != sql.ErrNoRows {
-		return fmt.Errorf("error querying booked status: %v", err)
+		return "", fmt.Errorf("error querying booked status: %v", err)
 	}
 
-	if count > 0 {
-		return fmt.Errorf("the exact seat range isn't available")
+	if count > 0 && !resale {
+		return "", fmt.Errorf("the exact seat range isn't available")
 	}
 
 	// Check if all claimedbyID match the bookedbyID
@@ -223,100 +273,122 @@ func saveBooking(tx *sqlx.Tx, db *sqlx.DB, reservation ReservationRequest, showi
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return fmt.Errorf("no rows found for SeatReservationIDs: %v", reservation.SeatReservationIDs)
+			return "", fmt.Errorf("no rows found for SeatReservationIDs: %v", reservation.SeatReservationIDs)
 		}
-		return fmt.Errorf("error querying claimedbyIDs: %v", err)
+		return "", fmt.Errorf("error querying claimedbyIDs: %v", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var claimedByID sql.NullInt64
 		if err := rows.Scan(&claimedByID); err != nil {
-			return fmt.Errorf("error scanning claimedByID: %v", err)
+			return "", fmt.Errorf("error scanning claimedByID: %v", err)
 		}
 
 		if !claimedByID.Valid {
-			return fmt.Errorf("seats need to be claimed first")
+			return "", fmt.Errorf("seats need to be claimed first")
 		}
 
 		if int(claimedByID.Int64) != reservation.BookedbyID {
-			return fmt.Errorf("some/many seats are claimed by a different user than the one booking them")
+			return "", fmt.Errorf("some/many seats are claimed by a different user than the one booking them")
 		}
 	}
 
-	// Update the reservation in the database
-	err = updateReservationDB(tx, reservation.SeatReservationIDs, reservation.BookedbyID)
+	// One order, and one reference, for all the seats paid together
+	reference, err := createOrder(tx, reservation, showid)
 	if err != nil {
-		return fmt.Errorf("update reservation error: %v", err)
-	}
-
-	log.Println("Data saved to database")
-
-	// Commit the transaction
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return "", fmt.Errorf("order error: %v", err)
 	}
 
-	// Update Redis Cache with decremented capacity
-	err = updateSeatLeftRedis(showid, len(reservation.SeatReservationIDs))
+	// Update the reservation in the database
+	err = updateReservationDB(tx, reservation.SeatReservationIDs, reservation.BookedbyID, reference)
 	if err != nil {
-		return fmt.Errorf("redis update error: %v", err)
+		return "", fmt.Errorf("update reservation error: %v", err)
 	}
 
-	return nil
-}
-
-func updateReservationDB(tx *sqlx.Tx, SeatReservationIDs []string, BookedbyID int) error {
-	for _, seatReservationID := range SeatReservationIDs {
-		_, err := tx.Exec(`
-            UPDATE Reservation 
-            SET BookedbyID = $1, Booked = true, Booking_confirmID = $2
-            WHERE SeatReservationID = $3`,
-			BookedbyID, generateBookingConfirmationID(), seatReservationID)
-
+	// Tickets exist exactly when the booking does, a resold seat already has one
+	if resale {
+		err = sellListings(tx, listings, reservation.BookedbyID, reference, reservation.Paymentconf_id)
+		if err != nil {
+			return "", fmt.Errorf("resale error: %v", err)
+		}
+	} else {
+		err = issueTickets(tx, reference, showid, reservation.BookedbyID, reservation.SeatReservationIDs)
 		if err != nil {
-			return fmt.Errorf("error updating database: %v", err)
+			return "", fmt.Errorf("ticket error: %v", err)
 		}
 	}
-	return nil
-}
 
-func updateSeatLeftRedis(showID int, seatsbooked int) error {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
-
-	defer rdb.Close()
+	// Receipt is kept with the booking for reconciliation
+	if reservation.Receipt != nil {
+		err = saveReceipt(tx, reservation, showid)
+		if err != nil {
+			return "", fmt.Errorf("receipt error: %v", err)
+		}
+	}
 
-	// Context for the Redis operations.
-	ctx := context.Background()
+	// Promo code is used up together with the booking, or not at all
+	if reservation.PromoCode != "" {
+		err = redeemVoucher(tx, reservation, showid)
+		if err != nil {
+			return "", fmt.Errorf("promo code error: %v", err)
+		}
+	}
 
-	//Get current seatleft value from Redis
-	seatsLeftCmd := rdb.Get(ctx, strconv.Itoa(showID))
-	seatsLeft, err := seatsLeftCmd.Int()
+	// The seats left counter in Redis is decremented from this event by outboxRelay,
+	// a resale doesn't change how many seats are left
+	if resale {
+		listingIDs := make([]int, len(listings))
+		for i, listing := range listings {
+			listingIDs[i] = listing.ListingID
+		}
+		err = writeOutboxEvent(tx, eventSeatResold, showid, seatResoldEvent{
+			ShowID:             showid,
+			BuyerID:            reservation.BookedbyID,
+			SeatReservationIDs: reservation.SeatReservationIDs,
+			ListingIDs:         listingIDs,
+			Paymentconf_id:     reservation.Paymentconf_id,
+			BookingReference:   reference,
+		})
+	} else {
+		err = writeOutboxEvent(tx, eventSeatBooked, showid, seatBookedEvent{
+			ShowID:             showid,
+			UserID:             reservation.BookedbyID,
+			SeatReservationIDs: reservation.SeatReservationIDs,
+			Seats:              len(reservation.SeatReservationIDs),
+			Paymentconf_id:     reservation.Paymentconf_id,
+			BookingReference:   reference,
+		})
+	}
 	if err != nil {
-		return fmt.Errorf("error getting seatsLeft from Redis: %v", err)
+		return "", fmt.Errorf("outbox error: %v", err)
 	}
 
-	new_seatsLeft := seatsLeft - seatsbooked
+	log.Println("Data saved to database")
 
-	// Update the value in Redis.
-	err = rdb.Set(ctx, strconv.Itoa(showID), new_seatsLeft, 0).Err()
-	if err != nil {
-		return fmt.Errorf("error setting value in Redis: %v", err)
+	// Commit the transaction
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
-	return nil
+	return reference, nil
 }
 
-func generateBookingConfirmationID() int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(900000) + 100000 // Generates a random number between 100000 and 999999
+// Every seat of the order gets the same booking reference
+func updateReservationDB(tx *sqlx.Tx, SeatReservationIDs []string, BookedbyID int, reference string) error {
+	_, err := tx.Exec(`
+            UPDATE Reservation 
+            SET BookedbyID = $1, Booked = true, Booking_confirmID = $2
+            WHERE SeatReservationID = ANY($3)`,
+		BookedbyID, reference, pq.Array(SeatReservationIDs))
+
+	if err != nil {
+		return fmt.Errorf("error updating database: %v", err)
+	}
+	return nil
 }
 
-func listenForPaymentData(paymenturl string, paymentDataChan chan PaymentData) {
+func listenForPaymentData(paymenturl string, deliveries chan paymentDelivery, stop <-chan struct{}) {
 
 	defer fmt.Printf("DEBUG_Conc: Exited the listenForPaymentData")
 
@@ -336,20 +408,52 @@ func listenForPaymentData(paymenturl string, paymentDataChan chan PaymentData) {
 			return
 		}
 
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read payload", http.StatusBadRequest)
+			return
+		}
+
+		// Only checkPayment knows the secret, anything else posting here is ignored
+		signature, err := verifyWebhookSignature(r.Header.Get(webhookSignatureHeader), body, time.Now())
+		if err != nil {
+			log.Printf("Rejected payment data on %s: %v", paymenturl, err)
+			http.Error(w, fmt.Sprintf("Invalid signature: %v", err), http.StatusUnauthorized)
+			return
+		}
+
+		err = checkWebhookReplay(signature)
+		if err != nil {
+			log.Printf("Rejected payment data on %s: %v", paymenturl, err)
+			http.Error(w, fmt.Sprintf("Rejected payment data: %v", err), http.StatusConflict)
+			return
+		}
+
 		var paymentData PaymentData
-		err := json.NewDecoder(r.Body).Decode(&paymentData)
+		err = json.Unmarshal(body, &paymentData)
 		if err != nil {
 			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
 			return
 		}
 
-		// Send the payment data to the channel
-		paymentDataChan <- paymentData
-
-		// Respond with a success message
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"message": "Payment data received successfully"}`)
+		// Send the payment data to the channel and wait for the booking outcome
+		result := make(chan error, 1)
+		select {
+		case deliveries <- paymentDelivery{Data: paymentData, Result: result}:
+		case <-stop:
+			http.Error(w, "Booking abandoned", http.StatusGone)
+			return
+		}
+		bookingErr := <-result
+
+		if bookingErr != nil {
+			http.Error(w, fmt.Sprintf("Booking failed: %v", bookingErr), http.StatusConflict)
+		} else {
+			// Respond with a success message
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, `{"message": "Booking confirmed"}`)
+		}
 
 		// Signal that the response is sent
 		close(responseSent)
@@ -367,8 +471,11 @@ func listenForPaymentData(paymenturl string, paymentDataChan chan PaymentData) {
 		}
 	}()
 
-	// Wait for the response to be sent
-	<-responseSent
+	// Wait for the response to be sent, or for the booking to be abandoned
+	select {
+	case <-responseSent:
+	case <-stop:
+	}
 
 	// Shutdown the server gracefully
 	if err := server.Shutdown(context.Background()); err != nil {
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// The booking goes over one of the show's purchase limits
+type limitError struct {
+	Reason string
+}
+
+func (e *limitError) Error() string {
+	return e.Reason
+}
+
+// Checks the booking against the per order and per user limits of the show,
+// claimSeat checked them too but the user may have booked other seats since.
+// Takes the advisory lock claimSeat takes for the same user and show.
+func checkBookingLimits(tx *sqlx.Tx, showID int, userID int, seatReservationIDs []string) error {
+	var maxPerOrder, maxPerUser sql.NullInt64
+	err := tx.QueryRow(`SELECT Max_seats_per_order, Max_seats_per_user FROM Show WHERE ShowID = $1`, showID).Scan(&maxPerOrder, &maxPerUser)
+	if err != nil {
+		return fmt.Errorf("purchase limits query error: %v", err)
+	}
+
+	if maxPerOrder.Valid && len(seatReservationIDs) > int(maxPerOrder.Int64) {
+		return &limitError{Reason: fmt.Sprintf("at most %d seats per order for show %d", maxPerOrder.Int64, showID)}
+	}
+	if !maxPerUser.Valid {
+		return nil
+	}
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock($1, $2)`, showID, userID)
+	if err != nil {
+		return fmt.Errorf("purchase limits lock error: %v", err)
+	}
+
+	var booked int
+	err = tx.Get(&booked, `
+		SELECT COUNT(*)
+		FROM Reservation
+		WHERE ShowID = $1 AND Booked AND BookedbyID = $2 AND NOT (SeatReservationID = ANY($3))`,
+		showID, userID, pq.Array(seatReservationIDs))
+	if err != nil {
+		return fmt.Errorf("purchase limits count error: %v", err)
+	}
+
+	if booked+len(seatReservationIDs) > int(maxPerUser.Int64) {
+		return &limitError{Reason: fmt.Sprintf("at most %d seats per user for show %d, you already booked %d", maxPerUser.Int64, showID, booked)}
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	authmiddleware "bookSeat/auth"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,6 +15,15 @@ type Config struct {
 const pgConnectionString = "host=localhost port=5432 user=rayanc dbname=tickets sslmode=disable"
 
 func main() {
+	// Only requests carrying the orchestrator's service token skip the address rate limit
+	authmiddleware.LoadServiceSecret()
+
+	// Payment data is only trusted with a valid signature
+	loadWebhookSecret()
+
+	// Tickets are never issued with a key checkIn doesn't know
+	loadTicketSigningKey()
+
 	app := Config{}
 
 	log.Printf("Starting BookSeat service on port: %s", webPort)
@@ -25,12 +35,15 @@ func main() {
 	}
 
 	//DB connection check
-	_, err := ConnectToDB()
+	db, err := ConnectToDB()
 	if err != nil {
 		log.Fatalf("Error: DB connection %v", err)
 		return
 	}
 
+	// Tickets of shows moved to another hall are signed again for their new seats
+	go runTicketReissuer(db)
+
 	//Start the web server
 	err = srv.ListenAndServe()
 
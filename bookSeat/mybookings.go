@@ -0,0 +1,231 @@
+package main
+
+import (
+	authmiddleware "bookSeat/auth"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Page size of the bookings list when the client doesn't ask for one, and the most it can ask for
+const (
+	defaultBookingsLimit = 20
+	maxBookingsLimit     = 100
+)
+
+// Which bookings to list, by the start of their show
+const (
+	bookingsAll      = "all"
+	bookingsUpcoming = "upcoming"
+	bookingsPast     = "past"
+)
+
+// One order as the customer sees it
+type myBooking struct {
+	OrderID    int            `json:"order_id" db:"orderid"`
+	Reference  string         `json:"reference" db:"reference"`
+	Status     string         `json:"status" db:"status"`
+	SeatIDs    pq.StringArray `json:"seat_ids" db:"seat_ids"`
+	Total      int64          `json:"total" db:"total"`
+	Currency   *string        `json:"currency" db:"currency"`
+	BookedAt   time.Time      `json:"booked_at" db:"created_at"`
+	ShowID     int            `json:"show_id" db:"showid"`
+	ShowName   string         `json:"show_name" db:"showname"`
+	ShowStatus string         `json:"show_status" db:"show_status"`
+	Starttime  time.Time      `json:"show_start_time" db:"time_start"`
+	Endtime    time.Time      `json:"show_end_time" db:"time_end"`
+	VenueName  *string        `json:"venue_name" db:"venuename"`
+	HallID     int            `json:"hall_id" db:"hallid"`
+}
+
+const myBookingColumns = `o.OrderID, o.Reference, o.Status, o.Seat_ids, o.Total, o.Currency, o.Created_at,
+	sh.ShowID, sh.ShowName, sh.Status AS show_status, sh.Time_start, sh.Time_end, v.VenueName, sh.HallID`
+
+const myBookingFrom = `FROM Orders o
+	JOIN Show sh ON sh.ShowID = o.ShowID
+	LEFT JOIN Venue v ON v.VenueID = sh.VenueID`
+
+// Lists the user's bookings, newest show first, or soonest first for upcoming ones.
+// Query parameters: when (all, upcoming or past), limit and offset.
+func (app *Config) HandleMyBookings(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return
+	}
+
+	when := r.URL.Query().Get("when")
+	if when == "" {
+		when = bookingsAll
+	}
+	if when != bookingsAll && when != bookingsUpcoming && when != bookingsPast {
+		http.Error(w, fmt.Sprintf("Error: when must be %s, %s or %s", bookingsAll, bookingsUpcoming, bookingsPast), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := queryInt(r, "limit", defaultBookingsLimit)
+	if err != nil || limit < 1 || limit > maxBookingsLimit {
+		http.Error(w, fmt.Sprintf("Error: limit must be between 1 and %d", maxBookingsLimit), http.StatusBadRequest)
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "Error: offset can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	filter := `WHERE o.UserID = $1
+		AND ($2 = 'all' OR ($2 = 'upcoming' AND sh.Time_start >= NOW()) OR ($2 = 'past' AND sh.Time_start < NOW()))`
+
+	var total int
+	err = db.Get(&total, `SELECT COUNT(*) `+myBookingFrom+` `+filter, userID, when)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Bookings count failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	order := `ORDER BY sh.Time_start DESC, o.OrderID DESC`
+	if when == bookingsUpcoming {
+		order = `ORDER BY sh.Time_start ASC, o.OrderID ASC`
+	}
+
+	bookings := []myBooking{}
+	err = db.Select(&bookings, `SELECT `+myBookingColumns+` `+myBookingFrom+` `+filter+` `+order+` LIMIT $3 OFFSET $4`,
+		userID, when, limit, offset)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Bookings lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range bookings {
+		bookings[i].SeatIDs = seatIDsOf(bookings[i].ShowID, bookings[i].SeatIDs)
+	}
+
+	var nextOffset *int
+	if offset+len(bookings) < total {
+		next := offset + len(bookings)
+		nextOffset = &next
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"bookings":    bookings,
+		"total":       total,
+		"limit":       limit,
+		"offset":      offset,
+		"next_offset": nextOffset,
+	})
+}
+
+// One of the user's bookings with its receipt, by booking reference or order id
+func (app *Config) HandleMyBooking(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	booking, err := getMyBooking(db, userID, chi.URLParam(r, "id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Error: Booking not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Booking lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var receipt struct {
+		Subtotal   int64           `db:"subtotal" json:"subtotal"`
+		Discount   int64           `db:"discount" json:"discount"`
+		ServiceFee int64           `db:"service_fee" json:"service_fee"`
+		BookingFee int64           `db:"booking_fee" json:"booking_fee"`
+		Tax        int64           `db:"tax" json:"tax"`
+		Total      int64           `db:"total" json:"total"`
+		Lines      json.RawMessage `db:"lines" json:"lines"`
+	}
+	err = db.Get(&receipt, `
+		SELECT rc.Subtotal, rc.Discount, rc.Service_fee, rc.Booking_fee, rc.Tax, rc.Total, rc.Lines
+		FROM Receipt rc
+		JOIN Orders o ON o.Paymentconf_id = rc.Paymentconf_id
+		WHERE o.OrderID = $1`, booking.OrderID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Error: Receipt lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Bookings made before receipts existed have none
+	response := map[string]interface{}{
+		"booking": booking,
+		"receipt": nil,
+	}
+	if err == nil {
+		response["receipt"] = receipt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func getMyBooking(db *sqlx.DB, userID int, id string) (*myBooking, error) {
+	var booking myBooking
+	var err error
+
+	if reference, ok := parseBookingReference(id); ok {
+		err = db.Get(&booking, `SELECT `+myBookingColumns+` `+myBookingFrom+` WHERE o.UserID = $1 AND o.Reference = $2`,
+			userID, reference)
+	} else if orderID, convErr := strconv.Atoi(id); convErr == nil {
+		err = db.Get(&booking, `SELECT `+myBookingColumns+` `+myBookingFrom+` WHERE o.UserID = $1 AND o.OrderID = $2`,
+			userID, orderID)
+	} else {
+		return nil, sql.ErrNoRows
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	booking.SeatIDs = seatIDsOf(booking.ShowID, booking.SeatIDs)
+	return &booking, nil
+}
+
+// Orders keep SeatReservationIDs, customers know their seats by SeatID
+func seatIDsOf(showID int, seatReservationIDs []string) []string {
+	prefix := "SH_" + strconv.Itoa(showID) + "_ST_"
+
+	seatIDs := make([]string, len(seatReservationIDs))
+	for i, seatReservationID := range seatReservationIDs {
+		seatIDs[i] = strings.TrimPrefix(seatReservationID, prefix)
+	}
+
+	return seatIDs
+}
+
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	return strconv.Atoi(value)
+}
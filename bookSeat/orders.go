@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Statuses of an order
+const (
+	orderConfirmed = "confirmed"
+	orderCancelled = "cancelled" // the show was cancelled, the order is refunded
+)
+
+// Collisions are astronomically rare, a few attempts is plenty
+const maxReferenceAttempts = 5
+
+// Creates the order grouping the seats paid for together, with a fresh
+// reference. The unique constraint on Reference is the collision check.
+func createOrder(tx *sqlx.Tx, reservation ReservationRequest, showid int) (string, error) {
+	var total int64
+	var currency, promoCode *string
+	if reservation.Receipt != nil {
+		total = reservation.Receipt.Total
+		currency = &reservation.Receipt.Currency
+	}
+	if reservation.PromoCode != "" {
+		promoCode = &reservation.PromoCode
+	}
+
+	for attempt := 0; attempt < maxReferenceAttempts; attempt++ {
+		reference, err := generateBookingReference()
+		if err != nil {
+			return "", err
+		}
+
+		var orderID int
+		err = tx.QueryRow(`
+			INSERT INTO Orders (Reference, UserID, ShowID, Seat_ids, Total, Currency, Promo_code, Paymentconf_id, Status)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (Reference) DO NOTHING
+			RETURNING OrderID`,
+			reference, reservation.BookedbyID, showid, pq.Array(reservation.SeatReservationIDs), total, currency,
+			promoCode, reservation.Paymentconf_id, orderConfirmed).Scan(&orderID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("order insert error: %v", err)
+		}
+
+		return reference, nil
+	}
+
+	return "", fmt.Errorf("no unique booking reference after %d attempts", maxReferenceAttempts)
+}
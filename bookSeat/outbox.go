@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Seats were paid for, seats left goes down by Seats
+const eventSeatBooked = "seat_booked"
+
+type seatBookedEvent struct {
+	ShowID             int      `json:"show_id"`
+	UserID             int      `json:"user_id"`
+	SeatReservationIDs []string `json:"seatreservation_ids"`
+	Seats              int      `json:"seats"`
+	Paymentconf_id     int      `json:"paymentconf_id"`
+	BookingReference   string   `json:"booking_reference"`
+}
+
+// Adds the event to the Outbox in the caller's transaction, outboxRelay publishes it
+func writeOutboxEvent(tx *sqlx.Tx, eventType string, aggregateID int, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %v", eventType, err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO Outbox (Event_type, Aggregate_id, Payload) VALUES ($1, $2, $3)`,
+		eventType, aggregateID, data)
+	if err != nil {
+		return fmt.Errorf("outbox insert error: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Receipt built by checkPayment, every amount is in minor units of Currency
+type Receipt struct {
+	Currency   string        `json:"currency"`
+	Lines      []receiptLine `json:"lines"`
+	Subtotal   int64         `json:"subtotal"`
+	Discount   int64         `json:"discount"`
+	ServiceFee int64         `json:"service_fee"`
+	BookingFee int64         `json:"booking_fee"`
+	TaxRateBps int           `json:"tax_rate_bps"`
+	Tax        int64         `json:"tax"`
+	Total      int64         `json:"total"`
+}
+
+type receiptLine struct {
+	SeatID   string `json:"seat_id"`
+	Category string `json:"category"`
+	Price    int64  `json:"price"`
+}
+
+func saveReceipt(tx *sqlx.Tx, reservation ReservationRequest, showid int) error {
+	receipt := reservation.Receipt
+
+	lines, err := json.Marshal(receipt.Lines)
+	if err != nil {
+		return fmt.Errorf("error encoding receipt lines: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO Receipt (Paymentconf_id, UserID, ShowID, Currency, Subtotal, Discount, Service_fee, Booking_fee, Tax_rate_bps, Tax, Total, Lines)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		reservation.Paymentconf_id, reservation.BookedbyID, showid, receipt.Currency, receipt.Subtotal, receipt.Discount,
+		receipt.ServiceFee, receipt.BookingFee, receipt.TaxRateBps, receipt.Tax, receipt.Total, lines)
+	if err != nil {
+		return fmt.Errorf("error saving receipt: %v", err)
+	}
+
+	return nil
+}
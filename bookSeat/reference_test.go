@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReferenceCheckChar(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want byte
+	}{
+		{"7K3M9QX2BD4", 'M'},
+		{"0000000000Z", '1'},
+		{"ABCDEFGHJKM", 'Y'},
+		{"10AB0CDEF1Z", 'D'},
+		{"00000000000", '0'},
+	}
+
+	for _, tt := range tests {
+		if got := referenceCheckChar(tt.raw); got != tt.want {
+			t.Errorf("referenceCheckChar(%q) = %c, want %c", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseBookingReference(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		ok    bool
+	}{
+		{"formatted", "7K3M-9QX2-BD4M", "7K3M-9QX2-BD4M", true},
+		{"no dashes", "7K3M9QX2BD4M", "7K3M-9QX2-BD4M", true},
+		{"lower case and spaces", " 7k3m 9qx2 bd4m ", "7K3M-9QX2-BD4M", true},
+		{"O read as zero", "OOOO-OOOO-OOZ1", "0000-0000-00Z1", true},
+		{"I and L read as one", "I0AB-0CDE-FLZD", "10AB-0CDE-F1ZD", true},
+		{"wrong check character", "7K3M-9QX2-BD4N", "", false},
+		{"single character mistyped", "7K3M-9QX2-BD5M", "", false},
+		{"neighbours swapped", "K73M-9QX2-BD4M", "", false},
+		{"check character swapped", "7K3M-9QX2-BDM4", "", false},
+		{"U isn't in the alphabet", "7K3M-9QX2-BD4U", "", false},
+		{"too short", "7K3M-9QX2-BD4", "", false},
+		{"too long", "7K3M-9QX2-BD4MM", "", false},
+		{"empty", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseBookingReference(tt.input)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("parseBookingReference(%q) = %q, %v, want %q, %v", tt.input, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// Every single mistyped character is caught, wherever it is
+func TestReferenceCatchesSingleCharacterErrors(t *testing.T) {
+	raw := "7K3M9QX2BD4M"
+
+	for i := 0; i < len(raw); i++ {
+		for j := 0; j < len(referenceAlphabet); j++ {
+			if referenceAlphabet[j] == raw[i] {
+				continue
+			}
+			typo := raw[:i] + string(referenceAlphabet[j]) + raw[i+1:]
+			if _, ok := parseBookingReference(typo); ok {
+				t.Errorf("%s accepted for %s", typo, raw)
+			}
+		}
+	}
+}
+
+// Swapping two neighbours is caught for every pair but 0 and Z, whose
+// doubled values give the same sum
+func TestReferenceCatchesTranspositions(t *testing.T) {
+	for _, a := range referenceAlphabet {
+		for _, b := range referenceAlphabet {
+			if a == b {
+				continue
+			}
+			pair := string(a) + string(b)
+			undetectable := pair == "0Z" || pair == "Z0"
+
+			for i := 0; i < referenceRandomLength-1; i++ {
+				random := "7K3M9QX2BD4"
+				random = random[:i] + pair + random[i+2:]
+				valid := random + string(referenceCheckChar(random))
+				swapped := valid[:i] + string(b) + string(a) + valid[i+2:]
+
+				_, ok := parseBookingReference(swapped)
+				if ok != undetectable {
+					t.Errorf("swap of %s at %d in %s: accepted = %v, want %v", pair, i, valid, ok, undetectable)
+				}
+			}
+		}
+	}
+}
+
+func TestGenerateBookingReference(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		reference, err := generateBookingReference()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(reference, "-") != 2 {
+			t.Errorf("%s isn't formatted as XXXX-XXXX-XXXX", reference)
+		}
+		if got, ok := parseBookingReference(reference); !ok || got != reference {
+			t.Errorf("generated %s parses as %q, %v", reference, got, ok)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+// Stream outboxRelay publishes the Outbox events to
+const eventStream = "ticket_events"
+
+// Shows writes it when a show moves hall, its tickets now name other seats
+const eventShowUpdated = "show_updated"
+
+const reissueGroup = "ticket_reissue"
+
+// How often events that failed are tried again
+const reissueRetry = 30 * time.Second
+
+// Signs the tickets of shows that moved hall again, for their new seat. The
+// door turns down a token naming a seat the ticket no longer has.
+func runTicketReissuer(db *sqlx.DB) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	defer rdb.Close()
+
+	// Context for the Redis operations.
+	ctx := context.Background()
+
+	err := rdb.XGroupCreateMkStream(ctx, eventStream, reissueGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Printf("Error: ticket reissue group: %v", err)
+		return
+	}
+
+	// Entries not acknowledged yet are read first, and again every reissueRetry
+	lastID := "0"
+	lastRetry := time.Now()
+	for {
+		if lastID == ">" && time.Since(lastRetry) >= reissueRetry {
+			lastID = "0"
+			lastRetry = time.Now()
+		}
+
+		streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    reissueGroup,
+			Consumer: "bookseat",
+			Streams:  []string{eventStream, lastID},
+			Count:    100,
+			Block:    5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error: ticket reissue read: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		messages := streams[0].Messages
+		if lastID != ">" && len(messages) == 0 {
+			lastID = ">"
+			continue
+		}
+
+		for _, message := range messages {
+			if lastID != ">" {
+				lastID = message.ID
+			}
+
+			err = reissueForEvent(db, message)
+			if err != nil {
+				log.Printf("Error: reissuing tickets for %s: %v", message.ID, err)
+				continue
+			}
+
+			err = rdb.XAck(ctx, eventStream, reissueGroup, message.ID).Err()
+			if err != nil {
+				log.Printf("Error: acknowledging %s: %v", message.ID, err)
+			}
+		}
+	}
+}
+
+func reissueForEvent(db *sqlx.DB, message redis.XMessage) error {
+	eventType, _ := message.Values["event_type"].(string)
+	if eventType != eventShowUpdated {
+		return nil
+	}
+
+	payload, _ := message.Values["payload"].(string)
+	var event struct {
+		ShowID int `json:"show_id"`
+	}
+	err := json.Unmarshal([]byte(payload), &event)
+	if err != nil {
+		return fmt.Errorf("malformed payload: %v", err)
+	}
+
+	return reissueMovedTickets(db, event.ShowID)
+}
+
+// Signs again the valid tickets of the show whose token names another seat than
+// the one the ticket has. Tickets already signed for their seat are left alone,
+// so the same event can be handled twice.
+func reissueMovedTickets(db *sqlx.DB, showID int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error creating DB transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	var tickets []struct {
+		TicketID          string `db:"ticketid"`
+		SeatReservationID string `db:"seatreservationid"`
+		Token             string `db:"token"`
+	}
+	err = tx.Select(&tickets, `
+		SELECT TicketID, SeatReservationID, Token
+		FROM Ticket
+		WHERE ShowID = $1 AND Status = $2
+		FOR UPDATE`, showID, ticketValid)
+	if err != nil {
+		return fmt.Errorf("tickets lookup error: %v", err)
+	}
+
+	reissued := 0
+	for _, ticket := range tickets {
+		claims, err := readTicketClaims(ticket.Token)
+		if err != nil {
+			return fmt.Errorf("ticket %s: %v", ticket.TicketID, err)
+		}
+
+		seatID := strings.TrimPrefix(ticket.SeatReservationID, fmt.Sprintf("SH_%d_ST_", showID))
+		if claims.SeatID == seatID {
+			continue
+		}
+
+		claims.SeatID = seatID
+		claims.IssuedAt = time.Now().Unix()
+		token, err := signTicket(*claims)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE Ticket SET Token = $1, Issued_at = NOW() WHERE TicketID = $2`, token, ticket.TicketID)
+		if err != nil {
+			return fmt.Errorf("ticket reissue error: %v", err)
+		}
+		reissued++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing reissued tickets: %v", err)
+	}
+
+	if reissued > 0 {
+		log.Printf("Reissued %d tickets of show %d for their new seats", reissued, showID)
+	}
+
+	return nil
+}
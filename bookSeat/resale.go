@@ -0,0 +1,420 @@
+package main
+
+import (
+	authmiddleware "bookSeat/auth"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Statuses of a resale listing, only an active one can be bought
+const (
+	listingActive    = "active"
+	listingSold      = "sold"
+	listingWithdrawn = "withdrawn" // by the seller
+	listingCancelled = "cancelled" // the show was cancelled
+)
+
+// Used for venues that don't set their own currency
+const defaultCurrency = "USD"
+
+// A payout is held until the show has taken place, so a cancelled show
+// never has to claw money back from sellers
+const payoutPending = "pending"
+
+const eventSeatResold = "seat_resold"
+
+type seatResoldEvent struct {
+	ShowID             int      `json:"show_id"`
+	BuyerID            int      `json:"buyer_id"`
+	SeatReservationIDs []string `json:"seatreservation_ids"`
+	ListingIDs         []int    `json:"listing_ids"`
+	Paymentconf_id     int      `json:"paymentconf_id"`
+	BookingReference   string   `json:"booking_reference"`
+}
+
+type ResaleForm struct {
+	Price int64 `json:"price"` // minor units of the venue currency
+}
+
+type resaleListing struct {
+	ListingID int        `json:"listing_id" db:"listingid"`
+	TicketID  string     `json:"ticket_id,omitempty" db:"ticketid"`
+	ShowID    int        `json:"show_id" db:"showid"`
+	ShowName  string     `json:"show_name" db:"showname"`
+	Starttime time.Time  `json:"show_start_time" db:"time_start"`
+	SeatID    string     `json:"seat_id" db:"seatid"`
+	Category  *string    `json:"category" db:"category"`
+	Price     int64      `json:"price" db:"price"`
+	Currency  string     `json:"currency" db:"currency"`
+	FaceValue int64      `json:"face_value" db:"face_value"`
+	Status    string     `json:"status" db:"status"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	SoldAt    *time.Time `json:"sold_at,omitempty" db:"sold_at"`
+	PayoutNet *int64     `json:"payout_net,omitempty" db:"payout_net"`
+	PayoutFee *int64     `json:"payout_fee,omitempty" db:"payout_fee"`
+	Payout    *string    `json:"payout_status,omitempty" db:"payout_status"`
+}
+
+const resaleListingQuery = `
+	SELECT l.ListingID, l.TicketID, l.ShowID, sh.ShowName, sh.Time_start, l.SeatReservationID AS seatid, s.Category,
+		l.Price, l.Currency, l.Face_value, l.Status, l.Created_at, l.Sold_at,
+		p.Net AS payout_net, p.Fee AS payout_fee, p.Status AS payout_status
+	FROM ResaleListing l
+	JOIN Show sh ON sh.ShowID = l.ShowID
+	LEFT JOIN Seat s ON l.SeatReservationID = 'SH_' || l.ShowID || '_ST_' || s.SeatID
+	LEFT JOIN Payout p ON p.ListingID = l.ListingID`
+
+// Puts one of the user's tickets up for resale, buyers claim and pay for the
+// seat the usual way and the ticket is reissued to them when they book it
+func (app *Config) HandleListForResale(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return
+	}
+
+	var resaleform ResaleForm
+	err := json.NewDecoder(r.Body).Decode(&resaleform)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse resale form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if resaleform.Price <= 0 {
+		http.Error(w, "Error: Resale price must be positive", http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	listingID, err := createListing(db, userID, chi.URLParam(r, "ticketID"), resaleform.Price)
+	var rejected *transferError
+	if errors.As(err, &rejected) {
+		http.Error(w, fmt.Sprintf("Error: %v", rejected), rejected.Status)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Listing failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Ticket %s listed for resale by user %d at %d", chi.URLParam(r, "ticketID"), userID, resaleform.Price)
+
+	writeListing(w, db, listingID, http.StatusCreated)
+}
+
+// The user's listings with what they were paid out for the sold ones
+func (app *Config) HandleMyListings(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	listings := []resaleListing{}
+	err = db.Select(&listings, resaleListingQuery+` WHERE l.SellerID = $1 ORDER BY l.Created_at DESC LIMIT 100`, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Listings lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range listings {
+		listings[i].SeatID = seatIDsOf(listings[i].ShowID, []string{listings[i].SeatID})[0]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"listings": listings,
+	})
+}
+
+// Takes an unsold listing off the market, a buyer already paying for it gets their payment voided
+func (app *Config) HandleWithdrawListing(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return
+	}
+
+	listingID, err := strconv.Atoi(chi.URLParam(r, "listingID"))
+	if err != nil {
+		http.Error(w, "Error: Listing not found", http.StatusNotFound)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var status string
+	err = db.Get(&status, `SELECT Status FROM ResaleListing WHERE ListingID = $1 AND SellerID = $2`, listingID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Error: Listing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Listing lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec(`UPDATE ResaleListing SET Status = $1 WHERE ListingID = $2 AND SellerID = $3 AND Status = $4`,
+		listingWithdrawn, listingID, userID, listingActive)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Withdraw failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if withdrawn, _ := result.RowsAffected(); withdrawn == 0 {
+		http.Error(w, fmt.Sprintf("Error: Listing is %s", status), http.StatusConflict)
+		return
+	}
+
+	writeListing(w, db, listingID, http.StatusOK)
+}
+
+// Seats of a show on resale, cheapest first, sellers stay anonymous
+func (app *Config) HandleResaleListings(w http.ResponseWriter, r *http.Request) {
+	showID, err := queryInt(r, "show_id", 0)
+	if err != nil || showID <= 0 {
+		http.Error(w, "Error: show_id is required", http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	listings := []resaleListing{}
+	err = db.Select(&listings, resaleListingQuery+` WHERE l.ShowID = $1 AND l.Status = $2 ORDER BY l.Price, l.ListingID`,
+		showID, listingActive)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Listings lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range listings {
+		listings[i].SeatID = seatIDsOf(listings[i].ShowID, []string{listings[i].SeatID})[0]
+		listings[i].TicketID = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"show_id":  showID,
+		"listings": listings,
+	})
+}
+
+func createListing(db *sqlx.DB, userID int, ticketID string, price int64) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	ticket, err := lockTicket(tx, ticketID)
+	if err == sql.ErrNoRows || (err == nil && ticket.HolderID != userID) {
+		return 0, &transferError{http.StatusNotFound, "ticket not found"}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	switch ticket.Status {
+	case ticketVoid:
+		return 0, &transferError{http.StatusGone, "ticket is void, the booking was cancelled"}
+	case ticketUsed:
+		return 0, &transferError{http.StatusConflict, "ticket has already been used"}
+	case ticketTransferred:
+		return 0, &transferError{http.StatusGone, "ticket was transferred to someone else"}
+	}
+	if ticket.FaceValue == nil {
+		return 0, &transferError{http.StatusConflict, "ticket has no face value to cap the resale price with"}
+	}
+
+	var policy struct {
+		Status   string    `db:"status"`
+		Start    time.Time `db:"time_start"`
+		Allowed  bool      `db:"resale_allowed"`
+		CapPct   int       `db:"resale_price_cap_pct"`
+		Currency string    `db:"currency"`
+	}
+	err = tx.Get(&policy, `
+		SELECT sh.Status, sh.Time_start, COALESCE(sh.Resale_allowed, FALSE) AS resale_allowed,
+			COALESCE(sh.Resale_price_cap_pct, 100) AS resale_price_cap_pct, COALESCE(v.Currency, $2) AS currency
+		FROM Show sh
+		LEFT JOIN Venue v ON v.VenueID = sh.VenueID
+		WHERE sh.ShowID = $1`, ticket.ShowID, defaultCurrency)
+	if err != nil {
+		return 0, fmt.Errorf("show resale policy query error: %v", err)
+	}
+
+	priceCap := *ticket.FaceValue * int64(policy.CapPct) / 100
+	switch {
+	case policy.Status == "cancelled":
+		return 0, &transferError{http.StatusGone, "show is cancelled"}
+	case !policy.Allowed:
+		return 0, &transferError{http.StatusForbidden, "tickets for this show can't be resold"}
+	case !time.Now().Before(policy.Start):
+		return 0, &transferError{http.StatusForbidden, "show has already started"}
+	case price > priceCap:
+		return 0, &transferError{http.StatusUnprocessableEntity, fmt.Sprintf("price can't be more than %d, %d%% of the face value", priceCap, policy.CapPct)}
+	}
+
+	listed, err := hasActiveListing(tx, ticketID)
+	if err != nil {
+		return 0, err
+	}
+	if listed {
+		return 0, &transferError{http.StatusConflict, "ticket is already listed"}
+	}
+
+	var pending int
+	err = tx.Get(&pending, `SELECT COUNT(*) FROM TicketTransfer WHERE TicketID = $1 AND Status = $2 AND Expires_at > NOW()`,
+		ticketID, transferPending)
+	if err != nil {
+		return 0, fmt.Errorf("pending transfer query error: %v", err)
+	}
+	if pending > 0 {
+		return 0, &transferError{http.StatusConflict, "ticket has a pending transfer, cancel it first"}
+	}
+
+	var listingID int
+	err = tx.Get(&listingID, `
+		INSERT INTO ResaleListing (TicketID, ShowID, SeatReservationID, SellerID, Price, Currency, Face_value, Status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING ListingID`,
+		ticketID, ticket.ShowID, ticket.SeatReservationID, userID, price, policy.Currency, *ticket.FaceValue, listingActive)
+	if err != nil {
+		return 0, fmt.Errorf("listing insert error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit listing: %v", err)
+	}
+
+	return listingID, nil
+}
+
+func hasActiveListing(tx *sqlx.Tx, ticketID string) (bool, error) {
+	var listed bool
+	err := tx.Get(&listed, `SELECT EXISTS (SELECT 1 FROM ResaleListing WHERE TicketID = $1 AND Status = $2)`,
+		ticketID, listingActive)
+	if err != nil {
+		return false, fmt.Errorf("listing query error: %v", err)
+	}
+
+	return listed, nil
+}
+
+type lockedListing struct {
+	ListingID         int    `db:"listingid"`
+	TicketID          string `db:"ticketid"`
+	SeatReservationID string `db:"seatreservationid"`
+	SellerID          int    `db:"sellerid"`
+	Price             int64  `db:"price"`
+	Currency          string `db:"currency"`
+	FeeBps            int    `db:"resale_fee_bps"`
+}
+
+// Active listings of the seats, locked so the seller can't withdraw them mid booking
+func lockActiveListings(tx *sqlx.Tx, seatReservationIDs []string) ([]lockedListing, error) {
+	var listings []lockedListing
+	err := tx.Select(&listings, `
+		SELECT l.ListingID, l.TicketID, l.SeatReservationID, l.SellerID, l.Price, l.Currency,
+			COALESCE(sh.Resale_fee_bps, 0) AS resale_fee_bps
+		FROM ResaleListing l
+		JOIN Show sh ON sh.ShowID = l.ShowID
+		WHERE l.SeatReservationID = ANY($1) AND l.Status = $2
+		FOR UPDATE OF l`, pq.Array(seatReservationIDs), listingActive)
+	if err != nil {
+		return nil, fmt.Errorf("listing query error: %v", err)
+	}
+
+	return listings, nil
+}
+
+// Completes the resale of every listing in the booking: the seller's ticket is
+// reissued under the buyer's order and the seller is owed the price minus the fee
+func sellListings(tx *sqlx.Tx, listings []lockedListing, buyerID int, reference string, paymentconfID int) error {
+	for _, listing := range listings {
+		if listing.SellerID == buyerID {
+			return fmt.Errorf("can't buy your own listing %d", listing.ListingID)
+		}
+
+		ticket, err := lockTicket(tx, listing.TicketID)
+		if err != nil {
+			return err
+		}
+		if ticket.Status != ticketValid || ticket.HolderID != listing.SellerID {
+			return fmt.Errorf("ticket of listing %d is no longer the seller's to sell", listing.ListingID)
+		}
+
+		// The seat leaves the order it was first bought in
+		_, err = tx.Exec(`UPDATE Orders SET Seat_ids = array_remove(Seat_ids, $1), Updated_at = NOW() WHERE Reference = $2`,
+			ticket.SeatReservationID, ticket.Reference)
+		if err != nil {
+			return fmt.Errorf("seller order update error: %v", err)
+		}
+
+		_, err = reissueTicket(tx, ticket, buyerID, reference)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE ResaleListing SET Status = $1, BuyerID = $2, Order_reference = $3, Sold_at = NOW() WHERE ListingID = $4`,
+			listingSold, buyerID, reference, listing.ListingID)
+		if err != nil {
+			return fmt.Errorf("listing update error: %v", err)
+		}
+
+		// Fee rounded half up, in the seller's disfavour by at most one minor unit
+		fee := (listing.Price*int64(listing.FeeBps) + 5000) / 10000
+		_, err = tx.Exec(`
+			INSERT INTO Payout (ListingID, SellerID, Paymentconf_id, Gross, Fee, Net, Currency, Status)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			listing.ListingID, listing.SellerID, paymentconfID, listing.Price, fee, listing.Price-fee, listing.Currency, payoutPending)
+		if err != nil {
+			return fmt.Errorf("payout insert error: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func writeListing(w http.ResponseWriter, db *sqlx.DB, listingID int, status int) {
+	var listing resaleListing
+	err := db.Get(&listing, resaleListingQuery+` WHERE l.ListingID = $1`, listingID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Listing lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	listing.SeatID = seatIDsOf(listing.ShowID, []string{listing.SeatID})[0]
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(listing)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	authmiddleware "bookSeat/auth"
 	"net/http"
+	"ratelimit"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -26,11 +27,37 @@ func (app *Config) routes() http.Handler {
 	//To check if service up or not
 	mux.Use(middleware.Heartbeat("/ping"))
 
+	//Rate limits, per address before the token is even looked at, then per user
+	mux.Use(ratelimit.Middleware("bookseat_ip", ratelimit.PerMinute(600), ratelimit.Unless(authmiddleware.FromService, ratelimit.ByIP)))
+
 	// Add JWT middleware
 	mux.Use(authmiddleware.JWTMiddleware)
 
+	mux.Use(ratelimit.Middleware("bookseat_user", ratelimit.PerMinute(120), ratelimit.ByUser(authmiddleware.UserID)))
+
 	//Add route at root level
-	mux.Post("/bookSeat", app.HandleBookSeat)
+	mux.With(ratelimit.Middleware("bookseat_book", ratelimit.PerMinute(10), ratelimit.ByUser(authmiddleware.UserID))).Post("/bookSeat", app.HandleBookSeat)
+
+	//Customer's own bookings
+	mux.Get("/me/bookings", app.HandleMyBookings)
+	mux.Get("/me/bookings/{id}", app.HandleMyBooking)
+	mux.Get("/me/bookings/{id}/tickets", app.HandleMyTickets)
+	mux.Get("/me/tickets", app.HandleHeldTickets)
+	mux.Get("/me/tickets/{ticketID}/qr.png", app.HandleTicketQR)
+	mux.Get("/me/tickets/{ticketID}/ticket.pdf", app.HandleTicketPDF)
+
+	//Ticket transfers between customers
+	mux.Post("/me/tickets/{ticketID}/transfer", app.HandleTransferTicket)
+	mux.Get("/me/transfers", app.HandleMyTransfers)
+	mux.Post("/me/transfers/{transferID}/accept", app.HandleAcceptTransfer)
+	mux.Post("/me/transfers/{transferID}/decline", app.HandleDeclineTransfer)
+	mux.Post("/me/transfers/{transferID}/cancel", app.HandleCancelTransfer)
+
+	//Resale between customers, bought through claimSeat and checkPayment like any seat
+	mux.Get("/resale", app.HandleResaleListings)
+	mux.Post("/me/tickets/{ticketID}/resale", app.HandleListForResale)
+	mux.Get("/me/listings", app.HandleMyListings)
+	mux.Post("/me/listings/{listingID}/withdraw", app.HandleWithdrawListing)
 
 	return mux
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	authmiddleware "bookSeat/auth"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-pdf/fpdf"
+	"github.com/jmoiron/sqlx"
+	"github.com/skip2/go-qrcode"
+)
+
+// Size in pixels of the QR code PNG, large enough to scan from a phone screen
+const qrSize = 512
+
+type myTicket struct {
+	TicketID  string    `json:"ticket_id" db:"ticketid"`
+	Reference string    `json:"reference" db:"order_reference"`
+	SeatID    string    `json:"seat_id" db:"seatid"`
+	Status    string    `json:"status" db:"status"`
+	Token     string    `json:"token" db:"token"`
+	IssuedAt  time.Time `json:"issued_at" db:"issued_at"`
+	ShowID    int       `json:"show_id" db:"showid"`
+	ShowName  string    `json:"show_name" db:"showname"`
+	Starttime time.Time `json:"show_start_time" db:"time_start"`
+	VenueName *string   `json:"venue_name" db:"venuename"`
+	HallID    int       `json:"hall_id" db:"hallid"`
+	QRCodeURL string    `json:"qr_code_url" db:"-"`
+	PDFURL    string    `json:"pdf_url" db:"-"`
+}
+
+const myTicketQuery = `
+	SELECT t.TicketID, t.Order_reference, t.SeatReservationID AS seatid, t.Status, t.Token, t.Issued_at,
+		sh.ShowID, sh.ShowName, sh.Time_start, v.VenueName, sh.HallID
+	FROM Ticket t
+	JOIN Show sh ON sh.ShowID = t.ShowID
+	LEFT JOIN Venue v ON v.VenueID = sh.VenueID`
+
+// Fills in what isn't stored. Tickets moved to another hall are signed again
+// for their new seat when Shows publishes the move, see runTicketReissuer.
+func (t *myTicket) complete() {
+	t.SeatID = strings.TrimPrefix(t.SeatID, fmt.Sprintf("SH_%d_ST_", t.ShowID))
+	t.QRCodeURL = "/me/tickets/" + t.TicketID + "/qr.png"
+	t.PDFURL = "/me/tickets/" + t.TicketID + "/ticket.pdf"
+}
+
+// Tickets of one of the user's bookings, by booking reference or order id
+func (app *Config) HandleMyTickets(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	booking, err := getMyBooking(db, userID, chi.URLParam(r, "id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Error: Booking not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Booking lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	tickets := []myTicket{}
+	err = db.Select(&tickets, myTicketQuery+` WHERE t.HolderID = $1 AND t.Order_reference = $2 AND t.Status <> $3
+		ORDER BY t.SeatReservationID`,
+		userID, booking.Reference, ticketTransferred)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Tickets lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range tickets {
+		tickets[i].complete()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reference": booking.Reference,
+		"tickets":   tickets,
+	})
+}
+
+// Every ticket the user holds, bought or received from someone else, soonest show first
+func (app *Config) HandleHeldTickets(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	tickets := []myTicket{}
+	err = db.Select(&tickets, myTicketQuery+` WHERE t.HolderID = $1 AND t.Status = $2 AND sh.Time_end >= NOW()
+		ORDER BY sh.Time_start, t.SeatReservationID`,
+		userID, ticketValid)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Tickets lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range tickets {
+		tickets[i].complete()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tickets": tickets,
+	})
+}
+
+// The ticket token as a QR code, what the door scans
+func (app *Config) HandleTicketQR(w http.ResponseWriter, r *http.Request) {
+	ticket, ok := getRequestedTicket(w, r)
+	if !ok {
+		return
+	}
+
+	png, err := qrcode.Encode(ticket.Token, qrcode.Medium, qrSize)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: QR code generation failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusOK)
+	w.Write(png)
+}
+
+// Printable ticket: show details, seat and the QR code
+func (app *Config) HandleTicketPDF(w http.ResponseWriter, r *http.Request) {
+	ticket, ok := getRequestedTicket(w, r)
+	if !ok {
+		return
+	}
+
+	pdf, err := renderTicketPDF(ticket)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: PDF generation failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="ticket-%s-%s.pdf"`, ticket.Reference, ticket.SeatID))
+	w.WriteHeader(http.StatusOK)
+	w.Write(pdf)
+}
+
+// Looks up the ticket in the URL among the user's, answering the request itself when it can't
+func getRequestedTicket(w http.ResponseWriter, r *http.Request) (*myTicket, bool) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	ticket, err := getMyTicket(db, userID, chi.URLParam(r, "ticketID"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Error: Ticket not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Ticket lookup failed: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if ticket.Status == ticketVoid {
+		http.Error(w, "Error: Ticket is void, the booking was cancelled", http.StatusGone)
+		return nil, false
+	}
+	if ticket.Status == ticketTransferred {
+		http.Error(w, "Error: Ticket was transferred to someone else", http.StatusGone)
+		return nil, false
+	}
+
+	return ticket, true
+}
+
+func getMyTicket(db *sqlx.DB, userID int, ticketID string) (*myTicket, error) {
+	var ticket myTicket
+	err := db.Get(&ticket, myTicketQuery+` WHERE t.HolderID = $1 AND t.TicketID = $2`, userID, ticketID)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket.complete()
+
+	return &ticket, nil
+}
+
+func renderTicketPDF(ticket *myTicket) ([]byte, error) {
+	png, err := qrcode.Encode(ticket.Token, qrcode.Medium, qrSize)
+	if err != nil {
+		return nil, fmt.Errorf("QR code generation failed: %v", err)
+	}
+
+	venue := "Venue to be announced"
+	if ticket.VenueName != nil {
+		venue = *ticket.VenueName
+	}
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle(fmt.Sprintf("Ticket %s seat %s", ticket.Reference, ticket.SeatID), true)
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 22)
+	pdf.CellFormat(0, 12, pdf.UnicodeTranslatorFromDescriptor("")(ticket.ShowName), "", 1, "L", false, 0, "")
+
+	pdf.SetFont("Helvetica", "", 13)
+	for _, line := range []string{
+		ticket.Starttime.Format("Monday 2 January 2006, 15:04"),
+		fmt.Sprintf("%s, hall %d", venue, ticket.HallID),
+		fmt.Sprintf("Seat %s", ticket.SeatID),
+		fmt.Sprintf("Booking reference %s", ticket.Reference),
+	} {
+		pdf.CellFormat(0, 8, pdf.UnicodeTranslatorFromDescriptor("")(line), "", 1, "L", false, 0, "")
+	}
+
+	pdf.RegisterImageOptionsReader("qr", fpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(png))
+	pdf.ImageOptions("qr", 55, 75, 100, 100, false, fpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+
+	pdf.SetY(180)
+	pdf.SetFont("Helvetica", "", 9)
+	pdf.CellFormat(0, 6, "Ticket "+ticket.TicketID+", show this code at the entrance. Each code lets one person in once.", "", 1, "C", false, 0, "")
+
+	var out bytes.Buffer
+	if err := pdf.Output(&out); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
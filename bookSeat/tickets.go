@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Statuses of a ticket, checkIn marks it used at the door
+const (
+	ticketValid = "valid"
+	ticketUsed  = "used"
+	ticketVoid  = "void" // the order was cancelled
+	// Given to someone else, who holds a newly issued ticket for the seat
+	ticketTransferred = "transferred"
+)
+
+// What a ticket token vouches for, the door only needs the token to check it
+type ticketClaims struct {
+	Version   int    `json:"v"`
+	TicketID  string `json:"tid"`
+	ShowID    int    `json:"show"`
+	SeatID    string `json:"seat"`
+	Reference string `json:"ref"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+// Signs every ticket, read at startup
+var ticketKey ed25519.PrivateKey
+
+// Signing key from TICKET_SIGNING_KEY, the base64 of a 32 byte ed25519 seed.
+// checkIn only needs the public half.
+func loadTicketSigningKey() {
+	seed, err := base64.StdEncoding.DecodeString(os.Getenv("TICKET_SIGNING_KEY"))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		log.Fatal("Error: TICKET_SIGNING_KEY is missing or isn't a base64 ed25519 seed")
+	}
+	ticketKey = ed25519.NewKeyFromSeed(seed)
+	log.Printf("Ticket public key: %s", base64.StdEncoding.EncodeToString(ticketKey.Public().(ed25519.PublicKey)))
+}
+
+// Token is base64url(claims json) "." base64url(ed25519 signature of the first part)
+func signTicket(claims ticketClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode ticket: %v", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(ticketKey, []byte(encoded))
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func newTicketID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate ticket id: %v", err)
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// One signed ticket per booked seat of the order, in the booking transaction
+func issueTickets(tx *sqlx.Tx, reference string, showid int, holderID int, seatReservationIDs []string) error {
+	for _, seatReservationID := range seatReservationIDs {
+		_, err := insertTicket(tx, reference, showid, seatReservationID, holderID, 0, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Signs a new ticket for the seat and stores it, transferCount is how many
+// times the seat's ticket changed hands before this one. Without a face value
+// the ticket is worth the price the seat was claimed at.
+func insertTicket(tx *sqlx.Tx, reference string, showid int, seatReservationID string, holderID int, transferCount int, faceValue *int64) (string, error) {
+	ticketID, err := newTicketID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	token, err := signTicket(ticketClaims{
+		Version:   1,
+		TicketID:  ticketID,
+		ShowID:    showid,
+		SeatID:    strings.TrimPrefix(seatReservationID, fmt.Sprintf("SH_%d_ST_", showid)),
+		Reference: reference,
+		IssuedAt:  now.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO Ticket (TicketID, Order_reference, ShowID, SeatReservationID, HolderID, Token, Status, Transfer_count, Issued_at, Face_value)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9,
+			COALESCE($10, (SELECT Claimed_price FROM Reservation WHERE SeatReservationID = $4)))`,
+		ticketID, reference, showid, seatReservationID, holderID, token, ticketValid, transferCount, now, faceValue)
+	if err != nil {
+		return "", fmt.Errorf("ticket insert error: %v", err)
+	}
+
+	return ticketID, nil
+}
+
+// Claims of one of our own tokens, without checking the signature
+func readTicketClaims(token string) (*ticketClaims, error) {
+	payload, _, found := strings.Cut(token, ".")
+	if !found {
+		return nil, fmt.Errorf("malformed ticket token")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ticket token: %v", err)
+	}
+
+	var claims ticketClaims
+	err = json.Unmarshal(data, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ticket token: %v", err)
+	}
+
+	return &claims, nil
+}
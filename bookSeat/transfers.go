@@ -0,0 +1,482 @@
+package main
+
+import (
+	authmiddleware "bookSeat/auth"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// Statuses of a ticket transfer, only a pending one can be answered
+const (
+	transferPending   = "pending"
+	transferAccepted  = "accepted"
+	transferDeclined  = "declined"  // by the recipient
+	transferCancelled = "cancelled" // by the sender
+	transferExpired   = "expired"
+)
+
+// How long the recipient has to accept, less when the show's transfer cutoff comes first
+const transferTTL = 48 * time.Hour
+
+// Why a transfer or resale can't go ahead, Status is the HTTP status to answer with
+type transferError struct {
+	Status int
+	Reason string
+}
+
+func (e *transferError) Error() string {
+	return e.Reason
+}
+
+type TransferForm struct {
+	To string `json:"to"` // username or email of the recipient
+}
+
+type ticketTransfer struct {
+	TransferID  int        `json:"transfer_id" db:"transferid"`
+	TicketID    string     `json:"ticket_id" db:"ticketid"`
+	NewTicketID *string    `json:"new_ticket_id,omitempty" db:"new_ticketid"`
+	ShowID      int        `json:"show_id" db:"showid"`
+	ShowName    string     `json:"show_name" db:"showname"`
+	Starttime   time.Time  `json:"show_start_time" db:"time_start"`
+	SeatID      string     `json:"seat_id" db:"seatid"`
+	FromID      int        `json:"from_user_id" db:"fromid"`
+	FromName    *string    `json:"from_username" db:"from_username"`
+	ToID        int        `json:"to_user_id" db:"toid"`
+	ToName      *string    `json:"to_username" db:"to_username"`
+	Status      string     `json:"status" db:"status"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at" db:"expires_at"`
+	RespondedAt *time.Time `json:"responded_at" db:"responded_at"`
+}
+
+// Pending transfers past their expiry read as expired, they are only marked so when touched
+const ticketTransferQuery = `
+	SELECT tt.TransferID, tt.TicketID, tt.New_ticketID, tt.ShowID, sh.ShowName, sh.Time_start,
+		t.SeatReservationID AS seatid, tt.FromID, uf.username AS from_username, tt.ToID, ut.username AS to_username,
+		CASE WHEN tt.Status = 'pending' AND tt.Expires_at <= NOW() THEN 'expired' ELSE tt.Status END AS status,
+		tt.Created_at, tt.Expires_at, tt.Responded_at
+	FROM TicketTransfer tt
+	JOIN Ticket t ON t.TicketID = tt.TicketID
+	JOIN Show sh ON sh.ShowID = tt.ShowID
+	LEFT JOIN Users uf ON uf.UserID = tt.FromID
+	LEFT JOIN Users ut ON ut.UserID = tt.ToID`
+
+// Offers one of the user's tickets to another user, who has to accept it
+func (app *Config) HandleTransferTicket(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return
+	}
+
+	var transferform TransferForm
+	err := json.NewDecoder(r.Body).Decode(&transferform)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse transfer form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(transferform.To) == "" {
+		http.Error(w, "Error: Transfer needs the username or email of the recipient", http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	transferID, err := createTransfer(db, userID, chi.URLParam(r, "ticketID"), transferform.To)
+	var rejected *transferError
+	if errors.As(err, &rejected) {
+		http.Error(w, fmt.Sprintf("Error: %v", rejected), rejected.Status)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Transfer failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeTransfer(w, db, transferID, http.StatusCreated)
+}
+
+// Transfers sent and received by the user, newest first
+func (app *Config) HandleMyTransfers(w http.ResponseWriter, r *http.Request) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	transfers := []ticketTransfer{}
+	err = db.Select(&transfers, ticketTransferQuery+` WHERE tt.FromID = $1 OR tt.ToID = $1
+		ORDER BY tt.Created_at DESC LIMIT 100`, userID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Transfers lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for i := range transfers {
+		transfers[i].SeatID = seatIDsOf(transfers[i].ShowID, []string{transfers[i].SeatID})[0]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transfers": transfers,
+	})
+}
+
+func (app *Config) HandleAcceptTransfer(w http.ResponseWriter, r *http.Request) {
+	app.answerTransfer(w, r, transferAccepted)
+}
+
+func (app *Config) HandleDeclineTransfer(w http.ResponseWriter, r *http.Request) {
+	app.answerTransfer(w, r, transferDeclined)
+}
+
+func (app *Config) HandleCancelTransfer(w http.ResponseWriter, r *http.Request) {
+	app.answerTransfer(w, r, transferCancelled)
+}
+
+// The recipient accepts or declines, the sender can cancel while it's pending
+func (app *Config) answerTransfer(w http.ResponseWriter, r *http.Request, answer string) {
+	userID, ok := authmiddleware.UserID(r.Context())
+	if !ok {
+		http.Error(w, "Error: No user in the request", http.StatusUnauthorized)
+		return
+	}
+
+	transferID, err := strconv.Atoi(chi.URLParam(r, "transferID"))
+	if err != nil {
+		http.Error(w, "Error: Transfer not found", http.StatusNotFound)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	err = settleTransfer(db, userID, transferID, answer)
+	var rejected *transferError
+	if errors.As(err, &rejected) {
+		http.Error(w, fmt.Sprintf("Error: %v", rejected), rejected.Status)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Transfer %s failed: %v", answer, err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Transfer %d %s by user %d", transferID, answer, userID)
+
+	writeTransfer(w, db, transferID, http.StatusOK)
+}
+
+func createTransfer(db *sqlx.DB, userID int, ticketID string, to string) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	ticket, err := lockTicket(tx, ticketID)
+	if err == sql.ErrNoRows || (err == nil && ticket.HolderID != userID) {
+		return 0, &transferError{http.StatusNotFound, "ticket not found"}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	deadline, err := ticket.transferable(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	listed, err := hasActiveListing(tx, ticketID)
+	if err != nil {
+		return 0, err
+	}
+	if listed {
+		return 0, &transferError{http.StatusConflict, "ticket is listed for resale, withdraw the listing first"}
+	}
+
+	recipientID, err := findRecipient(tx, to)
+	if err != nil {
+		return 0, err
+	}
+	if recipientID == userID {
+		return 0, &transferError{http.StatusBadRequest, "can't transfer a ticket to yourself"}
+	}
+
+	// An offer nobody answered in time doesn't block a new one
+	_, err = tx.Exec(`UPDATE TicketTransfer SET Status = $1 WHERE TicketID = $2 AND Status = $3 AND Expires_at <= NOW()`,
+		transferExpired, ticketID, transferPending)
+	if err != nil {
+		return 0, fmt.Errorf("transfer expiry error: %v", err)
+	}
+
+	var pending int
+	err = tx.Get(&pending, `SELECT COUNT(*) FROM TicketTransfer WHERE TicketID = $1 AND Status = $2`, ticketID, transferPending)
+	if err != nil {
+		return 0, fmt.Errorf("pending transfer query error: %v", err)
+	}
+	if pending > 0 {
+		return 0, &transferError{http.StatusConflict, "ticket already has a pending transfer, cancel it first"}
+	}
+
+	expiresAt := time.Now().Add(transferTTL)
+	if deadline.Before(expiresAt) {
+		expiresAt = deadline
+	}
+
+	var transferID int
+	err = tx.Get(&transferID, `
+		INSERT INTO TicketTransfer (TicketID, ShowID, FromID, ToID, Status, Expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING TransferID`,
+		ticketID, ticket.ShowID, userID, recipientID, transferPending, expiresAt)
+	if err != nil {
+		return 0, fmt.Errorf("transfer insert error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transfer: %v", err)
+	}
+
+	return transferID, nil
+}
+
+// Moves a pending transfer to its final status, accepting hands the ticket over
+func settleTransfer(db *sqlx.DB, userID int, transferID int, answer string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var transfer struct {
+		TicketID  string    `db:"ticketid"`
+		FromID    int       `db:"fromid"`
+		ToID      int       `db:"toid"`
+		Status    string    `db:"status"`
+		ExpiresAt time.Time `db:"expires_at"`
+	}
+	err = tx.Get(&transfer, `
+		SELECT TicketID, FromID, ToID, Status, Expires_at
+		FROM TicketTransfer
+		WHERE TransferID = $1
+		FOR UPDATE`, transferID)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("transfer query error: %v", err)
+	}
+
+	// Only the recipient answers, only the sender cancels
+	answeredBy := transfer.ToID
+	if answer == transferCancelled {
+		answeredBy = transfer.FromID
+	}
+	if err == sql.ErrNoRows || answeredBy != userID {
+		return &transferError{http.StatusNotFound, "transfer not found"}
+	}
+
+	if transfer.Status != transferPending {
+		return &transferError{http.StatusConflict, fmt.Sprintf("transfer is already %s", transfer.Status)}
+	}
+	if !transfer.ExpiresAt.After(time.Now()) {
+		_, err = tx.Exec(`UPDATE TicketTransfer SET Status = $1 WHERE TransferID = $2`, transferExpired, transferID)
+		if err != nil {
+			return fmt.Errorf("transfer expiry error: %v", err)
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transfer expiry: %v", err)
+		}
+		return &transferError{http.StatusGone, "transfer has expired"}
+	}
+
+	var newTicketID *string
+	if answer == transferAccepted {
+		ticket, err := lockTicket(tx, transfer.TicketID)
+		if err != nil {
+			return err
+		}
+		if ticket.HolderID != transfer.FromID {
+			return &transferError{http.StatusConflict, "sender no longer holds the ticket"}
+		}
+
+		// The show may have changed its policy, or the ticket been used, since the offer
+		_, err = ticket.transferable(tx)
+		if err != nil {
+			return err
+		}
+
+		id, err := reissueTicket(tx, ticket, transfer.ToID, ticket.Reference)
+		if err != nil {
+			return err
+		}
+		newTicketID = &id
+	}
+
+	_, err = tx.Exec(`UPDATE TicketTransfer SET Status = $1, New_ticketID = $2, Responded_at = NOW() WHERE TransferID = $3`,
+		answer, newTicketID, transferID)
+	if err != nil {
+		return fmt.Errorf("transfer update error: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transfer: %v", err)
+	}
+
+	return nil
+}
+
+type lockedTicket struct {
+	TicketID          string `db:"ticketid"`
+	Reference         string `db:"order_reference"`
+	ShowID            int    `db:"showid"`
+	SeatReservationID string `db:"seatreservationid"`
+	HolderID          int    `db:"holderid"`
+	Status            string `db:"status"`
+	TransferCount     int    `db:"transfer_count"`
+	FaceValue         *int64 `db:"face_value"`
+}
+
+func lockTicket(tx *sqlx.Tx, ticketID string) (*lockedTicket, error) {
+	var ticket lockedTicket
+	err := tx.Get(&ticket, `
+		SELECT TicketID, Order_reference, ShowID, SeatReservationID, HolderID, Status, Transfer_count, Face_value
+		FROM Ticket
+		WHERE TicketID = $1
+		FOR UPDATE`, ticketID)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ticket query error: %v", err)
+	}
+
+	return &ticket, nil
+}
+
+// Checks the ticket and its show's transfer policy, returns when transfers close
+func (t *lockedTicket) transferable(tx *sqlx.Tx) (time.Time, error) {
+	switch t.Status {
+	case ticketVoid:
+		return time.Time{}, &transferError{http.StatusGone, "ticket is void, the booking was cancelled"}
+	case ticketUsed:
+		return time.Time{}, &transferError{http.StatusConflict, "ticket has already been used"}
+	case ticketTransferred:
+		return time.Time{}, &transferError{http.StatusGone, "ticket was transferred to someone else"}
+	}
+
+	var policy struct {
+		Status        string    `db:"status"`
+		Starttime     time.Time `db:"time_start"`
+		Allowed       bool      `db:"transfers_allowed"`
+		CutoffMinutes int       `db:"transfer_cutoff_minutes"`
+		MaxTransfers  *int      `db:"max_transfers"`
+	}
+	err := tx.Get(&policy, `
+		SELECT Status, Time_start, COALESCE(Transfers_allowed, TRUE) AS transfers_allowed,
+			COALESCE(Transfer_cutoff_minutes, 0) AS transfer_cutoff_minutes, Max_transfers
+		FROM Show
+		WHERE ShowID = $1`, t.ShowID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("show transfer policy query error: %v", err)
+	}
+
+	deadline := policy.Starttime.Add(-time.Duration(policy.CutoffMinutes) * time.Minute)
+
+	switch {
+	case policy.Status == "cancelled":
+		return time.Time{}, &transferError{http.StatusGone, "show is cancelled"}
+	case !policy.Allowed:
+		return time.Time{}, &transferError{http.StatusForbidden, "tickets for this show can't be transferred"}
+	case !time.Now().Before(deadline):
+		return time.Time{}, &transferError{http.StatusForbidden, fmt.Sprintf("transfers for this show closed at %s", deadline.Format(time.RFC1123))}
+	case policy.MaxTransfers != nil && t.TransferCount >= *policy.MaxTransfers:
+		return time.Time{}, &transferError{http.StatusForbidden, fmt.Sprintf("this ticket can't be transferred more than %d times", *policy.MaxTransfers)}
+	}
+
+	return deadline, nil
+}
+
+// Matched without case, usernames aren't unique so an ambiguous one is refused
+func findRecipient(tx *sqlx.Tx, to string) (int, error) {
+	var userIDs []int
+	err := tx.Select(&userIDs, `
+		SELECT UserID
+		FROM Users
+		WHERE LOWER(username) = LOWER($1) OR LOWER(email) = LOWER($1)
+		LIMIT 2`, strings.TrimSpace(to))
+	if err != nil {
+		return 0, fmt.Errorf("recipient query error: %v", err)
+	}
+
+	switch len(userIDs) {
+	case 0:
+		return 0, &transferError{http.StatusNotFound, fmt.Sprintf("no user %s", to)}
+	case 1:
+		return userIDs[0], nil
+	default:
+		return 0, &transferError{http.StatusConflict, fmt.Sprintf("more than one user matches %s, use their email", to)}
+	}
+}
+
+// Hands the seat to the new holder: the old ticket's token stops working at the
+// door and a new ticket is signed under the given order. A transfer keeps the
+// buyer's order, and any refund stays with the buyer, a resale uses the new order.
+func reissueTicket(tx *sqlx.Tx, ticket *lockedTicket, holderID int, reference string) (string, error) {
+	_, err := tx.Exec(`UPDATE Ticket SET Status = $1 WHERE TicketID = $2`, ticketTransferred, ticket.TicketID)
+	if err != nil {
+		return "", fmt.Errorf("ticket update error: %v", err)
+	}
+
+	ticketID, err := insertTicket(tx, reference, ticket.ShowID, ticket.SeatReservationID, holderID, ticket.TransferCount+1, ticket.FaceValue)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`UPDATE Reservation SET BookedbyID = $1 WHERE SeatReservationID = $2 AND Booked = TRUE`,
+		holderID, ticket.SeatReservationID)
+	if err != nil {
+		return "", fmt.Errorf("reservation update error: %v", err)
+	}
+
+	return ticketID, nil
+}
+
+func writeTransfer(w http.ResponseWriter, db *sqlx.DB, transferID int, status int) {
+	var transfer ticketTransfer
+	err := db.Get(&transfer, ticketTransferQuery+` WHERE tt.TransferID = $1`, transferID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Transfer lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	transfer.SeatID = seatIDsOf(transfer.ShowID, []string{transfer.SeatID})[0]
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(transfer)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Records the use of a promo code in the booking transaction. The voucher row is
+// locked first, so concurrent bookings with the same code are counted one after
+// the other and the usage limits can't be exceeded. The code was checked when the
+// seats were priced, it is checked again here as it may have expired or changed since.
+func redeemVoucher(tx *sqlx.Tx, reservation ReservationRequest, showid int) error {
+	code := strings.ToUpper(reservation.PromoCode)
+
+	var maxUses, maxUsesPerUser, voucherShow sql.NullInt64
+	var category sql.NullString
+	var usedCount int
+	var started, expired bool
+	err := tx.QueryRow(`
+		SELECT Max_uses, Max_uses_per_user, Used_count, ShowID, Category,
+			COALESCE(Valid_from <= NOW(), TRUE), COALESCE(Valid_until < NOW(), FALSE)
+		FROM Voucher
+		WHERE Code = $1
+		FOR UPDATE`, code).Scan(&maxUses, &maxUsesPerUser, &usedCount, &voucherShow, &category, &started, &expired)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("promo code %s does not exist", code)
+	}
+	if err != nil {
+		return fmt.Errorf("error querying voucher: %v", err)
+	}
+
+	if !started {
+		return fmt.Errorf("promo code %s isn't valid yet", code)
+	}
+	if expired {
+		return fmt.Errorf("promo code %s has expired", code)
+	}
+	if voucherShow.Valid && int(voucherShow.Int64) != showid {
+		return fmt.Errorf("promo code %s isn't valid for show %d", code, showid)
+	}
+	if category.Valid {
+		var eligible int
+		err = tx.Get(&eligible, `
+			SELECT COUNT(*)
+			FROM Reservation r
+			JOIN Seat s ON r.SeatReservationID = 'SH_' || r.ShowID || '_ST_' || s.SeatID
+			WHERE r.SeatReservationID = ANY($1) AND s.Category = $2`,
+			pq.Array(reservation.SeatReservationIDs), category.String)
+		if err != nil {
+			return fmt.Errorf("error querying seat categories: %v", err)
+		}
+		if eligible == 0 {
+			return fmt.Errorf("promo code %s doesn't apply to any of the seats", code)
+		}
+	}
+
+	if maxUses.Valid && usedCount >= int(maxUses.Int64) {
+		return fmt.Errorf("promo code %s has been used up", code)
+	}
+
+	if maxUsesPerUser.Valid {
+		var userUses int
+		err = tx.Get(&userUses, `SELECT COUNT(*) FROM VoucherRedemption WHERE Code = $1 AND UserID = $2`, code, reservation.BookedbyID)
+		if err != nil {
+			return fmt.Errorf("error querying voucher redemptions: %v", err)
+		}
+		if userUses >= int(maxUsesPerUser.Int64) {
+			return fmt.Errorf("promo code %s has already been used the maximum number of times", code)
+		}
+	}
+
+	var discount int64
+	if reservation.Receipt != nil {
+		discount = reservation.Receipt.Discount
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO VoucherRedemption (Code, UserID, ShowID, Paymentconf_id, Discount)
+		VALUES ($1, $2, $3, $4, $5)`,
+		code, reservation.BookedbyID, showid, reservation.Paymentconf_id, discount)
+	if err != nil {
+		return fmt.Errorf("error saving voucher redemption: %v", err)
+	}
+
+	_, err = tx.Exec(`UPDATE Voucher SET Used_count = Used_count + 1 WHERE Code = $1`, code)
+	if err != nil {
+		return fmt.Errorf("error updating voucher usage: %v", err)
+	}
+
+	return nil
+}
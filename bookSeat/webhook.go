@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Header carrying the signature checkPayment puts on the payment data
+const webhookSignatureHeader = "X-Payment-Signature"
+
+// How far the signature timestamp may be from our clock, signatures are
+// remembered for twice as long so a replay can't outlive its record
+const webhookTolerance = 5 * time.Minute
+
+// Shared with checkPayment, read at startup from PAYMENT_WEBHOOK_SECRET
+var webhookSecret []byte
+
+func loadWebhookSecret() {
+	secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Fatal("Error: PAYMENT_WEBHOOK_SECRET is not set")
+	}
+	webhookSecret = []byte(secret)
+}
+
+// Checks a "t=<unix seconds>,v1=<hex hmac-sha256 of t.body>" header against
+// the body and returns the signature to use for replay protection
+func verifyWebhookSignature(header string, body []byte, now time.Time) (string, error) {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	if timestamp == "" || signature == "" {
+		return "", fmt.Errorf("malformed signature header")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed signature timestamp: %v", err)
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	if age > webhookTolerance || age < -webhookTolerance {
+		return "", fmt.Errorf("signature timestamp outside of the %v tolerance", webhookTolerance)
+	}
+
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return "", fmt.Errorf("malformed signature: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, webhookSecret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return "", fmt.Errorf("signature mismatch")
+	}
+
+	return signature, nil
+}
+
+// Records the signature in Redis, a signature that was already seen is a replay
+func checkWebhookReplay(signature string) error {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	defer rdb.Close()
+
+	// Context for the Redis operations.
+	ctx := context.Background()
+
+	fresh, err := rdb.SetNX(ctx, "webhook_sig_"+signature, 1, 2*webhookTolerance).Result()
+	if err != nil {
+		return fmt.Errorf("error recording webhook signature in Redis: %v", err)
+	}
+	if !fresh {
+		return fmt.Errorf("payment data was already delivered")
+	}
+
+	return nil
+}
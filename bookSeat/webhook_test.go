@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Signs the way checkPayment does
+func testSignature(secret string, timestamp int64, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", timestamp, body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	saved := webhookSecret
+	webhookSecret = []byte("test-secret")
+	defer func() { webhookSecret = saved }()
+
+	now := time.Unix(1700000000, 0)
+	body := `{"paymentconf_id":123456789,"amount":5000}`
+	valid := testSignature("test-secret", now.Unix(), body)
+
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		err    string
+	}{
+		{"valid", fmt.Sprintf("t=%d,v1=%s", now.Unix(), valid), body, ""},
+		{"spaces and parts in any order", fmt.Sprintf(" v1=%s , t=%d ", valid, now.Unix()), body, ""},
+		{"unknown parts ignored", fmt.Sprintf("t=%d,v0=abc,v1=%s", now.Unix(), valid), body, ""},
+		{
+			"just inside the tolerance",
+			fmt.Sprintf("t=%d,v1=%s", now.Add(-webhookTolerance).Unix(), testSignature("test-secret", now.Add(-webhookTolerance).Unix(), body)),
+			body, "",
+		},
+		{"empty header", "", body, "malformed signature header"},
+		{"no timestamp", "v1=" + valid, body, "malformed signature header"},
+		{"no signature", fmt.Sprintf("t=%d", now.Unix()), body, "malformed signature header"},
+		{"timestamp not a number", "t=yesterday,v1=" + valid, body, "malformed signature timestamp"},
+		{
+			"too old",
+			fmt.Sprintf("t=%d,v1=%s", now.Add(-webhookTolerance-time.Second).Unix(), testSignature("test-secret", now.Add(-webhookTolerance-time.Second).Unix(), body)),
+			body, "tolerance",
+		},
+		{
+			"too far in the future",
+			fmt.Sprintf("t=%d,v1=%s", now.Add(webhookTolerance+time.Second).Unix(), testSignature("test-secret", now.Add(webhookTolerance+time.Second).Unix(), body)),
+			body, "tolerance",
+		},
+		{"signature not hex", fmt.Sprintf("t=%d,v1=not-hex", now.Unix()), body, "malformed signature"},
+		{"body changed", fmt.Sprintf("t=%d,v1=%s", now.Unix(), valid), strings.Replace(body, "5000", "1", 1), "signature mismatch"},
+		{"timestamp changed", fmt.Sprintf("t=%d,v1=%s", now.Unix()-1, valid), body, "signature mismatch"},
+		{"other secret", fmt.Sprintf("t=%d,v1=%s", now.Unix(), testSignature("other-secret", now.Unix(), body)), body, "signature mismatch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature, err := verifyWebhookSignature(tt.header, []byte(tt.body), now)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("verifyWebhookSignature: %v", err)
+				}
+				if signature == "" {
+					t.Errorf("no signature returned for replay protection")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
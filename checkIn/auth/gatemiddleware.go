@@ -0,0 +1,79 @@
+package authmiddleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type contextKey string
+
+const gateKey contextKey = "gate"
+
+// Gate a scanner is signed in at, with when its shift token was issued
+type Gate struct {
+	Name     string
+	IssuedAt time.Time
+}
+
+var gateSecret []byte
+
+// Reads GATE_TOKEN_SECRET, the secret gate staff tokens are signed with. Called
+// at startup, without it anyone could let tickets in.
+func LoadGateSecret() {
+	secret := os.Getenv("GATE_TOKEN_SECRET")
+	if secret == "" {
+		log.Fatal("Error: GATE_TOKEN_SECRET is not set")
+	}
+	gateSecret = []byte(secret)
+}
+
+// Gate set by GateMiddleware
+func GateFrom(ctx context.Context) (Gate, bool) {
+	gate, ok := ctx.Value(gateKey).(Gate)
+	return gate, ok
+}
+
+// Lets only scanners signed in by gate staff through. Their token is an HS256
+// JWT with iss "gate", the gate name in "gate", and iat and exp for the shift.
+func GateMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || tokenString == "" {
+			http.Error(w, "Error: Authorization header is missing", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return gateSecret, nil
+		}, jwt.WithIssuer("gate"), jwt.WithExpirationRequired(), jwt.WithIssuedAt())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: invalid gate token: %v", err), http.StatusUnauthorized)
+			return
+		}
+
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			http.Error(w, "Error: invalid gate token claims", http.StatusUnauthorized)
+			return
+		}
+		name, _ := claims["gate"].(string)
+		issuedAt, err := claims.GetIssuedAt()
+		if name == "" || err != nil || issuedAt == nil {
+			http.Error(w, "Error: gate token has no gate or issue time", http.StatusUnauthorized)
+			return
+		}
+
+		gate := Gate{Name: name, IssuedAt: issuedAt.Time}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), gateKey, gate)))
+	})
+}
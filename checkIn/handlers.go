@@ -0,0 +1,218 @@
+package main
+
+import (
+	authmiddleware "checkIn/auth"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Oldest offline scan taken at the time the scanner says, older ones are
+// recorded at the time they arrive
+const maxOfflineAge = 12 * time.Hour
+
+// /scan takes the gate from the scanner's gate token, Gate is only echoed by /verify
+type scanRequest struct {
+	Token  string `json:"token"`
+	ShowID int    `json:"show_id"`
+	Gate   string `json:"gate"`
+}
+
+// Scans a scanner made while it couldn't reach the service
+type syncScansRequest struct {
+	ShowID int `json:"show_id"`
+	Scans  []struct {
+		Token     string    `json:"token"`
+		ScannedAt time.Time `json:"scanned_at"`
+	} `json:"scans"`
+}
+
+// HTTP status the scanner shows for each outcome
+var scanStatus = map[string]int{
+	scanAccepted:    http.StatusOK,
+	scanDuplicate:   http.StatusConflict,
+	scanWrongShow:   http.StatusConflict,
+	scanSuperseded:  http.StatusConflict,
+	scanVoid:        http.StatusGone,
+	scanTransferred: http.StatusGone,
+	scanUnknown:     http.StatusNotFound,
+	scanInvalid:     http.StatusUnauthorized,
+}
+
+// Checks a ticket and lets its holder in, each ticket is accepted only once
+func (app *Config) HandleScan(w http.ResponseWriter, r *http.Request) {
+	var scanrequest scanRequest
+
+	err := json.NewDecoder(r.Body).Decode(&scanrequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse scan request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if scanrequest.Token == "" || scanrequest.ShowID == 0 {
+		http.Error(w, "Error: token and show_id are required", http.StatusBadRequest)
+		return
+	}
+
+	gate, ok := authmiddleware.GateFrom(r.Context())
+	if !ok {
+		http.Error(w, "Error: scanner isn't signed in at a gate", http.StatusUnauthorized)
+		return
+	}
+	scanrequest.Gate = gate.Name
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := scanTicket(db, scanrequest.Token, scanrequest.ShowID, scanrequest.Gate, time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Scan failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !result.accepted() {
+		log.Printf("Scan at gate %s for show %d rejected: %s %s", result.Gate, scanrequest.ShowID, result.Result, result.TicketID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(scanStatus[result.Result])
+	json.NewEncoder(w).Encode(result)
+}
+
+// Signature and show check only, no database, so it answers the same way
+// a scanner holding the public key would while offline. Doesn't catch duplicates.
+func (app *Config) HandleVerify(w http.ResponseWriter, r *http.Request) {
+	var scanrequest scanRequest
+
+	err := json.NewDecoder(r.Body).Decode(&scanrequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse verify request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result := scanResult{Result: scanAccepted, ShowID: scanrequest.ShowID, Gate: scanrequest.Gate}
+
+	claims, err := verifyTicketToken(scanrequest.Token)
+	if err != nil {
+		result.Result = scanInvalid
+		result.Message = err.Error()
+	} else {
+		result.TicketID = claims.TicketID
+		result.SeatID = claims.SeatID
+		result.Reference = claims.Reference
+		if scanrequest.ShowID != 0 && claims.ShowID != scanrequest.ShowID {
+			result.Result = scanWrongShow
+			result.Message = fmt.Sprintf("ticket is for show %d, not show %d", claims.ShowID, scanrequest.ShowID)
+		}
+		result.ShowID = claims.ShowID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(scanStatus[result.Result])
+	json.NewEncoder(w).Encode(result)
+}
+
+// Uploads scans made offline, replayed in the order they were made so the
+// first holder through the gate keeps the entry when a ticket was copied
+func (app *Config) HandleSyncScans(w http.ResponseWriter, r *http.Request) {
+	var syncrequest syncScansRequest
+
+	err := json.NewDecoder(r.Body).Decode(&syncrequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse sync request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if syncrequest.ShowID == 0 {
+		http.Error(w, "Error: show_id is required", http.StatusBadRequest)
+		return
+	}
+
+	gate, ok := authmiddleware.GateFrom(r.Context())
+	if !ok {
+		http.Error(w, "Error: scanner isn't signed in at a gate", http.StatusUnauthorized)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The scanner's clock is only believed between the start of its shift and
+	// now, so a scan can't be dated before a genuine entry to take its place
+	received := time.Now()
+	scans := syncrequest.Scans
+	for i := range scans {
+		scans[i].ScannedAt = clampScanTime(scans[i].ScannedAt, gate.IssuedAt, received)
+	}
+	sort.SliceStable(scans, func(i, j int) bool {
+		return scans[i].ScannedAt.Before(scans[j].ScannedAt)
+	})
+
+	results := make([]scanResult, 0, len(scans))
+	for _, scan := range scans {
+		result, err := scanTicket(db, scan.Token, syncrequest.ShowID, gate.Name, scan.ScannedAt)
+		if err != nil {
+			// The scanner keeps what wasn't acknowledged and sends it again
+			http.Error(w, fmt.Sprintf("Error: Sync stopped after %d scans: %v", len(results), err), http.StatusInternalServerError)
+			return
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"show_id": syncrequest.ShowID,
+		"results": results,
+	})
+}
+
+// Time an offline scan is recorded at: the scanner's time when it falls within
+// the scanner's shift and maxOfflineAge, the time it arrived otherwise
+func clampScanTime(scannedAt, shiftStart, received time.Time) time.Time {
+	earliest := received.Add(-maxOfflineAge)
+	if shiftStart.After(earliest) {
+		earliest = shiftStart
+	}
+	if scannedAt.Before(earliest) || scannedAt.After(received) {
+		return received
+	}
+	return scannedAt
+}
+
+// How many people are in for the show, and through which gate
+func (app *Config) HandleEntries(w http.ResponseWriter, r *http.Request) {
+	showid, err := strconv.Atoi(chi.URLParam(r, "showID"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Invalid show id: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	counts, err := getEntryCounts(db, showid)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Entry count failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(counts)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	authmiddleware "checkIn/auth"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const webPort = "8092"
+
+type Config struct {
+}
+
+const pgConnectionString = "host=localhost port=5432 user=rayanc dbname=tickets sslmode=disable"
+
+func main() {
+	app := Config{}
+
+	log.Printf("Starting CheckIn service on port: %s", webPort)
+
+	// Fail early on a bad key rather than at the first scan
+	loadTicketPublicKey()
+
+	// Only scanners signed in by gate staff can let people in
+	authmiddleware.LoadGateSecret()
+
+	// HTTP server
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", webPort),
+		Handler: app.routes(),
+	}
+
+	//DB connection check
+	_, err := ConnectToDB()
+	if err != nil {
+		log.Fatalf("Error: DB connection %v", err)
+		return
+	}
+
+	//Start the web server
+	err = srv.ListenAndServe()
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+}
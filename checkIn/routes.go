@@ -0,0 +1,45 @@
+package main
+
+import (
+	authmiddleware "checkIn/auth"
+	"net/http"
+	"ratelimit"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/cors"
+)
+
+// Handlers the routing part, returns Handler to the main.go
+func (app *Config) routes() http.Handler {
+	mux := chi.NewRouter()
+
+	// Specify who is allowed to connect
+	mux.Use(cors.Handler(cors.Options{
+		AllowedOrigins:   []string{"https://*", "http://*"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-TOKEN"},
+		ExposedHeaders:   []string{"Link"},
+		AllowCredentials: true,
+		MaxAge:           300,
+	}))
+
+	//To check if service up or not
+	mux.Use(middleware.Heartbeat("/ping"))
+
+	//Rate limit per address, the scanners of a gate can share one
+	mux.Use(ratelimit.Middleware("checkin_ip", ratelimit.PerMinute(1200), ratelimit.ByIP))
+
+	//Add route at root level
+	mux.Post("/verify", app.HandleVerify)
+
+	//Letting people in and counting them takes a scanner signed in by gate staff
+	mux.Group(func(mux chi.Router) {
+		mux.Use(authmiddleware.GateMiddleware)
+		mux.Post("/scan", app.HandleScan)
+		mux.Post("/syncScans", app.HandleSyncScans)
+		mux.Get("/shows/{showID}/entries", app.HandleEntries)
+	})
+
+	return mux
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Outcome of one scan, only accepted lets the holder in
+const (
+	scanAccepted    = "accepted"
+	scanDuplicate   = "duplicate"      // already used, Checked_in_at says when
+	scanWrongShow   = "wrong_show"     // genuine ticket for another show
+	scanVoid        = "void"           // the order was cancelled
+	scanTransferred = "transferred"    // given to someone else, who has their own ticket
+	scanUnknown     = "unknown_ticket" // signed by us but not in the database
+	scanSuperseded  = "superseded"     // reissued after the show moved hall, the holder has a newer ticket
+	scanInvalid     = "invalid_ticket" // bad signature or not one of our tokens
+)
+
+type scanResult struct {
+	Result      string     `json:"result"`
+	TicketID    string     `json:"ticket_id,omitempty"`
+	ShowID      int        `json:"show_id,omitempty"`
+	SeatID      string     `json:"seat_id,omitempty"`
+	Reference   string     `json:"reference,omitempty"`
+	Gate        string     `json:"gate,omitempty"`
+	CheckedInAt *time.Time `json:"checked_in_at,omitempty"`
+	Message     string     `json:"message,omitempty"`
+}
+
+func (result scanResult) accepted() bool {
+	return result.Result == scanAccepted
+}
+
+// Checks the ticket against the database and marks it used, the row lock makes
+// two gates scanning copies of the same ticket let only one of them in.
+// Every scan is recorded in CheckIn, rejected ones included.
+func scanTicket(db *sqlx.DB, token string, showid int, gate string, scannedAt time.Time) (scanResult, error) {
+	claims, err := verifyTicketToken(token)
+	if err != nil {
+		result := scanResult{Result: scanInvalid, ShowID: showid, Gate: gate, Message: err.Error()}
+		return result, recordScan(db, showid, result, scannedAt)
+	}
+
+	result := scanResult{
+		TicketID:  claims.TicketID,
+		ShowID:    claims.ShowID,
+		SeatID:    claims.SeatID,
+		Reference: claims.Reference,
+		Gate:      gate,
+	}
+
+	if claims.ShowID != showid {
+		result.Result = scanWrongShow
+		result.Message = fmt.Sprintf("ticket is for show %d, not show %d", claims.ShowID, showid)
+		return result, recordScan(db, showid, result, scannedAt)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return result, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var ticket struct {
+		SeatReservationID string       `db:"seatreservationid"`
+		Token             string       `db:"token"`
+		Status            string       `db:"status"`
+		UsedAt            sql.NullTime `db:"used_at"`
+	}
+	err = tx.Get(&ticket, `
+		SELECT SeatReservationID, Token, Status, Used_at
+		FROM Ticket
+		WHERE TicketID = $1 AND ShowID = $2
+		FOR UPDATE`, claims.TicketID, claims.ShowID)
+
+	switch {
+	case err == sql.ErrNoRows:
+		result.Result = scanUnknown
+	case err != nil:
+		return result, fmt.Errorf("ticket query error: %v", err)
+	case ticket.Status == ticketVoid:
+		result.Result = scanVoid
+	case ticket.Status == ticketTransferred:
+		result.Result = scanTransferred
+	case ticket.Token != token:
+		result.Result = scanSuperseded
+	case strings.TrimPrefix(ticket.SeatReservationID, fmt.Sprintf("SH_%d_ST_", claims.ShowID)) != claims.SeatID:
+		// The show moved hall and the ticket hasn't been signed again yet
+		result.Result = scanSuperseded
+		result.Message = "the seat of this ticket has changed, the holder needs to download it again"
+	case ticket.Status == ticketUsed:
+		result.Result = scanDuplicate
+		result.CheckedInAt = &ticket.UsedAt.Time
+	default:
+		result.Result = scanAccepted
+		result.CheckedInAt = &scannedAt
+
+		_, err = tx.Exec(`UPDATE Ticket SET Status = $1, Used_at = $2 WHERE TicketID = $3`,
+			ticketUsed, scannedAt, claims.TicketID)
+		if err != nil {
+			return result, fmt.Errorf("ticket update error: %v", err)
+		}
+
+		_, err = tx.Exec(`UPDATE Reservation SET Checked_in_at = $1 WHERE SeatReservationID = $2 AND Booked = TRUE`,
+			scannedAt, ticket.SeatReservationID)
+		if err != nil {
+			return result, fmt.Errorf("reservation update error: %v", err)
+		}
+	}
+
+	err = insertCheckIn(tx, showid, result, scannedAt)
+	if err != nil {
+		return result, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return result, fmt.Errorf("failed to commit scan: %v", err)
+	}
+
+	return result, nil
+}
+
+// Logs a scan rejected before the ticket row was looked at
+func recordScan(db *sqlx.DB, showid int, result scanResult, scannedAt time.Time) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = insertCheckIn(tx, showid, result, scannedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Logged under the show the gate is scanning for, not the one on the ticket
+func insertCheckIn(tx *sqlx.Tx, showid int, result scanResult, scannedAt time.Time) error {
+	_, err := tx.Exec(`
+		INSERT INTO CheckIn (TicketID, ShowID, Gate, Result, Scanned_at)
+		VALUES (NULLIF($1, ''), $2, $3, $4, $5)`,
+		result.TicketID, showid, result.Gate, result.Result, scannedAt)
+	if err != nil {
+		return fmt.Errorf("check-in log insert error: %v", err)
+	}
+
+	return nil
+}
+
+type entryCounts struct {
+	ShowID    int            `json:"show_id"`
+	Issued    int            `json:"issued"`
+	CheckedIn int            `json:"checked_in"`
+	Remaining int            `json:"remaining"`
+	Rejected  int            `json:"rejected"`
+	ByGate    map[string]int `json:"by_gate"`
+}
+
+// How many ticket holders are in, void and transferred tickets aren't counted as issued
+func getEntryCounts(db *sqlx.DB, showid int) (*entryCounts, error) {
+	counts := entryCounts{ShowID: showid, ByGate: map[string]int{}}
+
+	err := db.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE Status NOT IN ($2, $3)), COUNT(*) FILTER (WHERE Status = $4)
+		FROM Ticket
+		WHERE ShowID = $1`, showid, ticketVoid, ticketTransferred, ticketUsed).Scan(&counts.Issued, &counts.CheckedIn)
+	if err != nil {
+		return nil, fmt.Errorf("ticket count query error: %v", err)
+	}
+	counts.Remaining = counts.Issued - counts.CheckedIn
+
+	var gates []struct {
+		Gate     string `db:"gate"`
+		Accepted int    `db:"accepted"`
+		Rejected int    `db:"rejected"`
+	}
+	err = db.Select(&gates, `
+		SELECT Gate, COUNT(*) FILTER (WHERE Result = $2) AS accepted, COUNT(*) FILTER (WHERE Result <> $2) AS rejected
+		FROM CheckIn
+		WHERE ShowID = $1
+		GROUP BY Gate`, showid, scanAccepted)
+	if err != nil {
+		return nil, fmt.Errorf("gate count query error: %v", err)
+	}
+
+	for _, gate := range gates {
+		counts.ByGate[gate.Gate] = gate.Accepted
+		counts.Rejected += gate.Rejected
+	}
+
+	return &counts, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Ticket statuses shared with bookSeat
+const (
+	ticketUsed        = "used"
+	ticketVoid        = "void"
+	ticketTransferred = "transferred"
+)
+
+// What a ticket token vouches for, signed by bookSeat
+type ticketClaims struct {
+	Version   int    `json:"v"`
+	TicketID  string `json:"tid"`
+	ShowID    int    `json:"show"`
+	SeatID    string `json:"seat"`
+	Reference string `json:"ref"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+// Checks every ticket, read at startup
+var publicKey ed25519.PublicKey
+
+// Public key from TICKET_PUBLIC_KEY (base64, bookSeat logs it at startup).
+// Only the public key is needed, so gates can check tickets without the network.
+func loadTicketPublicKey() {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("TICKET_PUBLIC_KEY"))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		log.Fatal("Error: TICKET_PUBLIC_KEY is missing or isn't a base64 ed25519 public key")
+	}
+	publicKey = key
+}
+
+// Checks the signature and returns what the token claims, nothing else is checked
+func verifyTicketToken(token string) (*ticketClaims, error) {
+	payload, signature, found := strings.Cut(strings.TrimSpace(token), ".")
+	if !found {
+		return nil, fmt.Errorf("malformed ticket token")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ticket signature: %v", err)
+	}
+	if !ed25519.Verify(publicKey, []byte(payload), sig) {
+		return nil, fmt.Errorf("ticket signature is invalid")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ticket token: %v", err)
+	}
+
+	var claims ticketClaims
+	err = json.Unmarshal(data, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ticket token: %v", err)
+	}
+	if claims.Version != 1 {
+		return nil, fmt.Errorf("unknown ticket version %d", claims.Version)
+	}
+
+	return &claims, nil
+}
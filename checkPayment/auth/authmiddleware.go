@@ -2,6 +2,7 @@ package authmiddleware
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,6 +14,16 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+type contextKey string
+
+const userIDKey contextKey = "user_id"
+
+// User the JWT was issued to, set by JWTMiddleware next to the one in the body
+func UserID(ctx context.Context) (int, bool) {
+	userID, ok := ctx.Value(userIDKey).(int)
+	return userID, ok
+}
+
 func JWTMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Extract token from Authorization header
@@ -61,6 +72,7 @@ func JWTMiddleware(next http.Handler) http.Handler {
 			// Convert the float64 value to an integer
 			value := int(sub)
 			body["user_id"] = value
+			r = r.WithContext(context.WithValue(r.Context(), userIDKey, value))
 
 			// Encode the modified body and create a new request with it
 			newBody, err := json.Marshal(body)
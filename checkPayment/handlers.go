@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
+	"math/big"
 	"net/http"
 	"regexp"
 	"sort"
@@ -15,24 +18,32 @@ import (
 )
 
 type PaymentRequest struct {
-	Price    int      `json:"price"`
-	Tokenpsp int      `json:"token_psp"`
-	Userid   int      `json:"user_id"`
-	Clientid int      `json:"client_id"`
-	Seats    []string `json:"seat_ids"`
+	Amount    int64    `json:"amount"`   // minor units, must match the receipt total
+	Currency  string   `json:"currency"` // ISO 4217
+	Tokenpsp  int      `json:"token_psp"`
+	Userid    int      `json:"user_id"`
+	Clientid  int      `json:"client_id"`
+	Showid    int      `json:"show_id"`
+	Seats     []string `json:"seat_ids"`
+	PromoCode string   `json:"promo_code"`
 }
 
 type paymentData struct {
-	Price          int      `json:"price"`
+	Amount         int64    `json:"amount"`
+	Currency       string   `json:"currency"`
 	Userid         int      `json:"user_id"`
+	Showid         int      `json:"show_id"` // the show the receipt and the admission are for
 	Seats          []string `json:"seat_ids"`
 	Paymentconf_id int      `json:"paymentconf_id"`
+	PromoCode      string   `json:"promo_code,omitempty"`
+	Receipt        *Receipt `json:"receipt"`
 }
 
 type beforePayment struct {
-	Userid  int      `json:"user_id"`
-	SeatIDs []string `json:"seat_ids"`
-	Showid  int      `json:"show_id"`
+	Userid    int      `json:"user_id"`
+	SeatIDs   []string `json:"seat_ids"`
+	Showid    int      `json:"show_id"`
+	PromoCode string   `json:"promo_code"`
 }
 
 func (app *Config) checkPayment(w http.ResponseWriter, r *http.Request) {
@@ -45,43 +56,113 @@ func (app *Config) checkPayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	err = checkAdmission(db, r.Header.Get(admissionHeader), paymentrequest.Showid, paymentrequest.Userid)
+	var denied *admissionError
+	if errors.As(err, &denied) {
+		http.Error(w, fmt.Sprintf("Error: Not admitted: %v", err), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Admission check failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Charge the prices locked in when the seats were claimed, promo code and fees included
+	receipt, err := buildReceipt(db, paymentrequest.Showid, paymentrequest.Userid, paymentrequest.Seats, paymentrequest.PromoCode)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to build receipt: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if paymentrequest.Amount != receipt.Total || paymentrequest.Currency != receipt.Currency {
+		http.Error(w, fmt.Sprintf("Error: Amount %d %s doesn't match the receipt total %d %s", paymentrequest.Amount, paymentrequest.Currency, receipt.Total, receipt.Currency), http.StatusConflict)
+		return
+	}
+
+	// Every payment is recorded before the psp is asked anything
+	payment, err := createPayment(db, paymentrequest.Userid, paymentrequest.Showid, receipt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to record payment: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	var paymentdata paymentData
 
-	paymentdata.Price = paymentrequest.Price
+	paymentdata.Amount = receipt.Total
+	paymentdata.Currency = receipt.Currency
+	paymentdata.Receipt = receipt
+	paymentdata.PromoCode = paymentrequest.PromoCode
 	paymentdata.Userid = paymentrequest.Userid
+	paymentdata.Showid = paymentrequest.Showid
 	paymentdata.Seats = paymentrequest.Seats
-	paymentdata.Paymentconf_id = generatePaymentConfirmationID()
+	paymentdata.Paymentconf_id = payment.Paymentconf_id
 
-	//Simulating a psp checking operation
-	time.Sleep(30 * time.Millisecond)
+	// Only hold the funds for now, they are captured once bookSeat has confirmed the seats
+	err = authorizePayment(db, payment)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to authorize payment: %v", err), http.StatusInternalServerError)
+		return
+	}
 
 	//Send the request to the savebooking webhook
 	jsonData, err := json.Marshal(paymentdata)
 	if err != nil {
+		voidPayment(db, payment, "payment data couldn't be encoded")
 		http.Error(w, fmt.Sprintf("Error: Failed to parse payment data form: %v", err), http.StatusInternalServerError)
 		return
 	}
 	sort.Strings(paymentdata.Seats)
-	//Make a HTTP POST call, to paymentData endpoint
-	resp, err := http.Post(generatePaymentUrl(paymentdata.Seats, paymentdata.Userid), "application/json", bytes.NewBuffer(jsonData))
+	//Make a signed HTTP POST call, to paymentData endpoint
+	req, err := http.NewRequest(http.MethodPost, generatePaymentUrl(paymentdata.Seats, paymentdata.Userid), bytes.NewBuffer(jsonData))
+	if err != nil {
+		voidPayment(db, payment, "payment data request couldn't be created")
+		http.Error(w, fmt.Sprintf("Error: Failed to create PaymentData request: %v", err), http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(jsonData, time.Now()))
 
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
+		voidPayment(db, payment, "bookSeat unreachable")
 		http.Error(w, fmt.Sprintf("Error: Failed to send data to PaymentData: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	defer resp.Body.Close()
 
-	// Check if the response status code is not 200
+	// bookSeat only answers 200 once the booking is saved, anything else means no seats
 	if resp.StatusCode != http.StatusOK {
-		http.Error(w, fmt.Sprintf("DEBUG: Unexpected status code from PaymentData: %d", resp.StatusCode), resp.StatusCode)
+		reason, _ := io.ReadAll(resp.Body)
+		voidPayment(db, payment, fmt.Sprintf("booking failed: %s", strings.TrimSpace(string(reason))))
+		http.Error(w, fmt.Sprintf("Error: Booking failed, payment authorization voided: %s", strings.TrimSpace(string(reason))), resp.StatusCode)
 		return
 	}
 
-	// Respond with a success message
+	err = capturePayment(db, payment)
+	if err != nil {
+		// The seats are booked but the money wasn't taken, left authorized for a retry
+		log.Printf("Error: payment %d booked but not captured: %v", payment.PaymentID, err)
+		http.Error(w, fmt.Sprintf("Error: Failed to capture payment: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Respond with the receipt of what was charged
+	response := map[string]interface{}{
+		"message":        "Payment data sent successfully",
+		"paymentconf_id": paymentdata.Paymentconf_id,
+		"receipt":        receipt,
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"message": "Payment data sent successfully"}`)
+	json.NewEncoder(w).Encode(response)
 }
 
 func generatePaymentUrl(seats []string, userid int) string {
@@ -105,9 +186,13 @@ func generatePaymentUrl(seats []string, userid int) string {
 	return finalurl
 }
 
-func generatePaymentConfirmationID() int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(900000) + 100000 // Generates a random number between 100000 and 999999
+// Random 9 digit id, from crypto/rand so ids can't be guessed from one another
+func generatePaymentConfirmationID() (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(900000000))
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate payment confirmation id: %v", err)
+	}
+	return int(n.Int64()) + 100000000, nil
 }
 
 func (app *Config) AbouttoCheckout(w http.ResponseWriter, r *http.Request) {
@@ -126,6 +211,24 @@ func (app *Config) AbouttoCheckout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = checkAdmission(db, r.Header.Get(admissionHeader), beforePayment.Showid, beforePayment.Userid)
+	var denied *admissionError
+	if errors.As(err, &denied) {
+		http.Error(w, fmt.Sprintf("Error: Not admitted: %v", err), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Admission check failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Tell the user what they are about to pay, the amount checkPayment expects
+	receipt, err := buildReceipt(db, beforePayment.Showid, beforePayment.Userid, beforePayment.SeatIDs, beforePayment.PromoCode)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to build receipt: %v", err), http.StatusBadRequest)
+		return
+	}
+
 	//Improvements
 	// Check Seat isnt booked
 	// Check Seat is booked by Same user id
@@ -158,7 +261,7 @@ func (app *Config) AbouttoCheckout(w http.ResponseWriter, r *http.Request) {
 	log.Print(SeatReservationIDs)
 	for _, seatReservationID := range SeatReservationIDs {
 		// Update the database with the new claim time
-		updateQuery := `UPDATE reservation SET last_claim = NOW() + interval '2 minutes' WHERE seatreservationid = $1 AND claimedbyid = $2 AND booked=false`
+		updateQuery := `UPDATE reservation r SET last_claim = NOW() + interval '2 minutes' WHERE seatreservationid = $1 AND claimedbyid = $2 AND (booked=false OR EXISTS (` + activeListing + `))`
 
 		_, err = tx.Exec(updateQuery, seatReservationID, beforePayment.Userid)
 		if err != nil {
@@ -171,5 +274,8 @@ func (app *Config) AbouttoCheckout(w http.ResponseWriter, r *http.Request) {
 	// Respond with a success message
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"message": "2 mins added to claim"}`)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "2 mins added to claim",
+		"receipt": receipt,
+	})
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	authmiddleware "checkPayment/auth"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,6 +16,33 @@ type Config struct {
 const pgConnectionString = "host=localhost port=5432 user=rayanc dbname=tickets sslmode=disable"
 
 func main() {
+	settlementFile := flag.String("reconcile", "", "compare this PSP settlement file (csv or json) with the stored payments and exit")
+	settlementFormat := flag.String("format", "", "format of the settlement file, csv or json (default: from the file extension)")
+	from := flag.String("from", "", "first day (YYYY-MM-DD) of payments to reconcile (default: from the settlement dates)")
+	to := flag.String("to", "", "last day (YYYY-MM-DD) of payments to reconcile (default: from the settlement dates)")
+	flag.Parse()
+
+	if *settlementFile != "" {
+		runReconciliation(*settlementFile, *settlementFormat, *from, *to)
+		return
+	}
+
+	// The orchestrator is told apart from customers by its service token
+	authmiddleware.LoadServiceSecret()
+
+	// bookSeat only takes payment data signed with the shared secret
+	loadWebhookSecret()
+
+	// Admission tokens from the waiting room are checked with the shared secret
+	loadAdmissionSecret()
+
+	// Refunds of cancelled shows are paid in the background
+	db, err := ConnectToDB()
+	if err != nil {
+		log.Fatalf("Error: DB connection %v", err)
+	}
+	go runRefundQueue(db)
+
 	app := Config{}
 
 	log.Printf("Starting checkPayment service on port: %s", webPort)
@@ -26,7 +55,7 @@ func main() {
 
 
 	//Start the web server
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 
 	if err != nil {
 		log.Panic(err)
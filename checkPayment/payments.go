@@ -0,0 +1,343 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// States of a payment, a payment only moves along paymentTransitions
+const (
+	paymentCreated    = "created"    // recorded, nothing asked of the psp yet
+	paymentAuthorized = "authorized" // the psp holds the amount on the customer's card
+	paymentCaptured   = "captured"   // the customer has been charged
+	paymentRefunded   = "refunded"   // a captured amount was given back
+	paymentVoided     = "voided"     // the hold was released, the customer was never charged
+	paymentFailed     = "failed"     // the psp declined or the payment couldn't go through
+)
+
+var paymentTransitions = map[string][]string{
+	paymentCreated:    {paymentAuthorized, paymentFailed},
+	paymentAuthorized: {paymentCaptured, paymentVoided, paymentFailed},
+	paymentCaptured:   {paymentRefunded},
+}
+
+type payment struct {
+	PaymentID      int       `json:"payment_id" db:"paymentid"`
+	Paymentconf_id int       `json:"paymentconf_id" db:"paymentconf_id"`
+	UserID         int       `json:"user_id" db:"userid"`
+	ShowID         int       `json:"show_id" db:"showid"`
+	Amount         int64     `json:"amount" db:"amount"`
+	Currency       string    `json:"currency" db:"currency"`
+	Status         string    `json:"status" db:"status"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type paymentEvent struct {
+	FromStatus *string   `json:"from_status" db:"from_status"`
+	ToStatus   string    `json:"to_status" db:"to_status"`
+	Reason     string    `json:"reason" db:"reason"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+type paymentStatusRequest struct {
+	Userid         int `json:"user_id"`
+	Paymentconf_id int `json:"paymentconf_id"`
+}
+
+type refundRequest struct {
+	Userid         int    `json:"user_id"`
+	Paymentconf_id int    `json:"paymentconf_id"`
+	Reason         string `json:"reason"`
+}
+
+func canTransition(from string, to string) bool {
+	for _, next := range paymentTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Collisions of the 9 digit ids are rare, a few attempts is plenty
+const maxConfirmationAttempts = 5
+
+// Records a new payment in the created state along with its first event
+func createPayment(db *sqlx.DB, userid int, showid int, receipt *Receipt) (*payment, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("error creating DB transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	var p payment
+	for attempt := 0; p.PaymentID == 0; attempt++ {
+		if attempt == maxConfirmationAttempts {
+			return nil, fmt.Errorf("no unique payment confirmation id after %d attempts", maxConfirmationAttempts)
+		}
+
+		paymentconfID, err := generatePaymentConfirmationID()
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Get(&p, `
+			INSERT INTO Payment (Paymentconf_id, UserID, ShowID, Amount, Currency, Status)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (Paymentconf_id) DO NOTHING
+			RETURNING PaymentID, Paymentconf_id, UserID, ShowID, Amount, Currency, Status, Created_at, Updated_at`,
+			paymentconfID, userid, showid, receipt.Total, receipt.Currency, paymentCreated)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("payment insert error: %v", err)
+		}
+	}
+
+	err = logPaymentEvent(tx, p.PaymentID, nil, paymentCreated, "checkout started")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing payment: %v", err)
+	}
+
+	return &p, nil
+}
+
+// Moves the payment to the next state, refusing transitions the state machine
+// doesn't allow, the row is locked so concurrent transitions are serialized
+func transitionPayment(db *sqlx.DB, paymentID int, to string, reason string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error creating DB transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	from, err := transitionPaymentTx(tx, paymentID, to, reason)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing payment transition: %v", err)
+	}
+
+	log.Printf("Payment %d: %s -> %s (%s)", paymentID, from, to, reason)
+	return nil
+}
+
+// Same as transitionPayment inside the caller's transaction, returns the state
+// the payment left
+func transitionPaymentTx(tx *sqlx.Tx, paymentID int, to string, reason string) (string, error) {
+	var from string
+	err := tx.Get(&from, `SELECT Status FROM Payment WHERE PaymentID = $1 FOR UPDATE`, paymentID)
+	if err != nil {
+		return "", fmt.Errorf("payment %d lookup error: %v", paymentID, err)
+	}
+
+	if !canTransition(from, to) {
+		return "", fmt.Errorf("payment %d can't go from %s to %s", paymentID, from, to)
+	}
+
+	_, err = tx.Exec(`UPDATE Payment SET Status = $1, Updated_at = NOW() WHERE PaymentID = $2`, to, paymentID)
+	if err != nil {
+		return "", fmt.Errorf("payment update error: %v", err)
+	}
+
+	err = logPaymentEvent(tx, paymentID, &from, to, reason)
+	if err != nil {
+		return "", err
+	}
+
+	return from, nil
+}
+
+func logPaymentEvent(tx *sqlx.Tx, paymentID int, from *string, to string, reason string) error {
+	_, err := tx.Exec(`INSERT INTO PaymentEvent (PaymentID, From_status, To_status, Reason) VALUES ($1, $2, $3, $4)`,
+		paymentID, from, to, reason)
+	if err != nil {
+		return fmt.Errorf("payment event insert error: %v", err)
+	}
+	return nil
+}
+
+// Asks the psp to hold the amount on the customer's card
+func authorizePayment(db *sqlx.DB, p *payment) error {
+	//Simulating a psp authorization
+	time.Sleep(30 * time.Millisecond)
+
+	return transitionPayment(db, p.PaymentID, paymentAuthorized, "psp authorized the amount")
+}
+
+// Takes the held amount, only once the seats are booked
+func capturePayment(db *sqlx.DB, p *payment) error {
+	//Simulating a psp capture
+	time.Sleep(10 * time.Millisecond)
+
+	return transitionPayment(db, p.PaymentID, paymentCaptured, "seats booked, psp captured the amount")
+}
+
+// Releases the hold so the customer is never charged, logging rather than
+// failing since the caller is already reporting the original error
+func voidPayment(db *sqlx.DB, p *payment, reason string) {
+	//Simulating a psp void
+	time.Sleep(10 * time.Millisecond)
+
+	if err := transitionPayment(db, p.PaymentID, paymentVoided, reason); err != nil {
+		log.Printf("Error: payment %d not voided: %v", p.PaymentID, err)
+	}
+}
+
+// Gives a captured amount back to the customer and takes back what it paid
+// for, both or neither
+func refundPayment(db *sqlx.DB, p *payment, reason string) error {
+	//Simulating a psp refund
+	time.Sleep(10 * time.Millisecond)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error creating DB transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	from, err := refundPaymentTx(tx, p, reason)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing refund: %v", err)
+	}
+
+	log.Printf("Payment %d: %s -> %s (%s)", p.PaymentID, from, paymentRefunded, reason)
+	return nil
+}
+
+// Same as refundPayment inside the caller's transaction, returns the state the
+// payment left
+func refundPaymentTx(tx *sqlx.Tx, p *payment, reason string) (string, error) {
+	from, err := transitionPaymentTx(tx, p.PaymentID, paymentRefunded, reason)
+	if err != nil {
+		return "", err
+	}
+
+	err = voidRefundedOrder(tx, p.Paymentconf_id)
+	if err != nil {
+		return "", err
+	}
+
+	return from, nil
+}
+
+func getUserPayment(db *sqlx.DB, paymentconfID int, userid int) (*payment, error) {
+	var p payment
+	err := db.Get(&p, `
+		SELECT PaymentID, Paymentconf_id, UserID, ShowID, Amount, Currency, Status, Created_at, Updated_at
+		FROM Payment
+		WHERE Paymentconf_id = $1 AND UserID = $2`, paymentconfID, userid)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Refunds one of the user's captured payments and voids the order it paid for.
+// Only the orchestrator reaches it, to undo a purchase that can't complete.
+// Refunding twice is a no-op.
+func (app *Config) refundPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	var refundrequest refundRequest
+
+	err := json.NewDecoder(r.Body).Decode(&refundrequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse refund request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	p, err := getUserPayment(db, refundrequest.Paymentconf_id, refundrequest.Userid)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Error: Payment %d not found", refundrequest.Paymentconf_id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Payment lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if p.Status != paymentRefunded {
+		err = refundPayment(db, p, refundrequest.Reason)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: Refund failed: %v", err), http.StatusConflict)
+			return
+		}
+	}
+
+	writePaymentStatus(w, p.Paymentconf_id, paymentRefunded)
+}
+
+func writePaymentStatus(w http.ResponseWriter, paymentconfID int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"paymentconf_id": paymentconfID,
+		"status":         status,
+	})
+}
+
+// Tells the user where one of their payments stands and how it got there
+func (app *Config) paymentStatus(w http.ResponseWriter, r *http.Request) {
+	var statusrequest paymentStatusRequest
+
+	err := json.NewDecoder(r.Body).Decode(&statusrequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse payment status request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	p, err := getUserPayment(db, statusrequest.Paymentconf_id, statusrequest.Userid)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Error: Payment %d not found", statusrequest.Paymentconf_id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Payment lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var events []paymentEvent
+	err = db.Select(&events, `
+		SELECT From_status, To_status, Reason, Created_at
+		FROM PaymentEvent
+		WHERE PaymentID = $1
+		ORDER BY EventID`, p.PaymentID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Payment events lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"payment": p,
+		"charged": p.Status == paymentCaptured,
+		"events":  events,
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	statuses := []string{paymentCreated, paymentAuthorized, paymentCaptured, paymentRefunded, paymentVoided, paymentFailed}
+
+	// Every move a payment can make, anything else is refused
+	allowed := map[[2]string]bool{
+		{paymentCreated, paymentAuthorized}:  true,
+		{paymentCreated, paymentFailed}:      true,
+		{paymentAuthorized, paymentCaptured}: true,
+		{paymentAuthorized, paymentVoided}:   true,
+		{paymentAuthorized, paymentFailed}:   true,
+		{paymentCaptured, paymentRefunded}:   true,
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := allowed[[2]string{from, to}]
+			if got := canTransition(from, to); got != want {
+				t.Errorf("canTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		from string
+		to   string
+	}{
+		{"unknown from", "pending", paymentAuthorized},
+		{"unknown to", paymentCreated, "pending"},
+		{"empty from", "", paymentCreated},
+		{"case matters", "Created", paymentAuthorized},
+		{"capture without authorization", paymentCreated, paymentCaptured},
+		{"refund of a voided payment", paymentVoided, paymentRefunded},
+		{"refunded twice", paymentRefunded, paymentRefunded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if canTransition(tt.from, tt.to) {
+				t.Errorf("canTransition(%q, %q) = true, want false", tt.from, tt.to)
+			}
+		})
+	}
+}
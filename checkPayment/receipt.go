@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Used for venues that don't set their own currency
+const defaultCurrency = "USD"
+
+// Condition on a Reservation r that the booked seat is listed for resale,
+// such a seat is paid for like any claimed one
+const activeListing = `SELECT 1 FROM ResaleListing l WHERE l.SeatReservationID = r.SeatReservationID AND l.Status = 'active'`
+
+// One claimed seat on the receipt, price in minor units
+type receiptLine struct {
+	SeatID   string `json:"seat_id" db:"seatid"`
+	Category string `json:"category" db:"category"`
+	Price    int64  `json:"price" db:"claimed_price"`
+}
+
+// Itemized amounts of one order, every amount is in minor units of Currency
+type Receipt struct {
+	Currency   string        `json:"currency"`
+	Lines      []receiptLine `json:"lines"`
+	Subtotal   int64         `json:"subtotal"`
+	Discount   int64         `json:"discount"`
+	ServiceFee int64         `json:"service_fee"` // per ticket fee times the number of seats
+	BookingFee int64         `json:"booking_fee"` // flat fee per order
+	TaxRateBps int           `json:"tax_rate_bps"`
+	Tax        int64         `json:"tax"`
+	Total      int64         `json:"total"`
+}
+
+// Fees and tax rate configured on the venue of a show
+type venueFees struct {
+	Currency   string `db:"currency"`
+	BookingFee int64  `db:"booking_fee"`
+	ServiceFee int64  `db:"service_fee"`
+	TaxRateBps int    `db:"tax_rate_bps"`
+}
+
+// Builds the receipt from the prices locked in at claim time, every seat must
+// still be claimed by the user. The promo code is optional.
+func buildReceipt(db *sqlx.DB, showid int, userid int, seatIDs []string, promoCode string) (*Receipt, error) {
+	var seatReservationIDs []string
+	for _, seatID := range seatIDs {
+		seatReservationIDs = append(seatReservationIDs, "SH_"+strconv.Itoa(showid)+"_ST_"+seatID)
+	}
+
+	var claimed []struct {
+		receiptLine
+		Currency sql.NullString `db:"claimed_currency"`
+	}
+	err := db.Select(&claimed, `
+		SELECT s.SeatID, s.Category, r.Claimed_price, r.Claimed_currency
+		FROM Reservation r
+		JOIN Seat s ON r.SeatReservationID = 'SH_' || r.ShowID || '_ST_' || s.SeatID
+		WHERE r.SeatReservationID = ANY($1) AND r.ClaimedbyID = $2 AND r.Claimed_price IS NOT NULL
+			AND (r.Booked = FALSE OR EXISTS (`+activeListing+`))
+		ORDER BY s.SeatID`,
+		pq.Array(seatReservationIDs), userid)
+	if err != nil {
+		return nil, fmt.Errorf("claimed seats query error: %v", err)
+	}
+
+	if len(claimed) != len(seatReservationIDs) {
+		return nil, fmt.Errorf("seats %v of show %d aren't claimed by user %d", seatIDs, showid, userid)
+	}
+
+	var fees venueFees
+	err = db.Get(&fees, `
+		SELECT COALESCE(v.Currency, $2) AS currency, COALESCE(v.Booking_fee, 0) AS booking_fee,
+			COALESCE(v.Service_fee, 0) AS service_fee, COALESCE(v.Tax_rate_bps, 0) AS tax_rate_bps
+		FROM Show sh
+		LEFT JOIN Venue v ON v.VenueID = sh.VenueID
+		WHERE sh.ShowID = $1`, showid, defaultCurrency)
+	if err != nil {
+		return nil, fmt.Errorf("venue fees query error: %v", err)
+	}
+
+	receipt := Receipt{Currency: fees.Currency, TaxRateBps: fees.TaxRateBps}
+	for _, seat := range claimed {
+		// Fees are in the venue currency, a seat priced in another one can't be added up
+		if seat.Currency.Valid && seat.Currency.String != fees.Currency {
+			return nil, fmt.Errorf("seat %s was claimed in %s but the venue charges %s", seat.SeatID, seat.Currency.String, fees.Currency)
+		}
+		receipt.Lines = append(receipt.Lines, seat.receiptLine)
+		receipt.Subtotal += seat.Price
+	}
+
+	if promoCode != "" {
+		var resale bool
+		err = db.Get(&resale, `SELECT EXISTS (SELECT 1 FROM ResaleListing l WHERE l.SeatReservationID = ANY($1) AND l.Status = 'active')`,
+			pq.Array(seatReservationIDs))
+		if err != nil {
+			return nil, fmt.Errorf("resale listing query error: %v", err)
+		}
+		// The seller is paid the listing price, the discount would come out of nobody's pocket
+		if resale {
+			return nil, fmt.Errorf("promo codes don't apply to resale seats")
+		}
+
+		receipt.Discount, err = getVoucherDiscount(db, promoCode, userid, showid, receipt.Lines)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	receipt.addFeesAndTax(fees)
+
+	return &receipt, nil
+}
+
+// Adds the venue fees to the lines and discount already on the receipt, then
+// the tax on the lot
+func (receipt *Receipt) addFeesAndTax(fees venueFees) {
+	receipt.ServiceFee = fees.ServiceFee * int64(len(receipt.Lines))
+	receipt.BookingFee = fees.BookingFee
+	receipt.TaxRateBps = fees.TaxRateBps
+
+	// Tax is due on what the customer pays, fees included, rounded half up
+	taxable := receipt.Subtotal - receipt.Discount + receipt.ServiceFee + receipt.BookingFee
+	receipt.Tax = (taxable*int64(receipt.TaxRateBps) + 5000) / 10000
+	receipt.Total = taxable + receipt.Tax
+}
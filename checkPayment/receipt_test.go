@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestReceiptAddFeesAndTax(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    int
+		subtotal int64
+		discount int64
+		fees     venueFees
+		tax      int64
+		total    int64
+	}{
+		{"no fees or tax", 2, 10000, 0, venueFees{}, 0, 10000},
+		{"fees per seat and per order", 3, 15000, 0, venueFees{ServiceFee: 150, BookingFee: 200}, 0, 15650},
+		{"tax on the fees too", 1, 10000, 0, venueFees{ServiceFee: 100, BookingFee: 100, TaxRateBps: 2000}, 2040, 12240},
+		{"tax after the discount", 2, 10000, 2500, venueFees{TaxRateBps: 1000}, 750, 8250},
+		{"half a cent rounded up", 1, 1005, 0, venueFees{TaxRateBps: 1000}, 101, 1106},         // 100.5
+		{"under half a cent rounded down", 1, 1004, 0, venueFees{TaxRateBps: 1000}, 100, 1104}, // 100.4
+		{"fractional rate", 1, 999, 0, venueFees{TaxRateBps: 825}, 82, 1081},                   // 82.4175
+		{"fractional rate rounded up", 1, 1000, 0, venueFees{TaxRateBps: 825}, 83, 1083},       // 82.5
+		{"whole order discounted", 1, 5000, 5000, venueFees{BookingFee: 100, TaxRateBps: 2000}, 20, 120},
+		{"large order keeps every cent", 500, 250_000_000, 0, venueFees{TaxRateBps: 1975}, 49_375_000, 299_375_000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receipt := Receipt{Lines: make([]receiptLine, tt.lines), Subtotal: tt.subtotal, Discount: tt.discount}
+			receipt.addFeesAndTax(tt.fees)
+
+			if receipt.Tax != tt.tax || receipt.Total != tt.total {
+				t.Errorf("tax %d, total %d, want tax %d, total %d", receipt.Tax, receipt.Total, tt.tax, tt.total)
+			}
+			if receipt.ServiceFee != tt.fees.ServiceFee*int64(tt.lines) || receipt.BookingFee != tt.fees.BookingFee {
+				t.Errorf("service fee %d, booking fee %d, want %d, %d", receipt.ServiceFee, receipt.BookingFee, tt.fees.ServiceFee*int64(tt.lines), tt.fees.BookingFee)
+			}
+			if receipt.Total != receipt.Subtotal-receipt.Discount+receipt.ServiceFee+receipt.BookingFee+receipt.Tax {
+				t.Errorf("total %d doesn't add up: %+v", receipt.Total, receipt)
+			}
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Kinds of settlement lines in a PSP file
+const (
+	settlementCapture = "capture"
+	settlementRefund  = "refund"
+)
+
+// Kinds of discrepancies found by the reconciliation
+const (
+	issueMissingInPSP   = "missing_in_psp"  // we charged or refunded, the PSP didn't settle it
+	issueUnknownPayment = "unknown_payment" // the PSP settled a payment we have no record of
+	issueDuplicated     = "duplicated"      // the PSP settled the same payment more than once
+	issueAmountMismatch = "amount_mismatch" // settled amount or currency differs from ours
+	issueStatusMismatch = "status_mismatch" // settled but our payment isn't captured/refunded
+	issueMissingBooking = "missing_booking" // the payment was captured but no booking has its receipt
+)
+
+// One line of a PSP settlement file. CSV files have a header row with the
+// json names as columns, amounts are in minor units.
+type settlementRecord struct {
+	Paymentconf_id int       `json:"paymentconf_id"`
+	Type           string    `json:"type"`
+	Amount         int64     `json:"amount"`
+	Currency       string    `json:"currency"`
+	Reference      string    `json:"psp_reference"`
+	SettledAt      time.Time `json:"settled_at"`
+}
+
+type reconciliationIssue struct {
+	Kind           string `json:"kind"`
+	Paymentconf_id int    `json:"paymentconf_id"`
+	Detail         string `json:"detail"`
+}
+
+type reconciledPayment struct {
+	payment
+	Booked           bool `db:"booked"`
+	CapturedInWindow bool `db:"captured_in_window"`
+}
+
+// Compares a PSP settlement file with the stored payments and bookings, prints
+// the discrepancies and exits non-zero when there are any
+func runReconciliation(path string, format string, from string, to string) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open settlement file: %v", err)
+	}
+	defer file.Close()
+
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+
+	records, err := readSettlement(file, format)
+	if err != nil {
+		log.Fatalf("Failed to read settlement file: %v", err)
+	}
+
+	start, end, err := settlementWindow(records, from, to)
+	if err != nil {
+		log.Fatalf("Invalid reconciliation window: %v", err)
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %v", err)
+	}
+	defer db.Close()
+
+	payments, err := getReconciledPayments(db, records, start, end)
+	if err != nil {
+		log.Fatalf("Failed to load payments: %v", err)
+	}
+
+	issues := reconcile(records, payments)
+
+	fmt.Printf("Reconciled %d settlement lines against %d payments from %s to %s\n",
+		len(records), len(payments), start.Format(time.DateOnly), end.AddDate(0, 0, -1).Format(time.DateOnly))
+	for _, issue := range issues {
+		fmt.Printf("%-16s %8d  %s\n", issue.Kind, issue.Paymentconf_id, issue.Detail)
+	}
+	fmt.Printf("%d discrepancies\n", len(issues))
+
+	if len(issues) > 0 {
+		os.Exit(1)
+	}
+}
+
+func readSettlement(r io.Reader, format string) ([]settlementRecord, error) {
+	switch format {
+	case "json":
+		var records []settlementRecord
+		err := json.NewDecoder(r).Decode(&records)
+		return records, err
+	case "csv":
+		return readSettlementCSV(r)
+	}
+
+	return nil, fmt.Errorf("unknown settlement format %q, use csv or json", format)
+}
+
+func readSettlementCSV(r io.Reader) ([]settlementRecord, error) {
+	reader := csv.NewReader(r)
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range []string{"paymentconf_id", "type", "amount", "currency"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+
+	field := func(row []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	var records []settlementRecord
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var record settlementRecord
+		record.Paymentconf_id, err = strconv.Atoi(field(row, "paymentconf_id"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad paymentconf_id: %v", line, err)
+		}
+		record.Amount, err = strconv.ParseInt(field(row, "amount"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad amount: %v", line, err)
+		}
+		record.Type = field(row, "type")
+		record.Currency = field(row, "currency")
+		record.Reference = field(row, "psp_reference")
+		if settledAt := field(row, "settled_at"); settledAt != "" {
+			record.SettledAt, err = time.Parse(time.RFC3339, settledAt)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad settled_at: %v", line, err)
+			}
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// Our payments are checked for the dates the file covers, unless given explicitly
+func settlementWindow(records []settlementRecord, from string, to string) (time.Time, time.Time, error) {
+	var start, end time.Time
+	for _, record := range records {
+		if record.SettledAt.IsZero() {
+			continue
+		}
+		if start.IsZero() || record.SettledAt.Before(start) {
+			start = record.SettledAt
+		}
+		if record.SettledAt.After(end) {
+			end = record.SettledAt
+		}
+	}
+
+	var err error
+	if from != "" {
+		start, err = time.Parse(time.DateOnly, from)
+		if err != nil {
+			return start, end, err
+		}
+	}
+	if to != "" {
+		end, err = time.Parse(time.DateOnly, to)
+		if err != nil {
+			return start, end, err
+		}
+	}
+	if start.IsZero() || end.IsZero() {
+		return start, end, fmt.Errorf("the file has no settled_at dates, pass -from and -to")
+	}
+
+	// Whole days, the PSP settles what was captured up to the end of the day
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
+	end = time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, end.Location()).AddDate(0, 0, 1)
+
+	return start, end, nil
+}
+
+// Payments referenced by the file, plus the ones we captured or refunded in
+// the window, with whether a booking holds their receipt and whether they were
+// captured in the window
+func getReconciledPayments(db *sqlx.DB, records []settlementRecord, start time.Time, end time.Time) (map[int]reconciledPayment, error) {
+	ids := make([]int64, len(records))
+	for i, record := range records {
+		ids[i] = int64(record.Paymentconf_id)
+	}
+
+	var rows []reconciledPayment
+	err := db.Select(&rows, `
+		SELECT p.PaymentID, p.Paymentconf_id, p.UserID, p.ShowID, p.Amount, p.Currency, p.Status, p.Created_at, p.Updated_at,
+			EXISTS (SELECT 1 FROM Receipt r WHERE r.Paymentconf_id = p.Paymentconf_id) AS booked,
+			EXISTS (SELECT 1 FROM PaymentEvent e WHERE e.PaymentID = p.PaymentID AND e.To_status = $2
+				AND e.Created_at >= $4 AND e.Created_at < $5) AS captured_in_window
+		FROM Payment p
+		WHERE p.Paymentconf_id = ANY($1)
+			OR (p.Status IN ($2, $3) AND p.Updated_at >= $4 AND p.Updated_at < $5)`,
+		pq.Array(ids), paymentCaptured, paymentRefunded, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("payments query error: %v", err)
+	}
+
+	payments := make(map[int]reconciledPayment)
+	for _, row := range rows {
+		payments[row.Paymentconf_id] = row
+	}
+
+	return payments, nil
+}
+
+func reconcile(records []settlementRecord, payments map[int]reconciledPayment) []reconciliationIssue {
+	var issues []reconciliationIssue
+
+	settled := make(map[int]map[string]int)
+	for _, record := range records {
+		if settled[record.Paymentconf_id] == nil {
+			settled[record.Paymentconf_id] = make(map[string]int)
+		}
+		settled[record.Paymentconf_id][record.Type]++
+
+		if settled[record.Paymentconf_id][record.Type] == 2 {
+			issues = append(issues, reconciliationIssue{issueDuplicated, record.Paymentconf_id,
+				fmt.Sprintf("%s settled more than once (%s)", record.Type, record.Reference)})
+		}
+
+		p, ok := payments[record.Paymentconf_id]
+		if !ok {
+			issues = append(issues, reconciliationIssue{issueUnknownPayment, record.Paymentconf_id,
+				fmt.Sprintf("%s of %d %s (%s) has no payment", record.Type, record.Amount, record.Currency, record.Reference)})
+			continue
+		}
+
+		if record.Amount != p.Amount || record.Currency != p.Currency {
+			issues = append(issues, reconciliationIssue{issueAmountMismatch, record.Paymentconf_id,
+				fmt.Sprintf("%s settled %d %s, payment is %d %s", record.Type, record.Amount, record.Currency, p.Amount, p.Currency)})
+		}
+
+		switch record.Type {
+		case settlementCapture:
+			if p.Status != paymentCaptured && p.Status != paymentRefunded {
+				issues = append(issues, reconciliationIssue{issueStatusMismatch, record.Paymentconf_id,
+					fmt.Sprintf("capture settled but payment is %s", p.Status)})
+			}
+		case settlementRefund:
+			if p.Status != paymentRefunded {
+				issues = append(issues, reconciliationIssue{issueStatusMismatch, record.Paymentconf_id,
+					fmt.Sprintf("refund settled but payment is %s", p.Status)})
+			}
+		default:
+			issues = append(issues, reconciliationIssue{issueStatusMismatch, record.Paymentconf_id,
+				fmt.Sprintf("unknown settlement type %q", record.Type)})
+		}
+	}
+
+	for id, p := range payments {
+		// A refund settles in this file, the capture it undoes may have settled in an earlier one
+		captured := p.Status == paymentCaptured || (p.Status == paymentRefunded && p.CapturedInWindow)
+		if captured && settled[id][settlementCapture] == 0 {
+			issues = append(issues, reconciliationIssue{issueMissingInPSP, id,
+				fmt.Sprintf("captured %d %s, no capture settled", p.Amount, p.Currency)})
+		}
+		if p.Status == paymentRefunded && settled[id][settlementRefund] == 0 {
+			issues = append(issues, reconciliationIssue{issueMissingInPSP, id,
+				fmt.Sprintf("refunded %d %s, no refund settled", p.Amount, p.Currency)})
+		}
+		if p.Status == paymentCaptured && !p.Booked {
+			issues = append(issues, reconciliationIssue{issueMissingBooking, id,
+				fmt.Sprintf("captured %d %s for show %d, no booking", p.Amount, p.Currency, p.ShowID)})
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].Kind != issues[j].Kind {
+			return issues[i].Kind < issues[j].Kind
+		}
+		return issues[i].Paymentconf_id < issues[j].Paymentconf_id
+	})
+
+	return issues
+}
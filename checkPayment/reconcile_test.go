@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	paid := func(id int, status string, amount int64, booked bool) reconciledPayment {
+		return reconciledPayment{
+			payment:          payment{Paymentconf_id: id, ShowID: 7, Amount: amount, Currency: "EUR", Status: status},
+			Booked:           booked,
+			CapturedInWindow: true,
+		}
+	}
+	settle := func(id int, kind string, amount int64) settlementRecord {
+		return settlementRecord{Paymentconf_id: id, Type: kind, Amount: amount, Currency: "EUR", Reference: fmt.Sprintf("psp_%d_%s", id, kind)}
+	}
+
+	tests := []struct {
+		name     string
+		records  []settlementRecord
+		payments []reconciledPayment
+		want     []string // kind:paymentconf_id, in the order reported
+	}{
+		{
+			name:     "everything matches",
+			records:  []settlementRecord{settle(1, settlementCapture, 5000), settle(2, settlementCapture, 3000), settle(2, settlementRefund, 3000)},
+			payments: []reconciledPayment{paid(1, paymentCaptured, 5000, true), paid(2, paymentRefunded, 3000, true)},
+			want:     nil,
+		},
+		{
+			name:     "nothing at all",
+			records:  nil,
+			payments: nil,
+			want:     nil,
+		},
+		{
+			name:     "capture the PSP didn't settle",
+			records:  nil,
+			payments: []reconciledPayment{paid(1, paymentCaptured, 5000, true)},
+			want:     []string{"missing_in_psp:1"},
+		},
+		{
+			name:     "refund the PSP didn't settle",
+			records:  []settlementRecord{settle(1, settlementCapture, 5000)},
+			payments: []reconciledPayment{paid(1, paymentRefunded, 5000, true)},
+			want:     []string{"missing_in_psp:1"},
+		},
+		{
+			name:     "refund of a capture settled in an earlier file",
+			records:  []settlementRecord{settle(1, settlementRefund, 5000)},
+			payments: []reconciledPayment{{payment: payment{Paymentconf_id: 1, Amount: 5000, Currency: "EUR", Status: paymentRefunded}, Booked: true}},
+			want:     nil,
+		},
+		{
+			name:     "refund and capture in the same file, capture not settled",
+			records:  []settlementRecord{settle(1, settlementRefund, 5000)},
+			payments: []reconciledPayment{paid(1, paymentRefunded, 5000, true)},
+			want:     []string{"missing_in_psp:1"},
+		},
+		{
+			name:     "settled payment we don't know",
+			records:  []settlementRecord{settle(9, settlementCapture, 5000)},
+			payments: nil,
+			want:     []string{"unknown_payment:9"},
+		},
+		{
+			name:     "settled twice",
+			records:  []settlementRecord{settle(1, settlementCapture, 5000), settle(1, settlementCapture, 5000), settle(1, settlementCapture, 5000)},
+			payments: []reconciledPayment{paid(1, paymentCaptured, 5000, true)},
+			want:     []string{"duplicated:1"},
+		},
+		{
+			name:     "amount differs",
+			records:  []settlementRecord{settle(1, settlementCapture, 4999)},
+			payments: []reconciledPayment{paid(1, paymentCaptured, 5000, true)},
+			want:     []string{"amount_mismatch:1"},
+		},
+		{
+			name:     "currency differs",
+			records:  []settlementRecord{{Paymentconf_id: 1, Type: settlementCapture, Amount: 5000, Currency: "USD"}},
+			payments: []reconciledPayment{paid(1, paymentCaptured, 5000, true)},
+			want:     []string{"amount_mismatch:1"},
+		},
+		{
+			name:     "capture settled for a voided payment",
+			records:  []settlementRecord{settle(1, settlementCapture, 5000)},
+			payments: []reconciledPayment{paid(1, paymentVoided, 5000, false)},
+			want:     []string{"status_mismatch:1"},
+		},
+		{
+			name:     "refund settled but we didn't refund",
+			records:  []settlementRecord{settle(1, settlementCapture, 5000), settle(1, settlementRefund, 5000)},
+			payments: []reconciledPayment{paid(1, paymentCaptured, 5000, true)},
+			want:     []string{"status_mismatch:1"},
+		},
+		{
+			name:     "unknown settlement type",
+			records:  []settlementRecord{settle(1, settlementCapture, 5000), settle(1, "chargeback", 5000)},
+			payments: []reconciledPayment{paid(1, paymentCaptured, 5000, true)},
+			want:     []string{"status_mismatch:1"},
+		},
+		{
+			name:     "captured without a booking",
+			records:  []settlementRecord{settle(1, settlementCapture, 5000)},
+			payments: []reconciledPayment{paid(1, paymentCaptured, 5000, false)},
+			want:     []string{"missing_booking:1"},
+		},
+		{
+			name:     "refunded payments don't need a booking",
+			records:  []settlementRecord{settle(1, settlementCapture, 5000), settle(1, settlementRefund, 5000)},
+			payments: []reconciledPayment{paid(1, paymentRefunded, 5000, false)},
+			want:     nil,
+		},
+		{
+			name: "sorted by kind then payment",
+			records: []settlementRecord{
+				settle(4, settlementCapture, 100),
+				settle(3, settlementCapture, 100),
+				settle(1, settlementCapture, 100),
+			},
+			payments: []reconciledPayment{
+				paid(1, paymentCaptured, 200, true),
+				paid(2, paymentCaptured, 100, true),
+				paid(5, paymentCaptured, 100, true),
+			},
+			want: []string{"amount_mismatch:1", "missing_in_psp:2", "missing_in_psp:5", "unknown_payment:3", "unknown_payment:4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payments := make(map[int]reconciledPayment)
+			for _, p := range tt.payments {
+				payments[p.Paymentconf_id] = p
+			}
+
+			var got []string
+			for _, issue := range reconcile(tt.records, payments) {
+				got = append(got, fmt.Sprintf("%s:%d", issue.Kind, issue.Paymentconf_id))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("issues %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
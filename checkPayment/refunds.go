@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Status of an order whose payment was refunded, shared with bookSeat and Shows
+const orderRefunded = "refunded"
+
+// Picked up by outboxRelay, the seats given back are for sale again
+const eventBookingRefunded = "booking_refunded"
+
+type bookingRefundedEvent struct {
+	ShowID             int      `json:"show_id"`
+	UserID             int      `json:"user_id"`
+	SeatReservationIDs []string `json:"seatreservation_ids"` // released seats, resold seats go back to their seller
+	Seats              int      `json:"seats"`
+	Paymentconf_id     int      `json:"paymentconf_id"`
+	BookingReference   string   `json:"booking_reference"`
+}
+
+type refundedOrder struct {
+	Reference string         `db:"reference"`
+	ShowID    int            `db:"showid"`
+	UserID    int            `db:"userid"`
+	SeatIDs   pq.StringArray `db:"seat_ids"`
+}
+
+type soldListing struct {
+	ListingID         int    `db:"listingid"`
+	TicketID          string `db:"ticketid"`
+	SeatReservationID string `db:"seatreservationid"`
+	SellerID          int    `db:"sellerid"`
+	SellerReference   string `db:"seller_reference"`
+}
+
+// Undoes the booking paid with a refunded payment, in the refund transaction so
+// a refunded customer can't keep the seats: the order is marked refunded, its
+// tickets voided and its seats released. A seat bought on resale goes back to
+// its seller and the seller's payout is cancelled.
+func voidRefundedOrder(tx *sqlx.Tx, paymentconfID int) error {
+	var order refundedOrder
+	err := tx.Get(&order, `
+		SELECT Reference, ShowID, UserID, Seat_ids
+		FROM Orders
+		WHERE Paymentconf_id = $1 AND Status = 'confirmed'
+		FOR UPDATE`, paymentconfID)
+	if err != nil {
+		// The saga refunds payments that never got booked, there is nothing to undo
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return fmt.Errorf("order lookup error: %v", err)
+	}
+
+	var listings []soldListing
+	err = tx.Select(&listings, `
+		SELECT l.ListingID, l.TicketID, l.SeatReservationID, l.SellerID, t.Order_reference AS seller_reference
+		FROM ResaleListing l
+		JOIN Ticket t ON t.TicketID = l.TicketID
+		WHERE l.Order_reference = $1 AND l.Status = 'sold'
+		FOR UPDATE OF l`, order.Reference)
+	if err != nil {
+		return fmt.Errorf("resale lookup error: %v", err)
+	}
+
+	// Whoever holds the order's tickets now, the buyer or who they gave them to, loses them
+	_, err = tx.Exec(`
+		UPDATE ResaleListing SET Status = 'cancelled'
+		WHERE Status = 'active' AND TicketID IN (SELECT TicketID FROM Ticket WHERE Order_reference = $1)`, order.Reference)
+	if err != nil {
+		return fmt.Errorf("listing update error: %v", err)
+	}
+	_, err = tx.Exec(`
+		UPDATE TicketTransfer SET Status = 'cancelled', Responded_at = NOW()
+		WHERE Status = 'pending' AND TicketID IN (SELECT TicketID FROM Ticket WHERE Order_reference = $1)`, order.Reference)
+	if err != nil {
+		return fmt.Errorf("transfer update error: %v", err)
+	}
+	_, err = tx.Exec(`UPDATE Ticket SET Status = 'void' WHERE Order_reference = $1 AND Status = 'valid'`, order.Reference)
+	if err != nil {
+		return fmt.Errorf("ticket update error: %v", err)
+	}
+
+	resold := make(map[string]bool)
+	for _, listing := range listings {
+		resold[listing.SeatReservationID] = true
+
+		_, err = tx.Exec(`UPDATE Ticket SET Status = 'valid' WHERE TicketID = $1`, listing.TicketID)
+		if err != nil {
+			return fmt.Errorf("seller ticket update error: %v", err)
+		}
+		_, err = tx.Exec(`UPDATE Orders SET Seat_ids = array_append(Seat_ids, $1), Updated_at = NOW() WHERE Reference = $2`,
+			listing.SeatReservationID, listing.SellerReference)
+		if err != nil {
+			return fmt.Errorf("seller order update error: %v", err)
+		}
+		_, err = tx.Exec(`UPDATE Reservation SET BookedbyID = $1, Booking_confirmID = $2 WHERE SeatReservationID = $3`,
+			listing.SellerID, listing.SellerReference, listing.SeatReservationID)
+		if err != nil {
+			return fmt.Errorf("reservation update error: %v", err)
+		}
+		_, err = tx.Exec(`UPDATE ResaleListing SET Status = 'cancelled' WHERE ListingID = $1`, listing.ListingID)
+		if err != nil {
+			return fmt.Errorf("listing update error: %v", err)
+		}
+		_, err = tx.Exec(`UPDATE Payout SET Status = 'cancelled' WHERE ListingID = $1 AND Status = 'pending'`, listing.ListingID)
+		if err != nil {
+			return fmt.Errorf("payout update error: %v", err)
+		}
+	}
+
+	var released []string
+	for _, seatReservationID := range order.SeatIDs {
+		if !resold[seatReservationID] {
+			released = append(released, seatReservationID)
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE Reservation
+		SET Booked = FALSE, BookedbyID = NULL, Booking_confirmID = NULL, ClaimedbyID = NULL, last_claim = NULL,
+			Released_at = NOW()
+		WHERE SeatReservationID = ANY($1) AND Booking_confirmID = $2`, pq.Array(released), order.Reference)
+	if err != nil {
+		return fmt.Errorf("reservation release error: %v", err)
+	}
+
+	_, err = tx.Exec(`UPDATE Orders SET Status = $1, Updated_at = NOW() WHERE Reference = $2`, orderRefunded, order.Reference)
+	if err != nil {
+		return fmt.Errorf("order update error: %v", err)
+	}
+
+	data, err := json.Marshal(bookingRefundedEvent{
+		ShowID:             order.ShowID,
+		UserID:             order.UserID,
+		SeatReservationIDs: released,
+		Seats:              len(released),
+		Paymentconf_id:     paymentconfID,
+		BookingReference:   order.Reference,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %v", eventBookingRefunded, err)
+	}
+	_, err = tx.Exec(`INSERT INTO Outbox (Event_type, Aggregate_id, Payload) VALUES ($1, $2, $3)`,
+		eventBookingRefunded, order.ShowID, data)
+	if err != nil {
+		return fmt.Errorf("outbox insert error: %v", err)
+	}
+
+	return nil
+}
+
+// Refunds Shows queues when it cancels a show
+const (
+	refundPending  = "pending"
+	refundRefunded = "refunded"
+	refundFailed   = "failed" // the payment wasn't captured or doesn't match, support has a look
+)
+
+// How often the Refund table is checked for refunds to pay
+const refundQueueInterval = 10 * time.Second
+
+type queuedRefund struct {
+	RefundID       int    `db:"refundid"`
+	Paymentconf_id int    `db:"paymentconf_id"`
+	Amount         int64  `db:"amount"`
+	Currency       string `db:"currency"`
+}
+
+// Pays back, through the psp, the refunds Shows queues for the orders of a
+// cancelled show. Refunds without a payment, for seats booked before payments
+// were recorded, are left pending for support to pay back by hand.
+func runRefundQueue(db *sqlx.DB) {
+	for {
+		for {
+			done, err := processNextRefund(db)
+			if err != nil {
+				log.Printf("Error: refund queue: %v", err)
+				break
+			}
+			if done {
+				break
+			}
+		}
+
+		time.Sleep(refundQueueInterval)
+	}
+}
+
+// Refunds the payment of one pending refund and marks the refund, both or
+// neither. Returns true once there is nothing left to refund.
+func processNextRefund(db *sqlx.DB) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, fmt.Errorf("error creating DB transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	// Other instances skip the refund this one is paying
+	var refund queuedRefund
+	err = tx.Get(&refund, `
+		SELECT RefundID, Paymentconf_id, Amount, Currency
+		FROM Refund
+		WHERE Status = $1 AND Paymentconf_id IS NOT NULL
+		ORDER BY RefundID
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`, refundPending)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("refund lookup error: %v", err)
+	}
+
+	var p payment
+	err = tx.Get(&p, `
+		SELECT PaymentID, Paymentconf_id, UserID, ShowID, Amount, Currency, Status, Created_at, Updated_at
+		FROM Payment
+		WHERE Paymentconf_id = $1`, refund.Paymentconf_id)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("payment %d lookup error: %v", refund.Paymentconf_id, err)
+	}
+
+	status := refundRefunded
+	switch {
+	case err == sql.ErrNoRows || (p.Status != paymentCaptured && p.Status != paymentRefunded):
+		status = refundFailed
+		log.Printf("Error: refund %d: payment %d isn't captured, nothing to refund", refund.RefundID, refund.Paymentconf_id)
+	case p.Amount != refund.Amount || p.Currency != refund.Currency:
+		status = refundFailed
+		log.Printf("Error: refund %d of %d %s doesn't match payment %d of %d %s",
+			refund.RefundID, refund.Amount, refund.Currency, p.Paymentconf_id, p.Amount, p.Currency)
+	case p.Status == paymentCaptured:
+		//Simulating a psp refund
+		time.Sleep(10 * time.Millisecond)
+
+		_, err = refundPaymentTx(tx, &p, "show cancelled")
+		if err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE Refund SET Status = $1 WHERE RefundID = $2`, status, refund.RefundID)
+	if err != nil {
+		return false, fmt.Errorf("refund update error: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("error committing refund %d: %v", refund.RefundID, err)
+	}
+
+	log.Printf("Refund %d of payment %d: %s", refund.RefundID, refund.Paymentconf_id, status)
+	return false, nil
+}
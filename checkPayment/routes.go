@@ -3,6 +3,7 @@ package main
 import (
 	authmiddleware "checkPayment/auth"
 	"net/http"
+	"ratelimit"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -17,7 +18,7 @@ func (app *Config) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-TOKEN"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-TOKEN", "X-Admission-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300,
@@ -26,12 +27,26 @@ func (app *Config) routes() http.Handler {
 	//To check if service up or not
 	mux.Use(middleware.Heartbeat("/ping"))
 
-	//JWT middleware
-	mux.Use(authmiddleware.JWTMiddleware)
+	//Rate limits, per address before the token is even looked at, then per user
+	mux.Use(ratelimit.Middleware("checkpayment_ip", ratelimit.PerMinute(600), ratelimit.Unless(authmiddleware.FromService, ratelimit.ByIP)))
 
-	//Add route at root level
-	mux.Post("/checkPayment", app.checkPayment)
-	mux.Post("/AbouttoCheckout",app.AbouttoCheckout)
+	//Customer routes, JWT middleware
+	mux.Group(func(mux chi.Router) {
+		mux.Use(authmiddleware.JWTMiddleware)
+
+		mux.Use(ratelimit.Middleware("checkpayment_user", ratelimit.PerMinute(120), ratelimit.ByUser(authmiddleware.UserID)))
+
+		mux.Post("/checkPayment", app.checkPayment)
+		mux.Post("/AbouttoCheckout", app.AbouttoCheckout)
+		mux.Post("/paymentStatus", app.paymentStatus)
+	})
+
+	//Internal routes, only the orchestrator can call them
+	mux.Group(func(mux chi.Router) {
+		mux.Use(authmiddleware.ServiceMiddleware)
+
+		mux.Post("/internal/refundPayment", app.refundPaymentHandler)
+	})
 
 	return mux
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	voucherPercent = "percent" // Percent_bps, in basis points, is taken off the eligible seats
+	voucherFixed   = "fixed"   // Amount, in minor units, is taken off the eligible seats, never below zero
+)
+
+// Basis points in a whole
+const fullBps = 10000
+
+type voucher struct {
+	Code           string         `db:"code"`
+	Kind           string         `db:"kind"`
+	Amount         sql.NullInt64  `db:"amount"`
+	PercentBps     sql.NullInt64  `db:"percent_bps"`
+	ShowID         sql.NullInt64  `db:"showid"`
+	Category       sql.NullString `db:"category"`
+	MaxUses        sql.NullInt64  `db:"max_uses"`
+	MaxUsesPerUser sql.NullInt64  `db:"max_uses_per_user"`
+	UsedCount      int            `db:"used_count"`
+	ValidFrom      sql.NullTime   `db:"valid_from"`
+	ValidUntil     sql.NullTime   `db:"valid_until"`
+}
+
+// Validates the code for this user, show and receipt lines and returns the amount
+// it takes off the claimed price, in minor units. The usage limits are checked
+// again when bookSeat redeems the code, this check is only there to tell the user early.
+func getVoucherDiscount(db *sqlx.DB, code string, userid int, showid int, lines []receiptLine) (int64, error) {
+	var v voucher
+	err := db.Get(&v, `
+		SELECT Code, Kind, Amount, Percent_bps, ShowID, Category, Max_uses, Max_uses_per_user, Used_count, Valid_from, Valid_until
+		FROM Voucher
+		WHERE Code = $1`, strings.ToUpper(code))
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("promo code %s does not exist", code)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("voucher query error: %v", err)
+	}
+
+	now := time.Now()
+	if v.ValidFrom.Valid && now.Before(v.ValidFrom.Time) {
+		return 0, fmt.Errorf("promo code %s isn't valid yet", code)
+	}
+	if v.ValidUntil.Valid && now.After(v.ValidUntil.Time) {
+		return 0, fmt.Errorf("promo code %s has expired", code)
+	}
+	if v.ShowID.Valid && int(v.ShowID.Int64) != showid {
+		return 0, fmt.Errorf("promo code %s isn't valid for show %d", code, showid)
+	}
+	if v.MaxUses.Valid && v.UsedCount >= int(v.MaxUses.Int64) {
+		return 0, fmt.Errorf("promo code %s has been used up", code)
+	}
+
+	if v.MaxUsesPerUser.Valid {
+		var userUses int
+		err = db.Get(&userUses, `SELECT COUNT(*) FROM VoucherRedemption WHERE Code = $1 AND UserID = $2`, v.Code, userid)
+		if err != nil {
+			return 0, fmt.Errorf("voucher redemption query error: %v", err)
+		}
+		if userUses >= int(v.MaxUsesPerUser.Int64) {
+			return 0, fmt.Errorf("promo code %s has already been used the maximum number of times", code)
+		}
+	}
+
+	var eligible int64
+	for _, line := range lines {
+		if !v.Category.Valid || v.Category.String == line.Category {
+			eligible += line.Price
+		}
+	}
+	if eligible == 0 {
+		return 0, fmt.Errorf("promo code %s doesn't apply to any of the seats", code)
+	}
+
+	switch v.Kind {
+	case voucherPercent:
+		if !v.PercentBps.Valid || v.PercentBps.Int64 <= 0 || v.PercentBps.Int64 > fullBps {
+			return 0, fmt.Errorf("promo code %s has an invalid percentage", code)
+		}
+		// Rounded half up, in integers so large totals don't lose cents
+		return min((eligible*v.PercentBps.Int64+fullBps/2)/fullBps, eligible), nil
+	case voucherFixed:
+		if !v.Amount.Valid || v.Amount.Int64 <= 0 {
+			return 0, fmt.Errorf("promo code %s has an invalid amount", code)
+		}
+		return min(v.Amount.Int64, eligible), nil
+	}
+
+	return 0, fmt.Errorf("promo code %s has unknown kind %s", code, v.Kind)
+}
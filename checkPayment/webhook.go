@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Header carrying the signature of the payment data sent to bookSeat
+const webhookSignatureHeader = "X-Payment-Signature"
+
+// Shared with bookSeat, read at startup from PAYMENT_WEBHOOK_SECRET
+var webhookSecret []byte
+
+func loadWebhookSecret() {
+	secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Fatal("Error: PAYMENT_WEBHOOK_SECRET is not set")
+	}
+	webhookSecret = []byte(secret)
+}
+
+// Signs the body as "t=<unix seconds>,v1=<hex hmac-sha256 of t.body>", the
+// timestamp is part of the signed content so it can't be swapped for a newer one
+func signWebhookPayload(body []byte, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	mac := hmac.New(sha256.New, webhookSecret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
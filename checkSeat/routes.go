@@ -3,6 +3,7 @@ package main
 import (
 	authmiddleware "checkSeat/auth"
 	"net/http"
+	"ratelimit"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -26,6 +27,9 @@ func (app *Config) routes() http.Handler {
 	//To check if service up or not
 	mux.Use(middleware.Heartbeat("/ping"))
 
+	//Rate limit per address, the JWT middleware doesn't pass the user on
+	mux.Use(ratelimit.Middleware("checkseat_ip", ratelimit.PerMinute(600), ratelimit.ByIP))
+
 	//JWT authentication
 	mux.Use(authmiddleware.JWTMiddleware)
 
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq" // Import PostgreSQL driver
+	"github.com/lib/pq"
 )
 
 type ClaimSeatForm struct {
@@ -35,6 +37,18 @@ func (app *Config) HandleSeatClaim(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// On-sale behind the waiting room, only admitted users claim
+	err = checkAdmission(db, r.Header.Get(admissionHeader), claimseatform.ShowID, claimseatform.BookedbyID)
+	var denied *admissionError
+	if errors.As(err, &denied) {
+		http.Error(w, fmt.Sprintf("Error: Not admitted: %v", err), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Admission check failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	//Validation to check if show and seat match
 	err = checkClaim(db, claimseatform)
 	if err != nil {
@@ -43,15 +57,20 @@ func (app *Config) HandleSeatClaim(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//Send the request to the producer function
-	err = saveClaim(db, claimseatform)
+	prices, err := saveClaim(db, claimseatform)
 
+	var overLimit *limitError
+	if errors.As(err, &overLimit) {
+		http.Error(w, fmt.Sprintf("Error: Purchase limit reached: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error: Failed to claim the seat in DB: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, "Success: Seats %v for Show %v is claimed for user %v", claimseatform.SeatIDs, claimseatform.ShowID, claimseatform.BookedbyID)
+	fmt.Fprintf(w, "Success: Seats %v for Show %v is claimed for user %v at a total price of %s", claimseatform.SeatIDs, claimseatform.ShowID, claimseatform.BookedbyID, formatMinorUnits(prices.total(), prices.Currency))
 
 }
 
@@ -72,12 +91,12 @@ func checkClaim(db *sqlx.DB, claimseatform ClaimSeatForm) error {
 
 	// Check if show exists
 	var showExists bool
-	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM show WHERE showid = $1)`, claimseatform.ShowID).Scan(&showExists)
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM show WHERE showid = $1 AND status <> 'cancelled')`, claimseatform.ShowID).Scan(&showExists)
 	if err != nil {
 		return fmt.Errorf("ShowExists Error: %v", err)
 	}
 	if !showExists {
-		return fmt.Errorf("show with ID %d does not exist", claimseatform.ShowID)
+		return fmt.Errorf("show with ID %d does not exist or is cancelled", claimseatform.ShowID)
 	}
 
 	// log.Printf("DEBUG: showcheck done for show: %v", claimseatform.ShowID)
@@ -86,9 +105,23 @@ func checkClaim(db *sqlx.DB, claimseatform ClaimSeatForm) error {
 
 }
 
-func saveClaim(db *sqlx.DB, claimseatform ClaimSeatForm) error {
+// Active resale listing of a booked seat, all NULL when the seat isn't listed
+type resaleListing struct {
+	SellerID sql.NullInt64
+	Price    sql.NullInt64
+	Currency sql.NullString
+}
+
+// Claims the seats and locks in their current price, returns the price of each seat
+func saveClaim(db *sqlx.DB, claimseatform ClaimSeatForm) (*SeatPrices, error) {
 	log.Println("Inside ClaimSeat_saveClaim")
 
+	// Price seen by the user now is the price charged at checkout
+	prices, err := getSeatPrices(db, claimseatform.ShowID, claimseatform.SeatIDs)
+	if err != nil {
+		return nil, fmt.Errorf("pricing failed: %v", err)
+	}
+
 	// Create an array of seatReservationIDs
 	seatReservationIDs := make([]string, len(claimseatform.SeatIDs))
 	for i, seatID := range claimseatform.SeatIDs {
@@ -98,62 +131,111 @@ func saveClaim(db *sqlx.DB, claimseatform ClaimSeatForm) error {
 	// Begin a transaction
 	tx, err := db.Beginx()
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
 	}
 	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
 
+	err = checkClaimLimits(tx, claimseatform.ShowID, claimseatform.BookedbyID, seatReservationIDs)
+	if err != nil {
+		return nil, err
+	}
+
 	// Loop through each seatReservationID
-	for _, seatReservationID := range seatReservationIDs {
-		// Execute a SELECT statement with FOR UPDATE to lock the row
+	resaleSeats := 0
+	for i, seatReservationID := range seatReservationIDs {
+		// Execute a SELECT statement with FOR UPDATE to lock the row.
+		// A booked seat listed for resale can be claimed, at the listing price
 		var status string
+		var listing resaleListing
 		err = tx.QueryRowx(`
             SELECT 
                 CASE 
-                    WHEN Booked THEN 'Booked'
-                    WHEN last_claim >= NOW() - INTERVAL '1 minute' THEN 'Claimed'
+                    WHEN r.Booked AND l.ListingID IS NULL THEN 'Booked'
+                    WHEN r.last_claim >= NOW() - INTERVAL '1 minute' THEN 'Claimed'
+                    WHEN r.Held_until > NOW() AND r.Held_for IS DISTINCT FROM $2 THEN 'Held'
+                    WHEN r.Booked THEN 'Resale'
                     ELSE 'Available'
-                END AS status
-            FROM Reservation
-            WHERE SeatReservationID = $1
-            FOR UPDATE`, seatReservationID).Scan(&status)
+                END AS status,
+                l.SellerID, l.Price, l.Currency
+            FROM Reservation r
+            LEFT JOIN ResaleListing l ON l.SeatReservationID = r.SeatReservationID AND l.Status = 'active'
+            WHERE r.SeatReservationID = $1
+            FOR UPDATE OF r`, seatReservationID, claimseatform.BookedbyID).Scan(&status, &listing.SellerID, &listing.Price, &listing.Currency)
 
 		if err != nil {
 			// Rollback the transaction and return error
 			tx.Rollback()
-			return fmt.Errorf("error querying seat availability: %v", err)
+			return nil, fmt.Errorf("error querying seat availability: %v", err)
 		}
 
 		log.Printf("Seat %s availability status: %s", seatReservationID, status)
 
 		if status == "Booked" {
-			return fmt.Errorf("the seats for Show %v are not available, already booked", claimseatform.ShowID)
+			return nil, fmt.Errorf("the seats for Show %v are not available, already booked", claimseatform.ShowID)
 		} else if status == "Claimed" {
-			return fmt.Errorf("seats %v for Show %v are claimed by another user", claimseatform.SeatIDs, claimseatform.ShowID)
+			return nil, fmt.Errorf("seats %v for Show %v are claimed by another user", claimseatform.SeatIDs, claimseatform.ShowID)
+		} else if status == "Held" {
+			return nil, fmt.Errorf("seat %s for Show %v is held for someone on the waitlist", claimseatform.SeatIDs[i], claimseatform.ShowID)
+		} else if status == "Resale" {
+			if int(listing.SellerID.Int64) == claimseatform.BookedbyID {
+				return nil, fmt.Errorf("seat %s is listed for resale by you", claimseatform.SeatIDs[i])
+			}
+			if listing.Currency.String != prices.Currency {
+				return nil, fmt.Errorf("seat %s is listed in %s but the venue charges %s", claimseatform.SeatIDs[i], listing.Currency.String, prices.Currency)
+			}
+			prices.Prices[claimseatform.SeatIDs[i]] = listing.Price.Int64
+			resaleSeats++
+		}
+
+		// bookSeat books resale seats as an order of their own
+		if resaleSeats > 0 && resaleSeats != i+1 {
+			return nil, fmt.Errorf("resale seats have to be claimed on their own")
 		}
 
 		// Update the reservation row
 		_, err = tx.Exec(`
             UPDATE Reservation 
-            SET ClaimedbyID = $1, last_claim = NOW() 
+            SET ClaimedbyID = $1, last_claim = NOW(), Claimed_price = $3, Claimed_currency = $4, Held_for = NULL, Held_until = NULL
             WHERE SeatReservationID = $2`,
-			claimseatform.BookedbyID, seatReservationID)
+			claimseatform.BookedbyID, seatReservationID, prices.Prices[claimseatform.SeatIDs[i]], prices.Currency)
 
 		if err != nil {
 			// Rollback the transaction and return error
 			tx.Rollback()
-			return fmt.Errorf("update claim query failed for SeatReservationID: %s - %v", seatReservationID, err)
+			return nil, fmt.Errorf("update claim query failed for SeatReservationID: %s - %v", seatReservationID, err)
 		}
 
 		log.Printf("Claim saved for SeatReservationID: %s", seatReservationID)
 	}
 
+	// Claiming seats offered from the waitlist takes up the offer
+	_, err = tx.Exec(`
+		UPDATE WaitlistEntry
+		SET Status = $1
+		WHERE ShowID = $2 AND UserID = $3 AND Status = $4 AND Offered_seats && $5`,
+		waitlistClaimed, claimseatform.ShowID, claimseatform.BookedbyID, waitlistOffered, pq.Array(seatReservationIDs))
+	if err != nil {
+		return nil, fmt.Errorf("waitlist update failed: %v", err)
+	}
+
+	err = writeOutboxEvent(tx, eventSeatClaimed, claimseatform.ShowID, seatClaimedEvent{
+		ShowID:   claimseatform.ShowID,
+		UserID:   claimseatform.BookedbyID,
+		SeatIDs:  claimseatform.SeatIDs,
+		Currency: prices.Currency,
+		Prices:   prices.Prices,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	// Commit the transaction if all updates are successful
 	if err := tx.Commit(); err != nil {
 		// Rollback the transaction if commit fails
 		tx.Rollback()
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
 	log.Println("Claims saved to database")
-	return nil
+	return prices, nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Purchase limits of a show, NULL for no limit
+type purchaseLimits struct {
+	MaxPerOrder sql.NullInt64 `db:"max_seats_per_order"`
+	MaxPerUser  sql.NullInt64 `db:"max_seats_per_user"`
+	MaxHeld     sql.NullInt64 `db:"max_held_seats"`
+}
+
+// The claim goes over one of the show's purchase limits
+type limitError struct {
+	Reason string
+}
+
+func (e *limitError) Error() string {
+	return e.Reason
+}
+
+// Checks the claim against the limits of the show. Claims and bookings of one
+// user on one show take the same advisory lock first, so two of them running
+// side by side can't both fit under a limit only one of them fits under.
+func checkClaimLimits(tx *sqlx.Tx, showID int, userID int, seatReservationIDs []string) error {
+	var limits purchaseLimits
+	err := tx.Get(&limits, `SELECT Max_seats_per_order, Max_seats_per_user, Max_held_seats FROM Show WHERE ShowID = $1`, showID)
+	if err != nil {
+		return fmt.Errorf("purchase limits query error: %v", err)
+	}
+
+	if !limits.MaxPerOrder.Valid && !limits.MaxPerUser.Valid && !limits.MaxHeld.Valid {
+		return nil
+	}
+
+	if limits.MaxPerOrder.Valid && len(seatReservationIDs) > int(limits.MaxPerOrder.Int64) {
+		return &limitError{Reason: fmt.Sprintf("at most %d seats per order for show %d", limits.MaxPerOrder.Int64, showID)}
+	}
+
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock($1, $2)`, showID, userID)
+	if err != nil {
+		return fmt.Errorf("purchase limits lock error: %v", err)
+	}
+
+	// Seats the user has booked, and seats they claimed on top of the ones asked for now
+	var booked, held int
+	err = tx.QueryRow(`
+		SELECT
+			COUNT(*) FILTER (WHERE Booked AND BookedbyID = $2),
+			COUNT(*) FILTER (WHERE ClaimedbyID = $2 AND last_claim >= NOW() - INTERVAL '1 minute' AND (Booked IS NOT TRUE OR BookedbyID <> ClaimedbyID))
+		FROM Reservation
+		WHERE ShowID = $1 AND NOT (SeatReservationID = ANY($3))`,
+		showID, userID, pq.Array(seatReservationIDs)).Scan(&booked, &held)
+	if err != nil {
+		return fmt.Errorf("purchase limits count error: %v", err)
+	}
+
+	if limits.MaxHeld.Valid && held+len(seatReservationIDs) > int(limits.MaxHeld.Int64) {
+		return &limitError{Reason: fmt.Sprintf("at most %d seats can be claimed at once for show %d, you already claimed %d", limits.MaxHeld.Int64, showID, held)}
+	}
+	if limits.MaxPerUser.Valid && booked+held+len(seatReservationIDs) > int(limits.MaxPerUser.Int64) {
+		return &limitError{Reason: fmt.Sprintf("at most %d seats per user for show %d, you already have %d", limits.MaxPerUser.Int64, showID, booked+held)}
+	}
+
+	return nil
+}
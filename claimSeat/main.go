@@ -1,9 +1,11 @@
 package main
 
 import (
+	authmiddleware "claimseat/auth"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 )
 
 const webPort = "8090"
@@ -13,7 +15,16 @@ type Config struct {
 
 const pgConnectionString = "host=localhost port=5432 user=rayanc dbname=tickets sslmode=disable"
 
+// How often freed seats are offered to the waitlists
+const waitlistInterval = 15 * time.Second
+
 func main() {
+	// Only requests carrying the orchestrator's service token skip the address rate limit
+	authmiddleware.LoadServiceSecret()
+
+	// Admission tokens from the waiting room are checked with the shared secret
+	loadAdmissionSecret()
+
 	app := Config{}
 
 	log.Printf("Starting ClaimSeat service on port: %s", webPort)
@@ -25,12 +36,15 @@ func main() {
 	}
 
 	//DB connection check
-	_, err := ConnectToDB()
+	db, err := ConnectToDB()
 	if err != nil {
 		log.Fatalf("Error: DB connection %v", err)
 		return
 	}
 
+	// Seats that free up are held for waitlisted users in the background
+	go offerWaitlistSeats(db, waitlistInterval)
+
 	//Start the web server
 	err = srv.ListenAndServe()
 
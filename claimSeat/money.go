@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Used for venues that don't set their own currency
+const defaultCurrency = "USD"
+
+// ISO 4217 currencies whose minor unit isn't a hundredth
+var currencyExponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+	"CLP": 0,
+	"ISK": 0,
+	"BHD": 3,
+	"KWD": 3,
+	"JOD": 3,
+	"OMR": 3,
+	"TND": 3,
+}
+
+func currencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// Converts a price in major units (Seat.Price) to minor units of the currency
+func toMinorUnits(amount float64, currency string) int64 {
+	return int64(math.Round(amount * math.Pow10(currencyExponent(currency))))
+}
+
+// Formats minor units for humans, e.g. 1250 EUR as "12.50 EUR"
+func formatMinorUnits(amount int64, currency string) string {
+	exponent := currencyExponent(currency)
+	major := float64(amount) / math.Pow10(exponent)
+	return fmt.Sprintf("%s %s", strconv.FormatFloat(major, 'f', exponent, 64), currency)
+}
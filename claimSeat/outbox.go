@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Seats were claimed at the prices shown to the user
+const eventSeatClaimed = "seat_claimed"
+
+type seatClaimedEvent struct {
+	ShowID   int              `json:"show_id"`
+	UserID   int              `json:"user_id"`
+	SeatIDs  []string         `json:"seat_ids"`
+	Currency string           `json:"currency"`
+	Prices   map[string]int64 `json:"prices"`
+}
+
+// Adds the event to the Outbox in the caller's transaction, outboxRelay publishes it
+func writeOutboxEvent(tx *sqlx.Tx, eventType string, aggregateID int, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %v", eventType, err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO Outbox (Event_type, Aggregate_id, Payload) VALUES ($1, $2, $3)`,
+		eventType, aggregateID, data)
+	if err != nil {
+		return fmt.Errorf("outbox insert error: %v", err)
+	}
+
+	return nil
+}
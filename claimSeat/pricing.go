@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+// Kinds of price rules, set per show from the Shows service
+const (
+	ruleEarlyBird  = "early_bird"  // applies until Hours_before the show starts
+	ruleLastMinute = "last_minute" // applies from Hours_before the show starts
+	ruleDemand     = "demand"      // applies once the share of seats left drops below Seats_left_below
+)
+
+type priceRule struct {
+	Category       *string  `db:"category"`
+	Kind           string   `db:"kind"`
+	HoursBefore    *int     `db:"hours_before"`
+	SeatsLeftBelow *float64 `db:"seats_left_below"`
+	Percent        float64  `db:"percent"`
+}
+
+// Everything needed to price the seats of one show at one moment
+type pricingContext struct {
+	Now       time.Time
+	Starttime time.Time
+	Capacity  int
+	SeatsLeft int
+	Currency  string
+	Rules     []priceRule
+}
+
+type seatPrice struct {
+	Category  string        `db:"category"`
+	TierPrice sql.NullInt64 `db:"price_minor"`
+	SeatPrice float64       `db:"price"`
+}
+
+// Prices of a set of seats in minor units of the venue currency
+type SeatPrices struct {
+	Currency string           `json:"currency"`
+	Prices   map[string]int64 `json:"prices"`
+}
+
+func (s *SeatPrices) total() int64 {
+	var total int64
+	for _, price := range s.Prices {
+		total += price
+	}
+
+	return total
+}
+
+type PriceQuery struct {
+	SeatIDs []string `json:"seat_ids"`
+	ShowID  int      `json:"show_id"`
+}
+
+// Shows the current prices of seats, the price is only locked by claiming them
+func (app *Config) HandlePriceQuote(w http.ResponseWriter, r *http.Request) {
+
+	var pricequery PriceQuery
+
+	err := json.NewDecoder(r.Body).Decode(&pricequery)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse price query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	prices, err := getSeatPrices(db, pricequery.ShowID, pricequery.SeatIDs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Price quote failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"show_id":  pricequery.ShowID,
+		"currency": prices.Currency,
+		"prices":   prices.Prices,
+		"total":    prices.total(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Current price of each seat: the show's tier price for the seat category (or
+// the seat's own price when the show has no tier for it) adjusted by the rules
+func getSeatPrices(db *sqlx.DB, showID int, seatIDs []string) (*SeatPrices, error) {
+	pricing, err := getPricingContext(db, showID)
+	if err != nil {
+		return nil, err
+	}
+
+	prices := SeatPrices{Currency: pricing.Currency, Prices: make(map[string]int64)}
+	for _, seatID := range seatIDs {
+		var seat seatPrice
+		err := db.Get(&seat, `
+			SELECT s.Category, t.Price_minor, COALESCE(s.Price, 0) AS price
+			FROM Seat s
+			LEFT JOIN PriceTier t ON t.ShowID = $2 AND t.Category = s.Category
+			WHERE s.SeatID = $1`, seatID, showID)
+		if err != nil {
+			return nil, fmt.Errorf("SeatPrice Error for seat %s: %v", seatID, err)
+		}
+
+		basePrice := toMinorUnits(seat.SeatPrice, pricing.Currency)
+		if seat.TierPrice.Valid {
+			basePrice = seat.TierPrice.Int64
+		}
+
+		prices.Prices[seatID] = pricing.apply(seat.Category, basePrice)
+	}
+
+	return &prices, nil
+}
+
+func getPricingContext(db *sqlx.DB, showID int) (*pricingContext, error) {
+	pricing := pricingContext{Now: time.Now()}
+
+	err := db.QueryRow(`
+		SELECT sh.Time_start, sh.totalcapacity, COALESCE(v.Currency, $2)
+		FROM Show sh
+		LEFT JOIN Venue v ON v.VenueID = sh.VenueID
+		WHERE sh.ShowID = $1`, showID, defaultCurrency).Scan(&pricing.Starttime, &pricing.Capacity, &pricing.Currency)
+	if err != nil {
+		return nil, fmt.Errorf("ShowPricing Error: %v", err)
+	}
+
+	err = db.Select(&pricing.Rules, `
+		SELECT Category, Kind, Hours_before, Seats_left_below, Percent
+		FROM PriceRule
+		WHERE ShowID = $1
+		ORDER BY RuleID`, showID)
+	if err != nil {
+		return nil, fmt.Errorf("PriceRule Error: %v", err)
+	}
+
+	// Without a counter there is no demand information, price as if the show was empty
+	pricing.SeatsLeft, err = getSeatsLeft(showID)
+	if err == redis.Nil {
+		pricing.SeatsLeft = pricing.Capacity
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &pricing, nil
+}
+
+// Applies every matching rule on top of the base price, rounded to the minor unit
+func (p *pricingContext) apply(category string, basePrice int64) int64 {
+	price := float64(basePrice)
+
+	for _, rule := range p.Rules {
+		if rule.Category != nil && *rule.Category != category {
+			continue
+		}
+
+		if p.matches(rule) {
+			price = price * (1 + rule.Percent/100)
+		}
+	}
+
+	return int64(math.Round(price))
+}
+
+func (p *pricingContext) matches(rule priceRule) bool {
+	switch rule.Kind {
+	case ruleEarlyBird:
+		if rule.HoursBefore == nil {
+			return false
+		}
+		return p.Now.Before(p.Starttime.Add(-time.Duration(*rule.HoursBefore) * time.Hour))
+	case ruleLastMinute:
+		if rule.HoursBefore == nil {
+			return false
+		}
+		return !p.Now.Before(p.Starttime.Add(-time.Duration(*rule.HoursBefore) * time.Hour))
+	case ruleDemand:
+		if rule.SeatsLeftBelow == nil || p.Capacity <= 0 {
+			return false
+		}
+		return float64(p.SeatsLeft)/float64(p.Capacity) < *rule.SeatsLeftBelow
+	}
+
+	return false
+}
+
+func getSeatsLeft(showID int) (int, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	defer rdb.Close()
+
+	// Context for the Redis operations.
+	ctx := context.Background()
+
+	seatsLeft, err := rdb.Get(ctx, strconv.Itoa(showID)).Int()
+	if err == redis.Nil {
+		return -1, err
+	}
+	if err != nil {
+		return -1, fmt.Errorf("error getting seatsLeft from Redis: %v", err)
+	}
+
+	return seatsLeft, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPricingContextApply(t *testing.T) {
+	start := time.Date(2024, 6, 1, 20, 0, 0, 0, time.UTC)
+	hours := func(h int) *int { return &h }
+	share := func(s float64) *float64 { return &s }
+	category := func(c string) *string { return &c }
+
+	earlyBird := priceRule{Kind: ruleEarlyBird, HoursBefore: hours(48), Percent: -20}
+	lastMinute := priceRule{Kind: ruleLastMinute, HoursBefore: hours(2), Percent: 10}
+	demand := priceRule{Kind: ruleDemand, SeatsLeftBelow: share(0.25), Percent: 50}
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		seatsLeft int
+		capacity  int
+		rules     []priceRule
+		category  string
+		base      int64
+		want      int64
+	}{
+		{"no rules", start.Add(-time.Hour), 50, 100, nil, "STANDARD", 5000, 5000},
+		{"early bird before the cut off", start.Add(-72 * time.Hour), 50, 100, []priceRule{earlyBird}, "STANDARD", 5000, 4000},
+		{"early bird at the cut off", start.Add(-48 * time.Hour), 50, 100, []priceRule{earlyBird}, "STANDARD", 5000, 5000},
+		{"early bird after the cut off", start.Add(-24 * time.Hour), 50, 100, []priceRule{earlyBird}, "STANDARD", 5000, 5000},
+		{"last minute before the window", start.Add(-3 * time.Hour), 50, 100, []priceRule{lastMinute}, "STANDARD", 5000, 5000},
+		{"last minute at the window", start.Add(-2 * time.Hour), 50, 100, []priceRule{lastMinute}, "STANDARD", 5000, 5500},
+		{"demand below the share", start.Add(-24 * time.Hour), 24, 100, []priceRule{demand}, "STANDARD", 5000, 7500},
+		{"demand at the share", start.Add(-24 * time.Hour), 25, 100, []priceRule{demand}, "STANDARD", 5000, 5000},
+		{"demand without capacity", start.Add(-24 * time.Hour), 0, 0, []priceRule{demand}, "STANDARD", 5000, 5000},
+		{
+			"rule for another category",
+			start.Add(-72 * time.Hour), 50, 100,
+			[]priceRule{{Category: category("VIP"), Kind: ruleEarlyBird, HoursBefore: hours(48), Percent: -20}},
+			"STANDARD", 5000, 5000,
+		},
+		{
+			"rule for the category",
+			start.Add(-72 * time.Hour), 50, 100,
+			[]priceRule{{Category: category("VIP"), Kind: ruleEarlyBird, HoursBefore: hours(48), Percent: -20}},
+			"VIP", 5000, 4000,
+		},
+		{"rules stack", start.Add(-time.Hour), 10, 100, []priceRule{lastMinute, demand}, "STANDARD", 5000, 8250},
+		{"rounded to the minor unit", start.Add(-72 * time.Hour), 50, 100, []priceRule{{Kind: ruleEarlyBird, HoursBefore: hours(48), Percent: -15}}, "STANDARD", 999, 849},
+		{"half rounded away from zero", start.Add(-24 * time.Hour), 10, 100, []priceRule{demand}, "STANDARD", 333, 500},
+		{"rule without hours never applies", start.Add(-72 * time.Hour), 50, 100, []priceRule{{Kind: ruleEarlyBird, Percent: -20}}, "STANDARD", 5000, 5000},
+		{"unknown kind never applies", start.Add(-72 * time.Hour), 10, 100, []priceRule{{Kind: "flash_sale", Percent: -90}}, "STANDARD", 5000, 5000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pricing := pricingContext{
+				Now:       tt.now,
+				Starttime: start,
+				Capacity:  tt.capacity,
+				SeatsLeft: tt.seatsLeft,
+				Currency:  "EUR",
+				Rules:     tt.rules,
+			}
+
+			if got := pricing.apply(tt.category, tt.base); got != tt.want {
+				t.Errorf("apply(%q, %d) = %d, want %d", tt.category, tt.base, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Gives claimed seats back before the claim expires, used by the orchestrator
+// to undo a claim when a later step of the purchase fails. Releasing seats that
+// are no longer claimed by the user is a no-op so the call can be retried.
+func (app *Config) HandleReleaseClaim(w http.ResponseWriter, r *http.Request) {
+	log.Println("DEBUG: Inside claimSeat_HandleReleaseClaim ")
+
+	var claimseatform ClaimSeatForm
+
+	//Read the request payload
+	err := json.NewDecoder(r.Body).Decode(&claimseatform)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse release form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	released, err := releaseClaim(db, claimseatform)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to release the claim in DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Success: %d of seats %v for Show %v released by user %v", released, claimseatform.SeatIDs, claimseatform.ShowID, claimseatform.BookedbyID)
+}
+
+func releaseClaim(db *sqlx.DB, claimseatform ClaimSeatForm) (int64, error) {
+	seatReservationIDs := make([]string, len(claimseatform.SeatIDs))
+	for i, seatID := range claimseatform.SeatIDs {
+		seatReservationIDs[i] = "SH_" + strconv.Itoa(claimseatform.ShowID) + "_ST_" + seatID
+	}
+
+	// Booked seats are never touched, the claim only matters until the booking
+	result, err := db.Exec(`
+		UPDATE Reservation
+		SET ClaimedbyID = NULL, last_claim = NULL, Claimed_price = NULL, Claimed_currency = NULL, Released_at = NOW()
+		WHERE SeatReservationID = ANY($1) AND ClaimedbyID = $2 AND Booked IS NOT TRUE`,
+		pq.Array(seatReservationIDs), claimseatform.BookedbyID)
+	if err != nil {
+		return 0, fmt.Errorf("release claim query failed: %v", err)
+	}
+
+	released, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("release claim result: %v", err)
+	}
+
+	log.Printf("Released %d claims of user %d for show %d", released, claimseatform.BookedbyID, claimseatform.ShowID)
+	return released, nil
+}
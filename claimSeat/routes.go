@@ -3,6 +3,7 @@ package main
 import (
 	authmiddleware "claimseat/auth"
 	"net/http"
+	"ratelimit"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -17,7 +18,7 @@ func (app *Config) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-TOKEN"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-TOKEN", "X-Admission-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300,
@@ -26,11 +27,23 @@ func (app *Config) routes() http.Handler {
 	//To check if service up or not
 	mux.Use(middleware.Heartbeat("/ping"))
 
+	//Rate limits, per address before the token is even looked at, then per user
+	mux.Use(ratelimit.Middleware("claimseat_ip", ratelimit.PerMinute(600), ratelimit.Unless(authmiddleware.FromService, ratelimit.ByIP)))
+
 	//JWT middleware
 	mux.Use(authmiddleware.JWTMiddleware)
 
+	mux.Use(ratelimit.Middleware("claimseat_user", ratelimit.PerMinute(120), ratelimit.ByUser(authmiddleware.UserID)))
+
 	//Add route at root level
-	mux.Post("/claimSeat", app.HandleSeatClaim)
+	mux.With(ratelimit.Middleware("claimseat_claim", ratelimit.PerMinute(20), ratelimit.ByUser(authmiddleware.UserID))).Post("/claimSeat", app.HandleSeatClaim)
+	mux.Post("/quotePrice", app.HandlePriceQuote)
+	mux.Post("/releaseClaim", app.HandleReleaseClaim)
+
+	//Waitlist for shows without seats left
+	mux.Post("/joinWaitlist", app.HandleJoinWaitlist)
+	mux.Post("/waitlistStatus", app.HandleWaitlistStatus)
+	mux.Post("/leaveWaitlist", app.HandleLeaveWaitlist)
 
 	return mux
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Statuses of a waitlist entry, offers are made to waiting entries in the order they joined
+const (
+	waitlistWaiting = "waiting"
+	waitlistOffered = "offered" // seats are held for the user until Offer_expires_at
+	waitlistClaimed = "claimed" // the user claimed the seats held for them
+	waitlistExpired = "expired" // the offer wasn't taken up in time
+	waitlistLeft    = "left"
+	waitlistClosed  = "closed" // the show was cancelled or has started
+)
+
+// How long offered seats are held for the waitlisted user alone
+const waitlistHoldDuration = 10 * time.Minute
+
+// Largest party one entry can ask seats for
+const maxPartySize = 10
+
+type WaitlistForm struct {
+	ShowID    int     `json:"show_id"`
+	Userid    int     `json:"user_id"`
+	PartySize int     `json:"party_size"`
+	Category  *string `json:"category"` // nil takes seats of any category
+}
+
+type waitlistEntry struct {
+	EntryID        int            `json:"entry_id" db:"entryid"`
+	ShowID         int            `json:"show_id" db:"showid"`
+	UserID         int            `json:"user_id" db:"userid"`
+	PartySize      int            `json:"party_size" db:"party_size"`
+	Category       *string        `json:"category" db:"category"`
+	Status         string         `json:"status" db:"status"`
+	OfferedSeats   pq.StringArray `json:"offered_seats,omitempty" db:"offered_seats"`
+	OfferExpiresAt *time.Time     `json:"offer_expires_at,omitempty" db:"offer_expires_at"`
+	CreatedAt      time.Time      `json:"created_at" db:"created_at"`
+	Position       int            `json:"position,omitempty" db:"-"` // 1 for the next to be offered seats
+}
+
+const waitlistColumns = `EntryID, ShowID, UserID, Party_size, Category, Status, Offered_seats, Offer_expires_at, Created_at`
+
+// Puts the user on the waitlist of a show, for when no seats are left
+func (app *Config) HandleJoinWaitlist(w http.ResponseWriter, r *http.Request) {
+	var waitlistform WaitlistForm
+
+	err := json.NewDecoder(r.Body).Decode(&waitlistform)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse waitlist form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if waitlistform.PartySize == 0 {
+		waitlistform.PartySize = 1
+	}
+	if waitlistform.PartySize < 1 || waitlistform.PartySize > maxPartySize {
+		http.Error(w, fmt.Sprintf("Error: Party size must be between 1 and %d", maxPartySize), http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var open bool
+	err = db.Get(&open, `SELECT EXISTS (SELECT 1 FROM Show WHERE ShowID = $1 AND Status <> 'cancelled' AND Time_start > NOW())`,
+		waitlistform.ShowID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Show lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !open {
+		http.Error(w, fmt.Sprintf("Error: Show %d doesn't exist, is cancelled or has started", waitlistform.ShowID), http.StatusBadRequest)
+		return
+	}
+
+	maxParty, err := waitlistPartyLimit(db, waitlistform.ShowID, waitlistform.Userid)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Purchase limits lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if waitlistform.PartySize > maxParty {
+		http.Error(w, fmt.Sprintf("Error: At most %d seats can be asked for on show %d", maxParty, waitlistform.ShowID), http.StatusBadRequest)
+		return
+	}
+
+	// Seats anyone can claim right now are claimed, not waited for
+	var available int
+	err = db.Get(&available, `
+		SELECT COUNT(*)
+		FROM Reservation r
+		JOIN Seat s ON r.SeatReservationID = 'SH_' || r.ShowID || '_ST_' || s.SeatID
+		WHERE r.ShowID = $1 AND r.Booked IS NOT TRUE
+			AND (r.last_claim IS NULL OR r.last_claim < NOW() - INTERVAL '1 minute')
+			AND (r.Held_until IS NULL OR r.Held_until <= NOW())
+			AND ($2::text IS NULL OR s.Category = $2)`, waitlistform.ShowID, waitlistform.Category)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Free seats lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if available > 0 {
+		http.Error(w, fmt.Sprintf("Error: Show %d still has %d free seats, claim them instead", waitlistform.ShowID, available), http.StatusConflict)
+		return
+	}
+
+	// The partial unique index allows one live entry per user and show
+	var entryID int
+	err = db.Get(&entryID, `
+		INSERT INTO WaitlistEntry (ShowID, UserID, Party_size, Category, Status)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING
+		RETURNING EntryID`,
+		waitlistform.ShowID, waitlistform.Userid, waitlistform.PartySize, waitlistform.Category, waitlistWaiting)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Error: Already on the waitlist of show %d", waitlistform.ShowID), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to join the waitlist: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d joined the waitlist of show %d for %d seats", waitlistform.Userid, waitlistform.ShowID, waitlistform.PartySize)
+
+	writeWaitlistEntry(w, db, waitlistform.ShowID, waitlistform.Userid, http.StatusCreated)
+}
+
+// Where the user stands on the waitlist, and the seats held for them once offered
+func (app *Config) HandleWaitlistStatus(w http.ResponseWriter, r *http.Request) {
+	var waitlistform WaitlistForm
+
+	err := json.NewDecoder(r.Body).Decode(&waitlistform)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse waitlist form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeWaitlistEntry(w, db, waitlistform.ShowID, waitlistform.Userid, http.StatusOK)
+}
+
+// Takes the user off the waitlist, seats held for them go to the next in line
+func (app *Config) HandleLeaveWaitlist(w http.ResponseWriter, r *http.Request) {
+	var waitlistform WaitlistForm
+
+	err := json.NewDecoder(r.Body).Decode(&waitlistform)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse waitlist form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	left, err := leaveWaitlist(db, waitlistform.ShowID, waitlistform.Userid)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to leave the waitlist: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !left {
+		http.Error(w, fmt.Sprintf("Error: Not on the waitlist of show %d", waitlistform.ShowID), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Success: User %v left the waitlist of Show %v", waitlistform.Userid, waitlistform.ShowID)
+}
+
+func leaveWaitlist(db *sqlx.DB, showID int, userID int) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	var entry waitlistEntry
+	err = tx.Get(&entry, `
+		SELECT `+waitlistColumns+`
+		FROM WaitlistEntry
+		WHERE ShowID = $1 AND UserID = $2 AND Status IN ($3, $4)
+		FOR UPDATE`, showID, userID, waitlistWaiting, waitlistOffered)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("waitlist query error: %v", err)
+	}
+
+	_, err = tx.Exec(`UPDATE WaitlistEntry SET Status = $1 WHERE EntryID = $2`, waitlistLeft, entry.EntryID)
+	if err != nil {
+		return false, fmt.Errorf("waitlist update error: %v", err)
+	}
+
+	if entry.Status == waitlistOffered {
+		err = releaseHold(tx, userID, entry.OfferedSeats)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// The user's latest entry for the show with its place in the queue
+func writeWaitlistEntry(w http.ResponseWriter, db *sqlx.DB, showID int, userID int, status int) {
+	var entry waitlistEntry
+	err := db.Get(&entry, `
+		SELECT `+waitlistColumns+`
+		FROM WaitlistEntry
+		WHERE ShowID = $1 AND UserID = $2
+		ORDER BY Created_at DESC
+		LIMIT 1`, showID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Error: Not on the waitlist of show %d", showID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Waitlist lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if entry.Status == waitlistWaiting {
+		err = db.Get(&entry.Position, `
+			SELECT COUNT(*) + 1
+			FROM WaitlistEntry
+			WHERE ShowID = $1 AND Status = $2 AND (Created_at, EntryID) < ($3, $4)`,
+			showID, waitlistWaiting, entry.CreatedAt, entry.EntryID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: Waitlist position lookup failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	entry.OfferedSeats = seatIDsOf(showID, entry.OfferedSeats)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// Offers freed seats to the waitlists every interval: claims that expired or
+// were released, refunded bookings and offers nobody took up all come back here
+func offerWaitlistSeats(db *sqlx.DB, interval time.Duration) {
+	for {
+		err := runWaitlistRound(db)
+		if err != nil {
+			log.Printf("Error: waitlist round: %v", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func runWaitlistRound(db *sqlx.DB) error {
+	// Lapsed offers first, so their seats can go to the next in line this round
+	var expired []waitlistEntry
+	err := db.Select(&expired, `
+		UPDATE WaitlistEntry
+		SET Status = $1
+		WHERE Status = $2 AND Offer_expires_at <= NOW()
+		RETURNING `+waitlistColumns, waitlistExpired, waitlistOffered)
+	if err != nil {
+		return fmt.Errorf("offer expiry error: %v", err)
+	}
+	for _, entry := range expired {
+		log.Printf("Waitlist offer of seats %v to user %d expired", entry.OfferedSeats, entry.UserID)
+	}
+
+	_, err = db.Exec(`
+		UPDATE WaitlistEntry w
+		SET Status = $1
+		FROM Show sh
+		WHERE sh.ShowID = w.ShowID AND w.Status = $2 AND (sh.Status = 'cancelled' OR sh.Time_start <= NOW())`,
+		waitlistClosed, waitlistWaiting)
+	if err != nil {
+		return fmt.Errorf("waitlist close error: %v", err)
+	}
+
+	var showIDs []int
+	err = db.Select(&showIDs, `SELECT DISTINCT ShowID FROM WaitlistEntry WHERE Status = $1 ORDER BY ShowID`, waitlistWaiting)
+	if err != nil {
+		return fmt.Errorf("waitlisted shows query error: %v", err)
+	}
+
+	for _, showID := range showIDs {
+		err = offerShowSeats(db, showID)
+		if err != nil {
+			log.Printf("Error: waitlist offers for show %d: %v", showID, err)
+		}
+	}
+
+	return nil
+}
+
+// Largest party the user can wait for: the show's purchase limits apply to the
+// seats offered as they do to any claim
+func waitlistPartyLimit(db *sqlx.DB, showID int, userID int) (int, error) {
+	var limits purchaseLimits
+	err := db.Get(&limits, `SELECT Max_seats_per_order, Max_seats_per_user, Max_held_seats FROM Show WHERE ShowID = $1`, showID)
+	if err != nil {
+		return 0, err
+	}
+
+	maxParty := maxPartySize
+	if limits.MaxPerOrder.Valid && int(limits.MaxPerOrder.Int64) < maxParty {
+		maxParty = int(limits.MaxPerOrder.Int64)
+	}
+	if limits.MaxHeld.Valid && int(limits.MaxHeld.Int64) < maxParty {
+		maxParty = int(limits.MaxHeld.Int64)
+	}
+	if limits.MaxPerUser.Valid {
+		var booked int
+		err = db.Get(&booked, `SELECT COUNT(*) FROM Reservation WHERE ShowID = $1 AND Booked AND BookedbyID = $2`, showID, userID)
+		if err != nil {
+			return 0, err
+		}
+		if left := int(limits.MaxPerUser.Int64) - booked; left < maxParty {
+			maxParty = left
+		}
+	}
+
+	return maxParty, nil
+}
+
+type freeSeat struct {
+	SeatReservationID string `db:"seatreservationid"`
+	Category          string `db:"category"`
+}
+
+// Holds freed seats for the waiting entries of one show in the order they
+// joined: seats whose claim expired or was released and seats of refunded
+// bookings. An entry the freed seats can't satisfy keeps its place for the
+// next round.
+func offerShowSeats(db *sqlx.DB, showID int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	var entries []waitlistEntry
+	err = tx.Select(&entries, `
+		SELECT `+waitlistColumns+`
+		FROM WaitlistEntry
+		WHERE ShowID = $1 AND Status = $2
+		ORDER BY Created_at, EntryID
+		FOR UPDATE SKIP LOCKED`, showID, waitlistWaiting)
+	if err != nil {
+		return fmt.Errorf("waitlist query error: %v", err)
+	}
+
+	// Seats being claimed right now are locked by saveClaim and skipped
+	var seats []freeSeat
+	err = tx.Select(&seats, `
+		SELECT r.SeatReservationID, s.Category
+		FROM Reservation r
+		JOIN Seat s ON r.SeatReservationID = 'SH_' || r.ShowID || '_ST_' || s.SeatID
+		WHERE r.ShowID = $1 AND r.Booked IS NOT TRUE
+			AND (r.last_claim IS NULL OR r.last_claim < NOW() - INTERVAL '1 minute')
+			AND (r.Held_until IS NULL OR r.Held_until <= NOW())
+			AND (r.last_claim IS NOT NULL OR r.Released_at IS NOT NULL)
+		ORDER BY s.SeatID
+		FOR UPDATE OF r SKIP LOCKED`, showID)
+	if err != nil {
+		return fmt.Errorf("free seats query error: %v", err)
+	}
+
+	if len(entries) == 0 || len(seats) == 0 {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(waitlistHoldDuration)
+	for _, entry := range entries {
+		var picked []string
+		var rest []freeSeat
+		for _, seat := range seats {
+			if len(picked) < entry.PartySize && (entry.Category == nil || *entry.Category == seat.Category) {
+				picked = append(picked, seat.SeatReservationID)
+			} else {
+				rest = append(rest, seat)
+			}
+		}
+		if len(picked) < entry.PartySize {
+			continue
+		}
+		seats = rest
+
+		_, err = tx.Exec(`UPDATE Reservation SET Held_for = $1, Held_until = $2 WHERE SeatReservationID = ANY($3)`,
+			entry.UserID, expiresAt, pq.Array(picked))
+		if err != nil {
+			return fmt.Errorf("seat hold error: %v", err)
+		}
+
+		_, err = tx.Exec(`
+			UPDATE WaitlistEntry
+			SET Status = $1, Offered_seats = $2, Offered_at = NOW(), Offer_expires_at = $3
+			WHERE EntryID = $4`, waitlistOffered, pq.Array(picked), expiresAt, entry.EntryID)
+		if err != nil {
+			return fmt.Errorf("waitlist offer error: %v", err)
+		}
+
+		// outboxRelay emails the offer, the hold starts now whether it's read or not
+		_, err = tx.Exec(`INSERT INTO Notification (UserID, ShowID, Message) VALUES ($1, $2, $3)`,
+			entry.UserID, showID, fmt.Sprintf("Seats %v are held for you until %s, claim them before someone else gets them",
+				seatIDsOf(showID, picked), expiresAt.Format(time.RFC1123)))
+		if err != nil {
+			return fmt.Errorf("notification insert error: %v", err)
+		}
+
+		log.Printf("Offered seats %v of show %d to waitlisted user %d", picked, showID, entry.UserID)
+	}
+
+	return tx.Commit()
+}
+
+// Gives held seats back, only those still held for the user
+func releaseHold(tx *sqlx.Tx, userID int, seatReservationIDs []string) error {
+	_, err := tx.Exec(`UPDATE Reservation SET Held_for = NULL, Held_until = NULL WHERE SeatReservationID = ANY($1) AND Held_for = $2`,
+		pq.Array(seatReservationIDs), userID)
+	if err != nil {
+		return fmt.Errorf("hold release error: %v", err)
+	}
+
+	return nil
+}
+
+// Waitlist entries keep SeatReservationIDs, users know their seats by SeatID
+func seatIDsOf(showID int, seatReservationIDs []string) []string {
+	prefix := fmt.Sprintf("SH_%d_ST_", showID)
+
+	seatIDs := make([]string, len(seatReservationIDs))
+	for i, seatReservationID := range seatReservationIDs {
+		seatIDs[i] = strings.TrimPrefix(seatReservationID, prefix)
+	}
+
+	return seatIDs
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Gives bookSeat time to start listening for the payment data before paying
+const paymentListenerDelay = 300 * time.Millisecond
+
+type PurchaseForm struct {
+	SeatIDs   []string `json:"seat_ids"`
+	ShowID    int      `json:"show_id"`
+	Userid    int      `json:"user_id"`
+	PromoCode string   `json:"promo_code"`
+}
+
+type sagaStatusRequest struct {
+	SagaID int `json:"saga_id"`
+	Userid int `json:"user_id"`
+}
+
+// Body sent to claimSeat, bookSeat and the checkout
+type seatsRequest struct {
+	SeatIDs   []string `json:"seat_ids"`
+	ShowID    int      `json:"show_id"`
+	PromoCode string   `json:"promo_code,omitempty"`
+}
+
+type paymentRequest struct {
+	Amount    int64    `json:"amount"`
+	Currency  string   `json:"currency"`
+	Showid    int      `json:"show_id"`
+	Seats     []string `json:"seat_ids"`
+	PromoCode string   `json:"promo_code"`
+}
+
+type checkoutResponse struct {
+	Receipt struct {
+		Currency string `json:"currency"`
+		Total    int64  `json:"total"`
+	} `json:"receipt"`
+}
+
+type paymentResponse struct {
+	Paymentconf_id int `json:"paymentconf_id"`
+}
+
+type bookingOutcome struct {
+	resp *serviceResponse
+	err  error
+}
+
+// Runs the whole purchase, claim to booking, as one saga
+func (app *Config) HandlePurchase(w http.ResponseWriter, r *http.Request) {
+	log.Println("DEBUG: Inside orchestrator_HandlePurchase ")
+
+	var purchaseform PurchaseForm
+
+	//Read the request payload
+	err := json.NewDecoder(r.Body).Decode(&purchaseform)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse purchase form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if len(purchaseform.SeatIDs) == 0 {
+		http.Error(w, "Error: No seats to purchase", http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	saga, err := createSaga(db, purchaseform)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to start purchase: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	runSaga(db, saga, r.Header.Get(admissionHeader))
+
+	status := http.StatusCreated
+	if saga.Status != sagaCompleted {
+		status = http.StatusConflict
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(saga)
+}
+
+// Tells the user how far one of their purchases got
+func (app *Config) HandleSagaStatus(w http.ResponseWriter, r *http.Request) {
+	var statusrequest sagaStatusRequest
+
+	err := json.NewDecoder(r.Body).Decode(&statusrequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse saga status request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	saga, err := getSaga(db, statusrequest.SagaID)
+	if err == sql.ErrNoRows || (err == nil && saga.UserID != statusrequest.Userid) {
+		http.Error(w, fmt.Sprintf("Error: Purchase %d not found", statusrequest.SagaID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Purchase lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	events, err := getSagaEvents(db, saga.SagaID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Purchase history lookup failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"saga":   saga,
+		"events": events,
+	})
+}
+
+// Drives the saga step by step, any failure after the claim is compensated.
+// The admission token is only needed by the steps that buy, compensating
+// works without it.
+func runSaga(db *sqlx.DB, saga *Saga, admissionToken string) {
+	seats := seatsRequest{SeatIDs: saga.SeatIDs, ShowID: saga.ShowID}
+
+	// Claim, nothing to undo if it fails
+	resp, err := callService(claimSeatURL+"/claimSeat", saga.UserID, admissionToken, seats)
+	if err == nil && !resp.ok() {
+		err = fmt.Errorf("claim rejected: %s", resp)
+	}
+	if err != nil {
+		setSagaError(saga, err)
+		advanceSaga(db, saga, stepClaim, sagaAborted, err.Error())
+		return
+	}
+	advanceSaga(db, saga, stepCheckout, sagaRunning, "seats claimed")
+
+	// Checkout, gives the amount to pay
+	checkout := seats
+	checkout.PromoCode = saga.PromoCode
+	resp, err = callService(checkPaymentURL+"/AbouttoCheckout", saga.UserID, admissionToken, checkout)
+	if err == nil && !resp.ok() {
+		err = fmt.Errorf("checkout rejected: %s", resp)
+	}
+	var receipt checkoutResponse
+	if err == nil {
+		err = json.Unmarshal(resp.Body, &receipt)
+	}
+	if err != nil {
+		compensateSaga(db, saga, err)
+		return
+	}
+	advanceSaga(db, saga, stepPayment, sagaRunning, fmt.Sprintf("checkout total %d %s", receipt.Receipt.Total, receipt.Receipt.Currency))
+
+	// Payment and booking
+	err = payAndBook(db, saga, admissionToken, paymentRequest{
+		Amount:    receipt.Receipt.Total,
+		Currency:  receipt.Receipt.Currency,
+		Showid:    saga.ShowID,
+		Seats:     saga.SeatIDs,
+		PromoCode: saga.PromoCode,
+	})
+	if err != nil {
+		compensateSaga(db, saga, err)
+		return
+	}
+
+	saga.LastError = nil
+	advanceSaga(db, saga, stepDone, sagaCompleted, "seats booked and paid")
+}
+
+// bookSeat waits for the payment data that checkPayment sends once the funds
+// are authorized, checkPayment then captures only if the booking was saved
+func payAndBook(db *sqlx.DB, saga *Saga, admissionToken string, payment paymentRequest) error {
+	// Cancelling the booking request makes bookSeat stop waiting for the payment data
+	ctx, cancelBooking := context.WithCancel(context.Background())
+	defer cancelBooking()
+
+	bookingDone := make(chan bookingOutcome, 1)
+	go func() {
+		client := &http.Client{Timeout: bookingTimeout}
+		resp, err := postToService(ctx, client, bookSeatURL+"/bookSeat", saga.UserID, "", seatsRequest{SeatIDs: saga.SeatIDs, ShowID: saga.ShowID})
+		bookingDone <- bookingOutcome{resp: resp, err: err}
+	}()
+
+	time.Sleep(paymentListenerDelay)
+
+	// A failed payment voids its own authorization, so paying again is safe
+	// as long as bookSeat is still waiting
+	client := &http.Client{Timeout: serviceTimeout}
+	delay := retryBackoff
+	var paid *serviceResponse
+	var payErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		paid, payErr = postToService(context.Background(), client, checkPaymentURL+"/checkPayment", saga.UserID, admissionToken, payment)
+		if payErr == nil && paid.ok() {
+			break
+		}
+
+		retryable := payErr != nil || paid.StatusCode >= http.StatusInternalServerError
+		if payErr == nil {
+			payErr = fmt.Errorf("payment rejected: %s", paid)
+		}
+		logSagaEvent(db, saga.SagaID, stepPayment, "attempt_failed", payErr.Error())
+
+		if !retryable || attempt == maxAttempts || bookingFinished(bookingDone) {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	if payErr != nil {
+		return payErr
+	}
+
+	var confirmation paymentResponse
+	if err := json.Unmarshal(paid.Body, &confirmation); err == nil {
+		saga.Paymentconf_id = &confirmation.Paymentconf_id
+	}
+	advanceSaga(db, saga, stepPayment, sagaRunning, "payment captured")
+
+	booking := <-bookingDone
+	if booking.err != nil {
+		return fmt.Errorf("booking failed: %v", booking.err)
+	}
+	if !booking.resp.ok() {
+		return fmt.Errorf("booking rejected: %s", booking.resp)
+	}
+
+	return nil
+}
+
+// Tells whether bookSeat already answered, without taking the answer
+func bookingFinished(bookingDone chan bookingOutcome) bool {
+	select {
+	case outcome := <-bookingDone:
+		bookingDone <- outcome
+		return true
+	default:
+		return false
+	}
+}
+
+func setSagaError(saga *Saga, cause error) {
+	message := cause.Error()
+	saga.LastError = &message
+}
+
+// Undoes the steps already done: refunds a captured payment, then releases
+// the claim. A compensation that fails leaves the saga compensating for the
+// recovery loop to retry.
+func compensateSaga(db *sqlx.DB, saga *Saga, cause error) {
+	setSagaError(saga, cause)
+	advanceSaga(db, saga, saga.Step, sagaCompensating, cause.Error())
+
+	// The booking decides: a booked saga only failed to hear about it
+	booked, err := isSagaBooked(db, saga)
+	if err != nil {
+		logSagaEvent(db, saga.SagaID, saga.Step, "compensation_failed", err.Error())
+		return
+	}
+	if booked {
+		saga.LastError = nil
+		advanceSaga(db, saga, stepDone, sagaCompleted, "seats found booked")
+		return
+	}
+
+	if saga.Paymentconf_id != nil {
+		resp, err := callService(checkPaymentURL+"/internal/refundPayment", saga.UserID, "", map[string]interface{}{
+			"paymentconf_id": *saga.Paymentconf_id,
+			"reason":         fmt.Sprintf("purchase %d failed: %v", saga.SagaID, cause),
+		})
+		if err == nil && !resp.ok() {
+			err = fmt.Errorf("refund rejected: %s", resp)
+		}
+		if err != nil {
+			logSagaEvent(db, saga.SagaID, saga.Step, "compensation_failed", err.Error())
+			return
+		}
+		logSagaEvent(db, saga.SagaID, saga.Step, "compensated", "payment refunded")
+	}
+
+	resp, err := callService(claimSeatURL+"/releaseClaim", saga.UserID, "", seatsRequest{SeatIDs: saga.SeatIDs, ShowID: saga.ShowID})
+	if err == nil && !resp.ok() {
+		err = fmt.Errorf("release rejected: %s", resp)
+	}
+	if err != nil {
+		logSagaEvent(db, saga.SagaID, saga.Step, "compensation_failed", err.Error())
+		return
+	}
+
+	advanceSaga(db, saga, saga.Step, sagaAborted, "claim released")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const webPort = "8098"
+
+type Config struct {
+}
+
+const pgConnectionString = "host=localhost port=5432 user=rayanc dbname=tickets sslmode=disable"
+
+// Base URLs of the services the purchase saga goes through
+const (
+	claimSeatURL    = "http://localhost:8090"
+	checkPaymentURL = "http://localhost:8096"
+	bookSeatURL     = "http://localhost:8091"
+)
+
+// How often unfinished sagas are looked at again
+const recoveryInterval = 30 * time.Second
+
+func main() {
+	// The services' internal routes only take requests carrying our service token
+	loadServiceSecret()
+
+	app := Config{}
+
+	log.Printf("Starting Orchestrator service on port: %s", webPort)
+
+	// HTTP server
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", webPort),
+		Handler: app.routes(),
+	}
+
+	//DB connection check
+	db, err := ConnectToDB()
+	if err != nil {
+		log.Fatalf("Error: DB connection %v", err)
+		return
+	}
+
+	// Sagas left halfway by a crash or a failed compensation are finished in the background
+	go recoverSagas(db, recoveryInterval)
+
+	//Start the web server
+	err = srv.ListenAndServe()
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+}
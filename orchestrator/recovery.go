@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A saga still running after this long was interrupted, longer than any step can take
+const staleSagaAfter = 5 * time.Minute
+
+// Compensation is given up after this many recovery rounds
+const maxRecoveryAttempts = 10
+
+// Finishes sagas left halfway, either by a restart of the orchestrator or by
+// a compensation that failed, and keeps doing so every interval
+func recoverSagas(db *sqlx.DB, interval time.Duration) {
+	for {
+		err := recoverPendingSagas(db)
+		if err != nil {
+			log.Printf("Error: saga recovery: %v", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func recoverPendingSagas(db *sqlx.DB) error {
+	var sagas []Saga
+	err := db.Select(&sagas, `
+		SELECT `+sagaColumns+`
+		FROM Saga
+		WHERE Status = $1 OR (Status = $2 AND Updated_at < $3)
+		ORDER BY SagaID`, sagaCompensating, sagaRunning, time.Now().Add(-staleSagaAfter))
+	if err != nil {
+		return fmt.Errorf("pending sagas query error: %v", err)
+	}
+
+	for i := range sagas {
+		saga := &sagas[i]
+
+		saga.Attempts++
+		if saga.Attempts > maxRecoveryAttempts {
+			advanceSaga(db, saga, saga.Step, sagaFailed, "recovery gave up")
+			continue
+		}
+
+		// Whatever step it stopped at, the purchase can't be resumed without
+		// the user, so it is either found booked or undone
+		compensateSaga(db, saga, fmt.Errorf("recovered at step %s", saga.Step))
+	}
+
+	return nil
+}
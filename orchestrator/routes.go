@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	authmiddleware "orchestrator/auth"
+	"ratelimit"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/cors"
+)
+
+// Handlers the routing part, returns Handler to the main.go
+func (app *Config) routes() http.Handler {
+	mux := chi.NewRouter()
+
+	// Specify who is allowed to connect
+	mux.Use(cors.Handler(cors.Options{
+		AllowedOrigins:   []string{"https://*", "http://*"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-TOKEN", "X-Admission-Token"},
+		ExposedHeaders:   []string{"Link"},
+		AllowCredentials: true,
+		MaxAge:           300,
+	}))
+
+	//To check if service up or not
+	mux.Use(middleware.Heartbeat("/ping"))
+
+	//Rate limits, per address before the token is even looked at, then per user
+	mux.Use(ratelimit.Middleware("orchestrator_ip", ratelimit.PerMinute(600), ratelimit.ByIP))
+
+	//JWT middleware
+	mux.Use(authmiddleware.JWTMiddleware)
+
+	mux.Use(ratelimit.Middleware("orchestrator_user", ratelimit.PerMinute(120), ratelimit.ByUser(authmiddleware.UserID)))
+
+	//Add route at root level
+	mux.Post("/purchase", app.HandlePurchase)
+	mux.Post("/sagaStatus", app.HandleSagaStatus)
+
+	return mux
+}
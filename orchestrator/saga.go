@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Steps of the purchase saga, in order
+const (
+	stepClaim    = "claim"    // claimSeat locks the seats and their price
+	stepCheckout = "checkout" // checkPayment extends the claim and builds the receipt
+	stepPayment  = "payment"  // checkPayment authorizes, bookSeat books, checkPayment captures
+	stepDone     = "done"
+)
+
+// Statuses of a saga, completed, aborted and failed are final
+const (
+	sagaRunning      = "running"
+	sagaCompensating = "compensating" // undoing the steps already done, retried until it succeeds
+	sagaCompleted    = "completed"    // seats booked and paid
+	sagaAborted      = "aborted"      // a step failed and everything done before it was undone
+	sagaFailed       = "failed"       // compensation gave up, needs someone to look at it
+)
+
+type Saga struct {
+	SagaID         int            `json:"saga_id" db:"sagaid"`
+	UserID         int            `json:"user_id" db:"userid"`
+	ShowID         int            `json:"show_id" db:"showid"`
+	SeatIDs        pq.StringArray `json:"seat_ids" db:"seat_ids"`
+	PromoCode      string         `json:"promo_code" db:"promo_code"`
+	Step           string         `json:"step" db:"step"`
+	Status         string         `json:"status" db:"status"`
+	Paymentconf_id *int           `json:"paymentconf_id" db:"paymentconf_id"`
+	Attempts       int            `json:"attempts" db:"attempts"`
+	LastError      *string        `json:"last_error" db:"last_error"`
+	CreatedAt      time.Time      `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at" db:"updated_at"`
+}
+
+type sagaEvent struct {
+	Step      string    `json:"step" db:"step"`
+	Outcome   string    `json:"outcome" db:"outcome"`
+	Detail    string    `json:"detail" db:"detail"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+const sagaColumns = `SagaID, UserID, ShowID, Seat_ids, Promo_code, Step, Status, Paymentconf_id, Attempts, Last_error, Created_at, Updated_at`
+
+func createSaga(db *sqlx.DB, form PurchaseForm) (*Saga, error) {
+	var saga Saga
+	err := db.Get(&saga, `
+		INSERT INTO Saga (UserID, ShowID, Seat_ids, Promo_code, Step, Status)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+sagaColumns,
+		form.Userid, form.ShowID, pq.StringArray(form.SeatIDs), form.PromoCode, stepClaim, sagaRunning)
+	if err != nil {
+		return nil, fmt.Errorf("saga insert error: %v", err)
+	}
+
+	return &saga, nil
+}
+
+func getSaga(db *sqlx.DB, sagaID int) (*Saga, error) {
+	var saga Saga
+	err := db.Get(&saga, `SELECT `+sagaColumns+` FROM Saga WHERE SagaID = $1`, sagaID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &saga, nil
+}
+
+// Persists the state of the saga, called before and after every step so a
+// restart knows how far the saga got
+func saveSaga(db *sqlx.DB, saga *Saga) error {
+	_, err := db.Exec(`
+		UPDATE Saga
+		SET Step = $1, Status = $2, Paymentconf_id = $3, Attempts = $4, Last_error = $5, Updated_at = NOW()
+		WHERE SagaID = $6`,
+		saga.Step, saga.Status, saga.Paymentconf_id, saga.Attempts, saga.LastError, saga.SagaID)
+	if err != nil {
+		return fmt.Errorf("saga %d update error: %v", saga.SagaID, err)
+	}
+
+	return nil
+}
+
+// Moves the saga along and records why, a saga that can't be saved is
+// picked up by the recovery loop from its last saved state
+func advanceSaga(db *sqlx.DB, saga *Saga, step string, status string, detail string) {
+	saga.Step = step
+	saga.Status = status
+
+	if err := saveSaga(db, saga); err != nil {
+		log.Printf("Error: %v", err)
+	}
+	logSagaEvent(db, saga.SagaID, step, status, detail)
+}
+
+func logSagaEvent(db *sqlx.DB, sagaID int, step string, outcome string, detail string) {
+	_, err := db.Exec(`INSERT INTO SagaEvent (SagaID, Step, Outcome, Detail) VALUES ($1, $2, $3, $4)`,
+		sagaID, step, outcome, detail)
+	if err != nil {
+		log.Printf("Error: saga %d event not logged: %v", sagaID, err)
+	}
+
+	log.Printf("Saga %d %s: %s %s", sagaID, step, outcome, detail)
+}
+
+func getSagaEvents(db *sqlx.DB, sagaID int) ([]sagaEvent, error) {
+	var events []sagaEvent
+	err := db.Select(&events, `
+		SELECT Step, Outcome, Detail, Created_at
+		FROM SagaEvent
+		WHERE SagaID = $1
+		ORDER BY EventID`, sagaID)
+	if err != nil {
+		return nil, fmt.Errorf("saga events query error: %v", err)
+	}
+
+	return events, nil
+}
+
+// The booking is the source of truth: when every seat of the saga is booked by
+// its user the purchase went through, whatever the saga recorded
+func isSagaBooked(db *sqlx.DB, saga *Saga) (bool, error) {
+	seatReservationIDs := make([]string, len(saga.SeatIDs))
+	for i, seatID := range saga.SeatIDs {
+		seatReservationIDs[i] = "SH_" + strconv.Itoa(saga.ShowID) + "_ST_" + seatID
+	}
+
+	var booked int
+	err := db.Get(&booked, `
+		SELECT COUNT(*)
+		FROM Reservation
+		WHERE SeatReservationID = ANY($1) AND Booked = TRUE AND BookedbyID = $2`,
+		pq.Array(seatReservationIDs), saga.UserID)
+	if err != nil {
+		return false, fmt.Errorf("booking query error: %v", err)
+	}
+
+	return booked == len(seatReservationIDs), nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Transient failures are retried this many times, with a doubling delay
+const (
+	maxAttempts  = 3
+	retryBackoff = 200 * time.Millisecond
+)
+
+// bookSeat holds the request open until the payment data arrives
+const (
+	serviceTimeout = 30 * time.Second
+	bookingTimeout = 2 * time.Minute
+)
+
+type serviceResponse struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (r *serviceResponse) ok() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+func (r *serviceResponse) String() string {
+	return fmt.Sprintf("%d %s", r.StatusCode, strings.TrimSpace(string(r.Body)))
+}
+
+// The services take the user from the JWT, the orchestrator signs a short
+// lived token for the saga's user so it can also act while recovering
+func serviceToken(userID int) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": userID,
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	})
+
+	return token.SignedString([]byte("verysecretsecret"))
+}
+
+// Header the internal routes of the services check, so they know the request
+// comes from the orchestrator and not from a customer
+const serviceTokenHeader = "X-Service-Token"
+
+// Shared with the services, read at startup
+var serviceSecret []byte
+
+func loadServiceSecret() {
+	secret := os.Getenv("SERVICE_TOKEN_SECRET")
+	if secret == "" {
+		log.Fatal("Error: SERVICE_TOKEN_SECRET is not set")
+	}
+	serviceSecret = []byte(secret)
+}
+
+// Proves the request comes from the orchestrator, acting for userID
+func internalToken(userID int) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "orchestrator",
+		"sub": userID,
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	})
+
+	return token.SignedString(serviceSecret)
+}
+
+// Header carrying the waitingRoom admission token, passed on as the user gave it
+const admissionHeader = "X-Admission-Token"
+
+// Posts once, a response with any status code is not an error
+func postToService(ctx context.Context, client *http.Client, url string, userID int, admissionToken string, payload interface{}) (*serviceResponse, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request to %s: %v", url, err)
+	}
+
+	token, err := serviceToken(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign service token: %v", err)
+	}
+	internal, err := internalToken(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign internal token: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request to %s: %v", url, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(serviceTokenHeader, internal)
+	if admissionToken != "" {
+		req.Header.Set(admissionHeader, admissionToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %v", url, err)
+	}
+
+	return &serviceResponse{StatusCode: resp.StatusCode, Body: respBody}, nil
+}
+
+// Posts with retries on network errors and on the gateway statuses that
+// mean the service wasn't reached, the services answer 500 for rejections
+// too so those are not retried
+func callService(url string, userID int, admissionToken string, payload interface{}) (*serviceResponse, error) {
+	client := &http.Client{Timeout: serviceTimeout}
+	delay := retryBackoff
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		resp, err := postToService(context.Background(), client, url, userID, admissionToken, payload)
+		if err == nil && !isTransientStatus(resp.StatusCode) {
+			return resp, nil
+		}
+
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("%s answered %s", url, resp)
+		}
+		log.Printf("Attempt %d/%d of %s failed: %v", attempt, maxAttempts, url, lastErr)
+
+		if attempt < maxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	return nil, lastErr
+}
+
+func isTransientStatus(statusCode int) bool {
+	return statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+}
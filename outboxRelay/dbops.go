@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq" // Import PostgreSQL driver
+)
+
+func ConnectToDB() (*sqlx.DB, error) {
+	db, err := sqlx.Open("postgres", pgConnectionString)
+	if err != nil {
+		return db, err
+	}
+
+	return db, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+const pgConnectionString = "host=localhost port=5432 user=rayanc dbname=tickets sslmode=disable"
+
+func main() {
+	broker := flag.String("broker", "redis", "where events are published: redis (Redis Streams) or log")
+	pollInterval := flag.Duration("poll", 500*time.Millisecond, "how often the outbox is checked for new events")
+	batchSize := flag.Int("batch", 100, "events published per round")
+	project := flag.Bool("project", true, "keep the Redis seats left counters in sync from the events")
+	notify := flag.Bool("notify", true, "email the customers the messages left in the Notification table")
+	flag.Parse()
+
+	log.Printf("Starting OutboxRelay publishing to %s", *broker)
+
+	db, err := ConnectToDB()
+	if err != nil {
+		log.Fatalf("Error: DB connection %v", err)
+		return
+	}
+
+	publisher, err := newPublisher(*broker)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+		return
+	}
+	defer publisher.Close()
+
+	// Counters are derived from the stream, so they only make sense with Redis as the broker
+	if *project && *broker == brokerRedis {
+		go runProjector()
+	}
+
+	if *notify {
+		go runNotifier(db, *pollInterval)
+	}
+
+	relayOutbox(db, publisher, *pollInterval, *batchSize)
+}
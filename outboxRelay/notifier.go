@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Notifications sent per round
+const notificationBatch = 100
+
+type pendingNotification struct {
+	NotificationID int    `db:"notificationid"`
+	UserID         int    `db:"userid"`
+	Email          string `db:"email"`
+	Message        string `db:"message"`
+}
+
+// Emails the messages Shows and claimSeat leave in the Notification table:
+// reschedules, cancellations and waitlist offers. Customers without an email
+// address keep their messages unsent, for the app to show them.
+func runNotifier(db *sqlx.DB, pollInterval time.Duration) {
+	for {
+		sent, err := sendNotifications(db)
+		if err != nil {
+			log.Printf("Error: notifier: %v", err)
+		}
+
+		// Keep going while there is a backlog
+		if sent < notificationBatch {
+			time.Sleep(pollInterval)
+		}
+	}
+}
+
+// A message is marked sent in the transaction that sent it, so another relay
+// instance skips it and a crash before the commit sends it again
+func sendNotifications(db *sqlx.DB) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("error creating DB transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	var notifications []pendingNotification
+	err = tx.Select(&notifications, `
+		SELECT n.NotificationID, n.UserID, u.email, n.Message
+		FROM Notification n
+		JOIN Users u ON u.UserID = n.UserID
+		WHERE n.Sent = FALSE AND u.email IS NOT NULL
+		ORDER BY n.NotificationID
+		LIMIT $1
+		FOR UPDATE OF n SKIP LOCKED`, notificationBatch)
+	if err != nil {
+		return 0, fmt.Errorf("notification query error: %v", err)
+	}
+
+	sent := 0
+	for _, notification := range notifications {
+		err = sendEmail(notification.Email, notification.Message)
+		if err != nil {
+			log.Printf("Error: notification %d to user %d: %v", notification.NotificationID, notification.UserID, err)
+			continue
+		}
+
+		_, err = tx.Exec(`UPDATE Notification SET Sent = TRUE WHERE NotificationID = $1`, notification.NotificationID)
+		if err != nil {
+			return 0, fmt.Errorf("notification update error: %v", err)
+		}
+		sent++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing sent notifications: %v", err)
+	}
+
+	return sent, nil
+}
+
+func sendEmail(address string, message string) error {
+	//Simulating the email provider
+	time.Sleep(10 * time.Millisecond)
+
+	log.Printf("Email to %s: %s", address, message)
+	return nil
+}
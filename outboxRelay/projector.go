@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const projectorGroup = "seat_counters"
+
+// Entries the projector can't apply are retried, then set aside in the dead
+// letter stream for someone to look at
+const (
+	deadLetterStream = "ticket_events_dead"
+	maxDeliveries    = 5
+	pendingRetry     = 30 * time.Second
+)
+
+// Events are applied once: the marker key is set in the same script as the
+// counter change, so a redelivered event finds it and does nothing
+const projectedTTL = 7 * 24 * time.Hour
+
+// A cancelled show stays at zero, whatever arrives after the cancellation
+var applyEventScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], 1, 'NX', 'EX', ARGV[3]) == false then
+	return 0
+end
+if ARGV[1] == 'cancel' then
+	redis.call('SET', KEYS[3], 1)
+	redis.call('SET', KEYS[2], 0)
+	return 1
+end
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return 1
+end
+if ARGV[1] == 'init' then
+	redis.call('SET', KEYS[2], ARGV[2], 'NX')
+elseif ARGV[1] == 'incr' then
+	redis.call('INCRBY', KEYS[2], ARGV[2])
+else
+	redis.call('DECRBY', KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+type counterEvent struct {
+	ShowID         int `json:"show_id"`
+	Capacity       int `json:"capacity"`
+	CapacityChange int `json:"capacity_change"`
+	Seats          int `json:"seats"`
+}
+
+// Keeps the seats left counter of every show in sync with the event stream
+func runProjector() {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	defer rdb.Close()
+
+	// Context for the Redis operations.
+	ctx := context.Background()
+
+	// Starts from the beginning of the stream the first time, then from where the group left off
+	err := rdb.XGroupCreateMkStream(ctx, eventStream, projectorGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Printf("Error: projector group: %v", err)
+		return
+	}
+
+	// Entries delivered before but never acknowledged are read first, again
+	// every pendingRetry, until they go through or run out of deliveries
+	lastID := "0"
+	lastRetry := time.Now()
+	for {
+		if lastID == ">" && time.Since(lastRetry) >= pendingRetry {
+			lastID = "0"
+			lastRetry = time.Now()
+		}
+
+		streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    projectorGroup,
+			Consumer: "projector",
+			Streams:  []string{eventStream, lastID},
+			Count:    100,
+			Block:    5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error: projector read: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		messages := streams[0].Messages
+		if lastID != ">" && len(messages) == 0 {
+			lastID = ">"
+			continue
+		}
+
+		for _, message := range messages {
+			// The pending list is walked past entries that fail again
+			if lastID != ">" {
+				lastID = message.ID
+			}
+
+			err = projectEvent(ctx, rdb, message)
+			if err != nil {
+				log.Printf("Error: projecting %s: %v", message.ID, err)
+				deadLetter(ctx, rdb, message, err)
+				continue
+			}
+
+			err = rdb.XAck(ctx, eventStream, projectorGroup, message.ID).Err()
+			if err != nil {
+				log.Printf("Error: acknowledging %s: %v", message.ID, err)
+			}
+		}
+	}
+}
+
+// Moves an entry that failed maxDeliveries times to the dead letter stream and
+// acknowledges it, so it stops being retried. Before that it is left pending.
+func deadLetter(ctx context.Context, rdb *redis.Client, message redis.XMessage, cause error) {
+	pending, err := rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: eventStream,
+		Group:  projectorGroup,
+		Start:  message.ID,
+		End:    message.ID,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		log.Printf("Error: pending lookup for %s: %v", message.ID, err)
+		return
+	}
+	if len(pending) == 0 || pending[0].RetryCount < maxDeliveries {
+		return
+	}
+
+	values := make(map[string]interface{}, len(message.Values)+2)
+	for key, value := range message.Values {
+		values[key] = value
+	}
+	values["stream_id"] = message.ID
+	values["error"] = cause.Error()
+
+	err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: deadLetterStream, Values: values}).Err()
+	if err != nil {
+		log.Printf("Error: dead lettering %s: %v", message.ID, err)
+		return
+	}
+
+	err = rdb.XAck(ctx, eventStream, projectorGroup, message.ID).Err()
+	if err != nil {
+		log.Printf("Error: acknowledging %s: %v", message.ID, err)
+		return
+	}
+
+	log.Printf("Event %s moved to %s after %d deliveries", message.ID, deadLetterStream, pending[0].RetryCount)
+}
+
+func projectEvent(ctx context.Context, rdb *redis.Client, message redis.XMessage) error {
+	eventType, _ := message.Values["event_type"].(string)
+	eventID, _ := message.Values["event_id"].(string)
+	payload, _ := message.Values["payload"].(string)
+
+	var event counterEvent
+	err := json.Unmarshal([]byte(payload), &event)
+	if err != nil {
+		return fmt.Errorf("malformed payload: %v", err)
+	}
+
+	var op string
+	var amount int
+	switch eventType {
+	case "show_created":
+		op, amount = "init", event.Capacity
+	case "seat_booked":
+		op, amount = "decr", event.Seats
+	case "booking_refunded":
+		op, amount = "incr", event.Seats
+	case "show_updated":
+		op, amount = "incr", event.CapacityChange
+	case "show_cancelled":
+		op, amount = "cancel", 0
+	default:
+		// Not about counters
+		return nil
+	}
+
+	showKey := strconv.Itoa(event.ShowID)
+	keys := []string{"projected_" + eventID, showKey, "cancelled_" + showKey}
+	err = applyEventScript.Run(ctx, rdb, keys, op, amount, int(projectedTTL.Seconds())).Err()
+	if err != nil {
+		return fmt.Errorf("error applying event %s in Redis: %v", eventID, err)
+	}
+
+	return nil
+}
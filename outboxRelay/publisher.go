@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	brokerRedis = "redis"
+	brokerLog   = "log"
+)
+
+// Every event goes to one stream so consumers see them in outbox order
+const eventStream = "ticket_events"
+
+// Row of the Outbox table
+type OutboxEvent struct {
+	EventID     int64     `db:"eventid"`
+	EventType   string    `db:"event_type"`
+	AggregateID int       `db:"aggregate_id"`
+	Payload     []byte    `db:"payload"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// Broker the relay publishes to. Publish must only return once the broker has
+// the event, the event is marked published right after.
+type Publisher interface {
+	Publish(ctx context.Context, event OutboxEvent) error
+	Close() error
+}
+
+func newPublisher(broker string) (Publisher, error) {
+	switch broker {
+	case brokerRedis:
+		return newRedisStreamPublisher(), nil
+	case brokerLog:
+		return logPublisher{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown broker %s", broker)
+}
+
+type redisStreamPublisher struct {
+	rdb *redis.Client
+}
+
+func newRedisStreamPublisher() *redisStreamPublisher {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	return &redisStreamPublisher{rdb: rdb}
+}
+
+func (p *redisStreamPublisher) Publish(ctx context.Context, event OutboxEvent) error {
+	err := p.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: eventStream,
+		Values: map[string]interface{}{
+			"event_id":     strconv.FormatInt(event.EventID, 10),
+			"event_type":   event.EventType,
+			"aggregate_id": strconv.Itoa(event.AggregateID),
+			"payload":      string(event.Payload),
+			"created_at":   event.CreatedAt.Format(time.RFC3339Nano),
+		},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("error adding event %d to stream: %v", event.EventID, err)
+	}
+
+	return nil
+}
+
+func (p *redisStreamPublisher) Close() error {
+	return p.rdb.Close()
+}
+
+// Publishes nowhere, for running the services without Redis
+type logPublisher struct{}
+
+func (logPublisher) Publish(ctx context.Context, event OutboxEvent) error {
+	log.Printf("Event %d %s for %d: %s", event.EventID, event.EventType, event.AggregateID, event.Payload)
+	return nil
+}
+
+func (logPublisher) Close() error {
+	return nil
+}
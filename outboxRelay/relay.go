@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Services write their domain events to the Outbox table in the same transaction
+// as the change they describe, so an event exists exactly when the change does.
+//
+// Publishes unpublished outbox events in order, forever. An event is marked
+// published only after the broker took it, so a crash in between publishes it
+// again: consumers get every event at least once and must skip duplicates.
+func relayOutbox(db *sqlx.DB, publisher Publisher, pollInterval time.Duration, batchSize int) {
+	for {
+		published, err := relayBatch(db, publisher, batchSize)
+		if err != nil {
+			log.Printf("Error: outbox relay: %v", err)
+		}
+
+		// Keep going while there is a backlog
+		if published < batchSize {
+			time.Sleep(pollInterval)
+		}
+	}
+}
+
+func relayBatch(db *sqlx.DB, publisher Publisher, batchSize int) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback the transaction if it hasn't been committed
+
+	// Locked so a second relay can run without publishing the same events
+	var events []OutboxEvent
+	err = tx.Select(&events, `
+		SELECT EventID, Event_type, Aggregate_id, Payload, Created_at
+		FROM Outbox
+		WHERE Published_at IS NULL
+		ORDER BY EventID
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("outbox query error: %v", err)
+	}
+
+	published := 0
+	for _, event := range events {
+		// Stop at the first failure to keep the events in order
+		err = publisher.Publish(context.Background(), event)
+		if err != nil {
+			break
+		}
+
+		_, err = tx.Exec(`UPDATE Outbox SET Published_at = NOW() WHERE EventID = $1`, event.EventID)
+		if err != nil {
+			err = fmt.Errorf("outbox update error: %v", err)
+			break
+		}
+		published++
+	}
+
+	if commitErr := tx.Commit(); commitErr != nil {
+		return 0, fmt.Errorf("failed to commit published events: %v", commitErr)
+	}
+
+	if published > 0 {
+		log.Printf("Published %d outbox events", published)
+	}
+
+	return published, err
+}
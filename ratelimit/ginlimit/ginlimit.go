@@ -0,0 +1,62 @@
+// Package ginlimit adapts ratelimit to gin
+package ginlimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"ratelimit"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tells whose bucket a request draws from, an empty key isn't limited
+type KeyFunc func(c *gin.Context) string
+
+// Same as ratelimit.Middleware for gin routes
+func Middleware(scope string, limit ratelimit.Limit, key KeyFunc) gin.HandlerFunc {
+	limiter := ratelimit.NewLimiter(scope, limit)
+
+	return func(c *gin.Context) {
+		id := key(c)
+		if id == "" {
+			c.Next()
+			return
+		}
+
+		if seconds := limiter.Wait(c.Request.Context(), id); seconds > 0 {
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": ratelimit.TooManyRequests(seconds)})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Address the request comes from, through the proxies gin trusts
+func ByIP(c *gin.Context) string {
+	return "ip_" + c.ClientIP()
+}
+
+// Username the request is for, so guessing one account's password from many
+// addresses is slowed down too. The body is left for the handler to read.
+func ByUsername(c *gin.Context) string {
+	data, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+
+	var body struct {
+		Username string `json:"username"`
+	}
+	if json.Unmarshal(data, &body) != nil || body.Username == "" {
+		return ""
+	}
+
+	return "username_" + strings.ToLower(body.Username)
+}
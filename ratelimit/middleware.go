@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Tells whose bucket a request draws from, an empty key isn't limited
+type KeyFunc func(r *http.Request) string
+
+// Limits the requests going through it per key, requests over the budget get
+// 429 with Retry-After
+func Middleware(scope string, limit Limit, key KeyFunc) func(http.Handler) http.Handler {
+	limiter := NewLimiter(scope, limit)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := key(r)
+			if id == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if seconds := limiter.Wait(r.Context(), id); seconds > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				http.Error(w, fmt.Sprintf("Error: %s", TooManyRequests(seconds)), http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Address the request comes from
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip_" + host
+}
+
+// User the service's JWT middleware put in the context, by address when there
+// is none. Has to come after the JWT middleware.
+func ByUser(userID func(ctx context.Context) (int, bool)) KeyFunc {
+	return func(r *http.Request) string {
+		id, ok := userID(r.Context())
+		if !ok {
+			return ByIP(r)
+		}
+
+		return "user_" + strconv.Itoa(id)
+	}
+}
+
+// Leaves the requests exempt says so unlimited, e.g. the orchestrator's calls
+// carrying its service token, which are limited per user instead
+func Unless(exempt func(r *http.Request) bool, key KeyFunc) KeyFunc {
+	return func(r *http.Request) string {
+		if exempt(r) {
+			return ""
+		}
+
+		return key(r)
+	}
+}
@@ -0,0 +1,106 @@
+// Package ratelimit limits requests per key with token buckets kept in Redis,
+// so every instance of a service draws from the same budget. The chi services
+// use Middleware, authentication uses the gin adapter in ginlimit.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Refills from the Redis clock, returns whether a token was taken and
+// otherwise how many milliseconds until the next one.
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, retry}
+`)
+
+// Budget of one bucket
+type Limit struct {
+	Rate  float64 // tokens added per second
+	Burst int     // size of the bucket, requests allowed back to back
+}
+
+// n requests a minute, all of them can come at once
+func PerMinute(n int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: n}
+}
+
+// Buckets of one scope, a router can have a budget for all its routes and
+// smaller ones for the expensive routes
+type Limiter struct {
+	rdb   *redis.Client
+	scope string
+	limit Limit
+}
+
+func NewLimiter(scope string, limit Limit) *Limiter {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+
+	return &Limiter{rdb: rdb, scope: scope, limit: limit}
+}
+
+// Takes a token from id's bucket and returns how many seconds to wait when
+// there is none, 0 when the request can go. When Redis can't be reached
+// requests are let through.
+func (l *Limiter) Wait(ctx context.Context, id string) int {
+	retryAfter, err := l.take(ctx, "rate_limit_"+l.scope+"_"+id)
+	if err != nil {
+		log.Printf("Error: rate limit %s unavailable, letting the request through: %v", l.scope, err)
+		return 0
+	}
+
+	return int((retryAfter + time.Second - 1) / time.Second)
+}
+
+func (l *Limiter) take(ctx context.Context, bucket string) (time.Duration, error) {
+	result, err := tokenBucket.Run(ctx, l.rdb, []string{bucket}, l.limit.Rate, l.limit.Burst).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+	if len(result) != 2 {
+		return 0, fmt.Errorf("unexpected token bucket reply %v", result)
+	}
+	if result[0] == 1 {
+		return 0, nil
+	}
+
+	return time.Duration(result[1]) * time.Millisecond, nil
+}
+
+// Message sent with the 429
+func TooManyRequests(seconds int) string {
+	return fmt.Sprintf("Too many requests, retry in %d seconds", seconds)
+}
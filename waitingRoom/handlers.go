@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type QueueForm struct {
+	ShowID int `json:"show_id"`
+	UserID int `json:"user_id"` //user waiting
+}
+
+// Puts the user in the queue of a show on sale, or hands over their token if
+// they were already let in
+func (app *Config) HandleJoinQueue(w http.ResponseWriter, r *http.Request) {
+	app.handleQueue(w, r, func(ctx context.Context, rdb *redis.Client, room *waitingRoom, userID int, now time.Time) (*queueStatus, error) {
+		if now.Before(room.opensAt()) {
+			return &queueStatus{ShowID: room.ShowID, Status: queueNotOpen, OnSaleStart: room.OnSaleStart}, nil
+		}
+
+		return joinQueue(ctx, rdb, room, userID, now)
+	})
+}
+
+// Position in the queue and estimated wait, or the token once let in
+func (app *Config) HandleQueueStatus(w http.ResponseWriter, r *http.Request) {
+	app.handleQueue(w, r, getQueueStatus)
+}
+
+// Gives up the user's place, an admission already given stays valid
+func (app *Config) HandleLeaveQueue(w http.ResponseWriter, r *http.Request) {
+	app.handleQueue(w, r, func(ctx context.Context, rdb *redis.Client, room *waitingRoom, userID int, now time.Time) (*queueStatus, error) {
+		err := leaveQueue(ctx, rdb, room, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		return getQueueStatus(ctx, rdb, room, userID, now)
+	})
+}
+
+type queueAction func(ctx context.Context, rdb *redis.Client, room *waitingRoom, userID int, now time.Time) (*queueStatus, error)
+
+// Reads the form and looks the show up, shows without an on-sale behind a
+// waiting room answer not_required without touching the queue
+func (app *Config) handleQueue(w http.ResponseWriter, r *http.Request, action queueAction) {
+	var queueform QueueForm
+
+	//Read the request payload
+	err := json.NewDecoder(r.Body).Decode(&queueform)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to parse queue form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	db, err := ConnectToDB()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Failed to connect to DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	room, err := getWaitingRoom(db, queueform.ShowID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: Waiting room lookup failed: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	status := &queueStatus{ShowID: room.ShowID, Status: queueNotRequired}
+	if room.required(now) {
+		rdb := redis.NewClient(&redis.Options{
+			Addr:     "localhost:6379",
+			Password: "",
+			DB:       0,
+		})
+		defer rdb.Close()
+
+		status, err = action(context.Background(), rdb, room, queueform.UserID, now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: Queue update failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const webPort = "8094"
+
+type Config struct {
+}
+
+const pgConnectionString = "host=localhost port=5432 user=rayanc dbname=tickets sslmode=disable"
+
+// How often a batch of the queue is admitted
+const admitInterval = 10 * time.Second
+
+func main() {
+	// Admission tokens are only signed with the secret the services share
+	loadAdmissionSecret()
+
+	app := Config{}
+
+	log.Printf("Starting WaitingRoom service on port: %s", webPort)
+
+	// HTTP server
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", webPort),
+		Handler: app.routes(),
+	}
+
+	//DB connection check
+	db, err := ConnectToDB()
+	if err != nil {
+		log.Fatalf("Error: DB connection %v", err)
+		return
+	}
+
+	// The queues of the shows on sale are let in batch by batch in the background
+	go admitQueues(db, admitInterval)
+
+	//Start the web server
+	err = srv.ListenAndServe()
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+// What the queue tells a user
+const (
+	queueWaiting     = "waiting"      // in the queue, position and estimated wait given
+	queueAdmitted    = "admitted"     // let in, the admission token is given
+	queueNotQueued   = "not_queued"   // neither in the queue nor admitted
+	queueNotOpen     = "not_open"     // the waiting room doesn't take users yet
+	queueNotRequired = "not_required" // no on-sale running behind a waiting room, buy directly
+)
+
+// On-sale window of a show, admission tokens are required between On_sale_start
+// and On_sale_end. Users who join between Waiting_room_opens and On_sale_start
+// are let in in a random order, everyone after them in order of arrival.
+type waitingRoom struct {
+	ShowID         int        `db:"showid"`
+	Status         string     `db:"status"`
+	Opens          *time.Time `db:"waiting_room_opens"`
+	OnSaleStart    *time.Time `db:"on_sale_start"`
+	OnSaleEnd      *time.Time `db:"on_sale_end"`
+	AdmitPerMinute int        `db:"admit_per_minute"`
+}
+
+type queueStatus struct {
+	ShowID               int        `json:"show_id"`
+	Status               string     `json:"status"`
+	Position             int64      `json:"position,omitempty"` // 1 for the next user let in
+	EstimatedWaitSeconds int64      `json:"estimated_wait_seconds,omitempty"`
+	AdmissionToken       string     `json:"admission_token,omitempty"`
+	AdmittedUntil        *time.Time `json:"admitted_until,omitempty"`
+	OnSaleStart          *time.Time `json:"on_sale_start,omitempty"`
+}
+
+const waitingRoomColumns = `ShowID, Status, Waiting_room_opens, On_sale_start, On_sale_end, COALESCE(Admit_per_minute, 0) AS admit_per_minute`
+
+func getWaitingRoom(db *sqlx.DB, showID int) (*waitingRoom, error) {
+	var room waitingRoom
+	err := db.Get(&room, `SELECT `+waitingRoomColumns+` FROM Show WHERE ShowID = $1`, showID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("show %d not found", showID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("show lookup error: %v", err)
+	}
+
+	return &room, nil
+}
+
+// The queue only matters until the on-sale ends
+func (room *waitingRoom) required(now time.Time) bool {
+	return room.OnSaleStart != nil && room.OnSaleEnd != nil && now.Before(*room.OnSaleEnd) && room.Status != "cancelled"
+}
+
+func (room *waitingRoom) opensAt() time.Time {
+	if room.Opens != nil && room.Opens.Before(*room.OnSaleStart) {
+		return *room.Opens
+	}
+
+	return *room.OnSaleStart
+}
+
+// Users let in every round
+func (room *waitingRoom) batchSize(interval time.Duration) int64 {
+	batch := int64(room.AdmitPerMinute) * int64(interval) / int64(time.Minute)
+	if batch < 1 {
+		return 1
+	}
+
+	return batch
+}
+
+func queueKey(showID int) string {
+	return "waiting_room_" + strconv.Itoa(showID)
+}
+
+func admittedKey(showID int, userID int) string {
+	return "waiting_room_admitted_" + strconv.Itoa(showID) + "_" + strconv.Itoa(userID)
+}
+
+func admitLockKey(showID int) string {
+	return "waiting_room_lock_" + strconv.Itoa(showID)
+}
+
+// Adds the user to the queue, joining again keeps the place already taken.
+// Early arrivals get a random score below any arrival time so they are all let
+// in first, in an order that doesn't reward refreshing before the on-sale.
+// The score is drawn from the user and the show, leaving and joining again
+// lands on the same place.
+func joinQueue(ctx context.Context, rdb *redis.Client, room *waitingRoom, userID int, now time.Time) (*queueStatus, error) {
+	status, err := getQueueStatus(ctx, rdb, room, userID, now)
+	if err != nil || status.Status != queueNotQueued {
+		return status, err
+	}
+
+	score := float64(now.UnixMilli())
+	if now.Before(*room.OnSaleStart) {
+		score = earlyScore(room.ShowID, userID)
+	}
+
+	key := queueKey(room.ShowID)
+	err = rdb.ZAddNX(ctx, key, redis.Z{Score: score, Member: strconv.Itoa(userID)}).Err()
+	if err != nil {
+		return nil, fmt.Errorf("queue insert error: %v", err)
+	}
+	err = rdb.ExpireAt(ctx, key, room.OnSaleEnd.Add(admissionTTL)).Err()
+	if err != nil {
+		return nil, fmt.Errorf("queue expiry error: %v", err)
+	}
+
+	return getQueueStatus(ctx, rdb, room, userID, now)
+}
+
+// Uniform in [0, 1) and only known to us, HMAC of the show and user under the admission secret
+func earlyScore(showID int, userID int) float64 {
+	mac := hmac.New(sha256.New, admissionSecret)
+	mac.Write([]byte(strconv.Itoa(showID) + "|" + strconv.Itoa(userID)))
+	sum := mac.Sum(nil)
+
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+func getQueueStatus(ctx context.Context, rdb *redis.Client, room *waitingRoom, userID int, now time.Time) (*queueStatus, error) {
+	status := &queueStatus{ShowID: room.ShowID, OnSaleStart: room.OnSaleStart}
+
+	token, err := rdb.Get(ctx, admittedKey(room.ShowID, userID)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("admission lookup error: %v", err)
+	}
+	if err == nil {
+		ttl, err := rdb.TTL(ctx, admittedKey(room.ShowID, userID)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("admission lookup error: %v", err)
+		}
+		until := now.Add(ttl).Truncate(time.Second)
+		status.Status = queueAdmitted
+		status.AdmissionToken = token
+		status.AdmittedUntil = &until
+		return status, nil
+	}
+
+	rank, err := rdb.ZRank(ctx, queueKey(room.ShowID), strconv.Itoa(userID)).Result()
+	if err == redis.Nil {
+		status.Status = queueNotQueued
+		return status, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("queue position lookup error: %v", err)
+	}
+
+	// Batches ahead of the user's one, each a round apart, once the on-sale starts
+	status.Status = queueWaiting
+	status.Position = rank + 1
+	wait := time.Duration(rank/room.batchSize(admitInterval)+1) * admitInterval
+	if now.Before(*room.OnSaleStart) {
+		wait += room.OnSaleStart.Sub(now)
+	}
+	status.EstimatedWaitSeconds = int64(wait.Seconds())
+
+	return status, nil
+}
+
+func leaveQueue(ctx context.Context, rdb *redis.Client, room *waitingRoom, userID int) error {
+	err := rdb.ZRem(ctx, queueKey(room.ShowID), strconv.Itoa(userID)).Err()
+	if err != nil {
+		return fmt.Errorf("queue removal error: %v", err)
+	}
+
+	return nil
+}
+
+// Lets in the next batch of every show on sale, and keeps doing so every interval
+func admitQueues(db *sqlx.DB, interval time.Duration) {
+	for {
+		err := runAdmitRound(db, interval)
+		if err != nil {
+			log.Printf("Error: waiting room admission: %v", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func runAdmitRound(db *sqlx.DB, interval time.Duration) error {
+	var rooms []waitingRoom
+	err := db.Select(&rooms, `
+		SELECT `+waitingRoomColumns+`
+		FROM Show
+		WHERE On_sale_start <= NOW() AND On_sale_end > NOW() AND Status <> 'cancelled'
+		ORDER BY ShowID`)
+	if err != nil {
+		return fmt.Errorf("on-sale shows query error: %v", err)
+	}
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
+	})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	for i := range rooms {
+		err := admitBatch(ctx, rdb, &rooms[i], interval)
+		if err != nil {
+			log.Printf("Error: admitting the queue of show %d: %v", rooms[i].ShowID, err)
+		}
+	}
+
+	return nil
+}
+
+// Takes the head of the queue and gives each of them an admission token. The
+// lock lets only one waitingRoom instance admit a show per round.
+func admitBatch(ctx context.Context, rdb *redis.Client, room *waitingRoom, interval time.Duration) error {
+	locked, err := rdb.SetNX(ctx, admitLockKey(room.ShowID), "1", interval*9/10).Result()
+	if err != nil {
+		return fmt.Errorf("admission lock error: %v", err)
+	}
+	if !locked {
+		return nil
+	}
+
+	// Users only leave the queue once their admission is stored, a failure
+	// leaves them at the head for the next round
+	members, err := rdb.ZRange(ctx, queueKey(room.ShowID), 0, room.batchSize(interval)-1).Result()
+	if err != nil {
+		return fmt.Errorf("queue read error: %v", err)
+	}
+
+	expiresAt := time.Now().Add(admissionTTL)
+	admitted := 0
+	for _, member := range members {
+		userID, err := strconv.Atoi(member)
+		if err != nil {
+			log.Printf("Error: unexpected member %q in the queue of show %d", member, room.ShowID)
+			rdb.ZRem(ctx, queueKey(room.ShowID), member)
+			continue
+		}
+
+		token, err := signAdmission(userID, room.ShowID, expiresAt)
+		if err != nil {
+			return err
+		}
+		err = rdb.Set(ctx, admittedKey(room.ShowID, userID), token, admissionTTL).Err()
+		if err != nil {
+			return fmt.Errorf("admission save error: %v", err)
+		}
+		err = rdb.ZRem(ctx, queueKey(room.ShowID), member).Err()
+		if err != nil {
+			return fmt.Errorf("queue remove error: %v", err)
+		}
+		admitted++
+	}
+
+	if admitted > 0 {
+		log.Printf("Admitted %d users to the on-sale of show %d", admitted, room.ShowID)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"ratelimit"
+	authmiddleware "waitingRoom/auth"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/cors"
+)
+
+// Handlers the routing part, returns Handler to the main.go
+func (app *Config) routes() http.Handler {
+	mux := chi.NewRouter()
+
+	// Specify who is allowed to connect
+	mux.Use(cors.Handler(cors.Options{
+		AllowedOrigins:   []string{"https://*", "http://*"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-TOKEN"},
+		ExposedHeaders:   []string{"Link"},
+		AllowCredentials: true,
+		MaxAge:           300,
+	}))
+
+	//To check if service up or not
+	mux.Use(middleware.Heartbeat("/ping"))
+
+	//Rate limits, per address before the token is even looked at, then per user
+	mux.Use(ratelimit.Middleware("waitingroom_ip", ratelimit.PerMinute(600), ratelimit.ByIP))
+
+	//JWT middleware
+	mux.Use(authmiddleware.JWTMiddleware)
+
+	mux.Use(ratelimit.Middleware("waitingroom_user", ratelimit.PerMinute(120), ratelimit.ByUser(authmiddleware.UserID)))
+
+	//Add route at root level
+	mux.Post("/joinQueue", app.HandleJoinQueue)
+	mux.Post("/queueStatus", app.HandleQueueStatus)
+	mux.Post("/leaveQueue", app.HandleLeaveQueue)
+
+	return mux
+}